@@ -0,0 +1,49 @@
+package ssh
+
+import (
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// maxBreakBufSize is how many breaks will be buffered for a registered
+// channel that isn't receiving them.
+const maxBreakBufSize = 16
+
+// BreakRequest represents a break request as specified in RFC 4335.
+type BreakRequest struct {
+	// Length is the requested length of the break in milliseconds. Servers
+	// are expected to cap it to what the underlying device supports.
+	Length uint32
+}
+
+// Duration returns the requested length of the break.
+func (b BreakRequest) Duration() time.Duration {
+	return time.Duration(b.Length) * time.Millisecond
+}
+
+func parseBreakRequest(payload []byte) (BreakRequest, bool) {
+	var req BreakRequest
+	if err := gossh.Unmarshal(payload, &req); err != nil {
+		return BreakRequest{}, false
+	}
+	return req, true
+}
+
+// handleBreak delivers a break to the registered channels, and reports
+// whether any of them accepted it. A break dropped by both Break and
+// BreakRequests channels is counted once.
+func (sess *session) handleBreak(req BreakRequest) bool {
+	dropped := sess.breaks.dropped.Load() + sess.breakReqs.dropped.Load()
+	ok := sess.breakReqs.push(req)
+	if sess.breaks.push(true) {
+		ok = true
+	}
+	if sess.breaks.dropped.Load()+sess.breakReqs.dropped.Load() != dropped {
+		sess.droppedBreaks.Add(1)
+	}
+	if sess.publish(BreakEvent{req}) {
+		ok = true
+	}
+	return ok
+}
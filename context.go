@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	gossh "golang.org/x/crypto/ssh"
 )
@@ -55,6 +56,37 @@ var (
 	// ContextKeyPublicKey is a context key for use with Contexts in this package.
 	// The associated value will be of type PublicKey.
 	ContextKeyPublicKey = &contextKey{"public-key"}
+
+	// ContextKeySessionIndex is a context key for use with session Contexts
+	// in this package. The associated value will be of type uint32 and numbers
+	// the sessions of a connection from 0 in the order they were opened. It is
+	// not the SSH channel ID.
+	ContextKeySessionIndex = &contextKey{"session-index"}
+
+	// ContextKeyRequestType is a context key for use with session Contexts in
+	// this package. The associated value will be of type string and is one of
+	// "shell", "exec" or "subsystem" once the session has been started.
+	ContextKeyRequestType = &contextKey{"request-type"}
+
+	// ContextKeyStartTime is a context key for use with session Contexts in
+	// this package. The associated value will be of type time.Time and is the
+	// time the session channel was opened.
+	ContextKeyStartTime = &contextKey{"start-time"}
+
+	// ContextKeyPty is a context key for use with session Contexts in this
+	// package. The associated value will be of type Pty and is only set if a
+	// PTY was accepted for the session.
+	ContextKeyPty = &contextKey{"pty"}
+)
+
+var (
+	// contextKeyConnContext is an internal context key for the connection
+	// Context a session Context was derived from.
+	contextKeyConnContext = &contextKey{"conn-context"}
+
+	// contextKeySessionSeq is an internal context key for the counter used to
+	// assign ContextKeySessionIndex.
+	contextKeySessionSeq = &contextKey{"session-seq"}
 )
 
 // Context is a package specific context interface. It exposes connection
@@ -105,9 +137,43 @@ func newContext(srv *Server) (*sshContext, context.CancelFunc) {
 	ctx.SetValue(ContextKeyServer, srv)
 	perms := &Permissions{&gossh.Permissions{}}
 	ctx.SetValue(ContextKeyPermissions, perms)
+	ctx.SetValue(contextKeySessionSeq, new(atomic.Uint32))
+	ctx.SetValue(contextKeyStats, newTraffic())
 	return ctx, cancel
 }
 
+// newSessionContext derives a Context for a session channel from the
+// connection Context. It shares the connection's lock and falls back to the
+// connection's values, but values set on it are only visible to the session.
+func newSessionContext(parent Context) (*sshContext, context.CancelFunc) {
+	ctx, cancel := newChildContext(parent)
+	ctx.SetValue(contextKeyConnContext, parent)
+	if seq, ok := parent.Value(contextKeySessionSeq).(*atomic.Uint32); ok {
+		ctx.SetValue(ContextKeySessionIndex, seq.Add(1)-1)
+	}
+	return ctx, cancel
+}
+
+// newChildContext derives a cancelable Context that shares the parent's lock
+// and falls back to the parent's values.
+func newChildContext(parent Context) (*sshContext, context.CancelFunc) {
+	innerCtx, cancel := context.WithCancel(parent)
+	mu := &sync.Mutex{}
+	if p, ok := parent.(*sshContext); ok {
+		mu = p.Mutex
+	}
+	return &sshContext{Context: innerCtx, Mutex: mu, values: make(map[interface{}]interface{})}, cancel
+}
+
+// ConnContext returns the connection Context that a session Context was
+// derived from. If ctx is already a connection Context, it is returned as is.
+func ConnContext(ctx Context) Context {
+	if parent, ok := ctx.Value(contextKeyConnContext).(Context); ok {
+		return parent
+	}
+	return ctx
+}
+
 // this is separate from newContext because we will get ConnMetadata
 // at different points so it needs to be applied separately
 func applyConnMetadata(ctx Context, conn gossh.ConnMetadata) {
@@ -83,3 +83,86 @@ func TestSetValueConcurrency(t *testing.T) {
 		t.Fatal("context.Value(bar) doesn't match latest SetValue")
 	}
 }
+
+func TestSessionContext(t *testing.T) {
+	t.Parallel()
+	connKey, sessKey := "conn-value", "sess-value"
+	first := make(chan Context, 1)
+	session, client, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: func(s Session) {
+			ctx := s.Context()
+			if ctx.Value(connKey) != true {
+				t.Error("session context should hold connection values")
+			}
+			if ctx.Value(ContextKeyRequestType) != "exec" {
+				t.Errorf("request type = %v; want exec", ctx.Value(ContextKeyRequestType))
+			}
+			if _, ok := ctx.Value(ContextKeyStartTime).(time.Time); !ok {
+				t.Error("start time not set")
+			}
+			if _, ok := ctx.Value(ContextKeyPty).(Pty); ok {
+				t.Error("pty should not be set without a PTY")
+			}
+			if ConnContext(ctx).Value(ContextKeyConn) == nil {
+				t.Error("connection context should be reachable")
+			}
+			if ConnContext(ctx).Value(ContextKeyRequestType) != nil {
+				t.Error("session values should not leak into the connection context")
+			}
+			ctx.SetValue(sessKey, ctx.Value(ContextKeySessionIndex))
+			first <- ctx
+		},
+	}, nil, PasswordAuth(func(ctx Context, password string) bool {
+		ctx.SetValue(connKey, true)
+		return true
+	}))
+	defer cleanup()
+	if err := session.Run("cmd"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := <-first
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session context not canceled after the handler returned")
+	}
+	if ConnContext(ctx).Err() != nil {
+		t.Fatal("connection context should still be live")
+	}
+
+	session2, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session2.Run("cmd"); err != nil {
+		t.Fatal(err)
+	}
+	ctx2 := <-first
+	if ctx.Value(sessKey) != uint32(0) || ctx2.Value(sessKey) != uint32(1) {
+		t.Fatalf("session indexes = %v, %v; want 0, 1", ctx.Value(sessKey), ctx2.Value(sessKey))
+	}
+}
+
+func TestSessionContextCanceledOnChannelClose(t *testing.T) {
+	t.Parallel()
+	canceled := make(chan struct{})
+	started := make(chan struct{})
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			close(started)
+			<-s.Context().Done()
+			close(canceled)
+		},
+	}, nil)
+	defer cleanup()
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	session.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("session context not canceled after the channel closed")
+	}
+}
@@ -0,0 +1,68 @@
+package ssh
+
+import (
+	"path"
+	"strings"
+)
+
+// EnvPolicy restricts the environment variables a client may set with "env"
+// requests, similar to the AcceptEnv option of OpenSSH. Requests for variables
+// that don't satisfy the policy are rejected.
+type EnvPolicy struct {
+	// Allow is a list of path.Match patterns, like "LANG" or "LC_*", of
+	// variable names that may be set. If empty, all names are allowed.
+	Allow []string
+
+	// Deny is a list of path.Match patterns of variable names that may not
+	// be set. Deny takes precedence over Allow.
+	Deny []string
+
+	// MaxVars is the maximum number of variables a session may set,
+	// unlimited if zero.
+	MaxVars int
+
+	// MaxSize is the maximum length of a single "key=value" entry,
+	// unlimited if zero.
+	MaxSize int
+}
+
+// allows reports whether the variable may be added to an environment that
+// already holds count variables.
+func (p *EnvPolicy) allows(key, value string, count int) bool {
+	if key == "" || strings.ContainsRune(key, '=') {
+		return false
+	}
+	if p == nil {
+		return true
+	}
+	if p.MaxVars > 0 && count >= p.MaxVars {
+		return false
+	}
+	if p.MaxSize > 0 && len(key)+1+len(value) > p.MaxSize {
+		return false
+	}
+	if matchAny(p.Deny, key) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchAny(p.Allow, key)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupEnv returns the last value set for key in env, which holds entries
+// of the form "key=value".
+func lookupEnv(env []string, key string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if k, v, ok := strings.Cut(env[i], "="); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,76 @@
+package ssh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnvPolicyAllows(t *testing.T) {
+	policy := &EnvPolicy{
+		Allow:   []string{"LANG", "LC_*", "PATH"},
+		Deny:    []string{"PATH"},
+		MaxVars: 2,
+		MaxSize: 16,
+	}
+	for _, tc := range []struct {
+		key, value string
+		count      int
+		want       bool
+	}{
+		{"LANG", "C.UTF-8", 0, true},
+		{"LC_ALL", "C", 1, true},
+		{"LC_ALL", "C", 2, false},
+		{"PATH", "/bin", 0, false},
+		{"LD_PRELOAD", "/tmp/x.so", 0, false},
+		{"LANG", strings.Repeat("x", 12), 0, false},
+		{"LC_A=B", "C", 0, false},
+	} {
+		if got := policy.allows(tc.key, tc.value, tc.count); got != tc.want {
+			t.Errorf("allows(%q, %q, %d) = %v; want %v", tc.key, tc.value, tc.count, got, tc.want)
+		}
+	}
+	var nilPolicy *EnvPolicy
+	if !nilPolicy.allows("LD_PRELOAD", "x", 100) {
+		t.Error("nil policy should allow all variables")
+	}
+}
+
+func TestEnvPolicySession(t *testing.T) {
+	t.Parallel()
+	done := make(chan struct{})
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: func(s Session) {
+			defer close(done)
+			if v := s.Getenv("LANG"); v != "fr_FR" {
+				t.Errorf("LANG = %q; want the last value set", v)
+			}
+			if _, ok := s.LookupEnv("LD_PRELOAD"); ok {
+				t.Error("LD_PRELOAD should have been rejected")
+			}
+			if _, ok := s.LookupEnv("LC_SECRET"); ok {
+				t.Error("LC_SECRET should have been rejected by the callback")
+			}
+			if env := s.Environ(); len(env) != 2 {
+				t.Errorf("environ = %q; want 2 entries", env)
+			}
+		},
+		EnvCallback: func(sess Session, key, value string) bool {
+			return key != "LC_SECRET"
+		},
+	}, nil, AcceptEnv("LANG", "LC_*"))
+	defer cleanup()
+	for _, kv := range [][2]string{{"LANG", "en_US"}, {"LANG", "fr_FR"}} {
+		if err := session.Setenv(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, kv := range [][2]string{{"LD_PRELOAD", "/tmp/x.so"}, {"LC_SECRET", "x"}} {
+		if err := session.Setenv(kv[0], kv[1]); err == nil {
+			t.Fatalf("expected %s to be rejected", kv[0])
+		}
+	}
+	if err := session.Run(""); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
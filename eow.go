@@ -0,0 +1,18 @@
+package ssh
+
+// eowRequestType is the OpenSSH extension sent by clients once they will no
+// longer write to the session's channel.
+const eowRequestType = "eow@openssh.com"
+
+// contextKeyEndOfWrite is an internal context key for the channel closed when
+// the client sends an eow@openssh.com request.
+var contextKeyEndOfWrite = &contextKey{"end-of-write"}
+
+// EndOfWrite returns a channel that is closed when the client signals with an
+// eow@openssh.com request that it will not send any more data on the session.
+// Clients that don't support the extension only signal this with EOF on the
+// session's channel, in which case the returned channel is never closed.
+func EndOfWrite(sess Session) <-chan struct{} {
+	ch, _ := sess.Context().Value(contextKeyEndOfWrite).(chan struct{})
+	return ch
+}
@@ -0,0 +1,167 @@
+package ssh
+
+import (
+	"io"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// maxEventBufSize is how many events will be buffered for a subscriber that
+// isn't receiving them.
+const maxEventBufSize = 128
+
+// Event is something the client did during a session, as delivered by
+// Session.Events. It is one of WindowChangeEvent, SignalEvent, BreakEvent,
+// EnvEvent, EOFEvent or RequestEvent.
+type Event interface {
+	sessionEvent()
+}
+
+// WindowChangeEvent is sent when the client's terminal is resized.
+type WindowChangeEvent struct {
+	Window Window
+}
+
+// SignalEvent is sent when the client sends a signal.
+type SignalEvent struct {
+	Signal Signal
+}
+
+// BreakEvent is sent when the client sends a break.
+type BreakEvent struct {
+	Break BreakRequest
+}
+
+// EnvEvent is sent when the client sets an environment variable and the
+// server accepts it. Clients normally set variables before the session
+// starts, in which case they are found in Session.Environ instead.
+type EnvEvent struct {
+	Key, Value string
+}
+
+// EOFEvent is sent when the client closes its input, even if the handler
+// hasn't read all of it yet.
+type EOFEvent struct{}
+
+// RequestEvent is sent for session requests the server has no built-in
+// support for, whether or not a SessionRequestHandler handled them.
+type RequestEvent struct {
+	Type    string
+	Payload []byte
+}
+
+func (WindowChangeEvent) sessionEvent() {}
+func (SignalEvent) sessionEvent()       {}
+func (BreakEvent) sessionEvent()        {}
+func (EnvEvent) sessionEvent()          {}
+func (EOFEvent) sessionEvent()          {}
+func (RequestEvent) sessionEvent()      {}
+
+func isWindowChange(old, v Event) bool {
+	_, a := old.(WindowChangeEvent)
+	_, b := v.(WindowChangeEvent)
+	return a && b
+}
+
+func (sess *session) Events() <-chan Event {
+	c := make(chan Event)
+	q := newDeliveryQueue[Event](maxEventBufSize, sess.ctx.Done())
+	q.coalesce = isWindowChange
+	q.closeOnDone = true
+	q.register(c)
+	sess.Lock()
+	sess.subscribers = append(sess.subscribers, q)
+	sess.Unlock()
+	return c
+}
+
+// publish delivers an event to the subscribers, and reports whether any of
+// them accepted it.
+func (sess *session) publish(ev Event) bool {
+	sess.Lock()
+	defer sess.Unlock()
+	ok := false
+	for _, q := range sess.subscribers {
+		if q.push(ev) {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// maxInputBufSize is about how much client input is read ahead of the
+// handler.
+const maxInputBufSize = 64 * 1024
+
+// readInput reads the channel ahead of the handler, so that EOFEvent is sent
+// when the client closes its input rather than when the handler reads up to
+// it.
+func (sess *session) readInput() {
+	buf := make([]byte, maxInputBufSize/2)
+	for {
+		n, err := sess.Channel.Read(buf)
+		sess.inputMu.Lock()
+		sess.pending = append(sess.pending, buf[:n]...)
+		sess.inputErr = err
+		full := len(sess.pending) >= maxInputBufSize
+		sess.inputMu.Unlock()
+		notify(sess.inputReady)
+		if err != nil {
+			if err == io.EOF {
+				sess.publish(EOFEvent{})
+			}
+			return
+		}
+		for full {
+			select {
+			case <-sess.inputSpace:
+			case <-sess.ctx.Done():
+				sess.inputMu.Lock()
+				sess.inputErr = io.EOF
+				sess.inputMu.Unlock()
+				notify(sess.inputReady)
+				return
+			}
+			sess.inputMu.Lock()
+			full = len(sess.pending) >= maxInputBufSize
+			sess.inputMu.Unlock()
+		}
+	}
+}
+
+func (sess *session) Read(p []byte) (int, error) {
+	for {
+		sess.inputMu.Lock()
+		n := copy(p, sess.pending)
+		sess.pending = sess.pending[n:]
+		err := sess.inputErr
+		more := len(sess.pending) > 0 || err != nil
+		sess.inputMu.Unlock()
+		if more {
+			// let other readers see what's left
+			notify(sess.inputReady)
+		}
+		if n > 0 {
+			notify(sess.inputSpace)
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		<-sess.inputReady
+	}
+}
+
+// notify does a non-blocking send on a channel with a buffer of one.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// newRequestEvent copies the payload, so subscribers don't share it with the
+// request handlers.
+func newRequestEvent(req *gossh.Request) RequestEvent {
+	return RequestEvent{Type: req.Type, Payload: append([]byte(nil), req.Payload...)}
+}
@@ -0,0 +1,139 @@
+package ssh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestSessionEvents(t *testing.T) {
+	t.Parallel()
+	ready := make(chan struct{})
+	release := make(chan struct{})
+	got := make(chan []string, 1)
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			// the window channel is never received from, which must not
+			// block the request loop
+			events := s.Events()
+			close(ready)
+			<-release
+			var seen []string
+			for ev := range events {
+				switch ev := ev.(type) {
+				case WindowChangeEvent:
+					seen = append(seen, fmt.Sprintf("window %dx%d", ev.Window.Width, ev.Window.Height))
+				case SignalEvent:
+					seen = append(seen, "signal "+string(ev.Signal))
+				case BreakEvent:
+					seen = append(seen, "break "+ev.Break.Duration().String())
+				case RequestEvent:
+					seen = append(seen, "request "+ev.Type+" "+string(ev.Payload))
+				case EOFEvent:
+					seen = append(seen, "eof")
+					got <- seen
+					return
+				}
+			}
+		},
+	}, nil)
+	defer cleanup()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	<-ready
+	for _, w := range []uint32{100, 120, 140, 160, 180} {
+		winchMsg := struct{ w, h uint32 }{w, 40}
+		if ok, err := session.SendRequest("window-change", true, gossh.Marshal(&winchMsg)); err != nil || !ok {
+			t.Fatalf("window-change failed: %v %v", ok, err)
+		}
+	}
+	if err := session.Signal(gossh.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := session.SendRequest("break", true, gossh.Marshal(BreakRequest{Length: 250})); err != nil || !ok {
+		t.Fatalf("expected break to be accepted by the subscriber: %v %v", ok, err)
+	}
+	if ok, err := session.SendRequest("vendor@example.com", true, []byte("hi")); err != nil || ok {
+		t.Fatalf("expected unhandled request to be rejected: %v %v", ok, err)
+	}
+	// the handler never reads the input, but still sees its end
+	if _, err := stdin.Write([]byte("unread")); err != nil {
+		t.Fatal(err)
+	}
+	stdin.Close()
+	close(release)
+
+	// the first window change was already being delivered, and the later
+	// ones were coalesced into the last
+	want := fmt.Sprint([]string{
+		"window 100x40",
+		"window 180x40",
+		"signal INT",
+		"break 250ms",
+		"request vendor@example.com hi",
+		"eof",
+	})
+	select {
+	case seen := <-got:
+		if fmt.Sprint(seen) != want {
+			t.Fatalf("events = %v; want %v", seen, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for events")
+	}
+}
+
+func TestSessionEventsClosed(t *testing.T) {
+	t.Parallel()
+	closed := make(chan bool, 1)
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			events := s.Events()
+			go func() {
+				for range events {
+				}
+				closed <- true
+			}()
+		},
+	}, nil)
+	defer cleanup()
+	if err := session.Run(""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected events channel to be closed")
+	}
+}
+
+func TestDeliveryQueueBuffered(t *testing.T) {
+	t.Parallel()
+	done := make(chan struct{})
+	defer close(done)
+	q := newDeliveryQueue[int](2, done)
+	q.buffered = true
+	for i := 1; i <= 3; i++ {
+		q.push(i)
+	}
+	if n := q.dropped.Load(); n != 1 {
+		t.Fatalf("dropped = %d; want 1", n)
+	}
+	c := make(chan int)
+	q.register(c)
+	for want := 1; want <= 2; want++ {
+		if v := <-c; v != want {
+			t.Fatalf("got %d; want %d", v, want)
+		}
+	}
+}
@@ -38,3 +38,16 @@ func ExamplePublicKeyAuth() {
 func ExampleHostKeyFile() {
 	ssh.ListenAndServe(":2222", nil, ssh.HostKeyFile("/path/to/host/key"))
 }
+
+func ExampleSessionMux() {
+	mux := ssh.NewSessionMux()
+	mux.HandleCommand("hello", "say hello", func(s ssh.Session) {
+		fs := ssh.NewFlagSet(s)
+		name := fs.String("name", "world", "who to greet")
+		if !ssh.ParseFlags(s, fs) {
+			return
+		}
+		io.WriteString(s, "Hello "+*name+"\n")
+	})
+	ssh.ListenAndServe(":2222", mux.HandleSession)
+}
@@ -0,0 +1,112 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// HandlerE is like Handler, but returns an error that determines how the
+// session exits. Use ErrorHandler or ErrorSubsystemHandler to adapt it.
+type HandlerE func(Session) error
+
+// ExitError is an error that ends a session with a specific exit status or
+// signal, and an optional message for the client.
+type ExitError struct {
+	// Code is the exit status sent to the client.
+	Code int
+
+	// Signal, if set, is sent to the client as the signal the session was
+	// terminated by, instead of an exit status.
+	Signal Signal
+
+	// Message, if set, is written to the session's stderr.
+	Message string
+}
+
+// ExitErrorf returns an ExitError with the given exit status and a message
+// formatted according to a format specifier.
+func ExitErrorf(code int, format string, args ...interface{}) *ExitError {
+	return &ExitError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *ExitError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	if e.Signal != "" {
+		return "ssh: terminated by signal " + string(e.Signal)
+	}
+	return fmt.Sprintf("ssh: exit status %d", e.Code)
+}
+
+// ExitCode returns the exit status.
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// ErrorHandler adapts a HandlerE into a Handler that exits the session
+// according to the returned error:
+//
+//   - nil exits with status 0.
+//   - An *ExitError writes its message to stderr and exits with its status,
+//     or with its signal if set.
+//   - An error with an ExitCode() int method, like *exec.ExitError, exits
+//     with that status without writing anything, since the failed command is
+//     expected to have reported the problem itself.
+//   - Any other error is written to stderr and exits with status 1.
+func ErrorHandler(h HandlerE) Handler {
+	return func(s Session) {
+		exitWithError(s, h(s))
+	}
+}
+
+// ErrorSubsystemHandler adapts a HandlerE into a SubsystemHandler the same
+// way as ErrorHandler.
+func ErrorSubsystemHandler(h HandlerE) SubsystemHandler {
+	return SubsystemHandler(ErrorHandler(h))
+}
+
+func exitWithError(s Session, err error) {
+	if err == nil {
+		s.Exit(0)
+		return
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		// the message goes to stderr only, not also into exit-signal
+		writeExitMessage(s, exitErr.Message)
+		if exitErr.Signal != "" {
+			s.ExitSignal(exitErr.Signal, "")
+			return
+		}
+		s.Exit(exitErr.Code)
+		return
+	}
+	var coder interface{ ExitCode() int }
+	if errors.As(err, &coder) && coder.ExitCode() >= 0 {
+		s.Exit(coder.ExitCode())
+		return
+	}
+	writeExitMessage(s, err.Error())
+	s.Exit(1)
+}
+
+func writeExitMessage(s Session, msg string) {
+	if msg == "" {
+		return
+	}
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	io.WriteString(s.Stderr(), msg)
+}
+
+// exit-signal as specified in RFC 4254 Section 6.10
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Message    string
+	Language   string
+}
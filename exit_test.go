@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type exitCoder int
+
+func (c exitCoder) Error() string { return "command failed" }
+func (c exitCoder) ExitCode() int { return int(c) }
+
+func TestErrorHandler(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name   string
+		err    error
+		status int
+		signal string
+		stderr string
+	}{
+		{"nil", nil, 0, "", ""},
+		{"exit error", ExitErrorf(3, "bad input"), 3, "", "bad input\n"},
+		{"wrapped exit error", fmt.Errorf("wrapped: %w", &ExitError{Code: 4}), 4, "", ""},
+		{"signal", &ExitError{Signal: SIGTERM, Message: "terminated"}, -1, "TERM", "terminated\n"},
+		{"exit coder", exitCoder(7), 7, "", ""},
+		{"other error", errors.New("boom"), 1, "", "boom\n"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			session, _, cleanup := newTestSession(t, &Server{
+				Handler: ErrorHandler(func(s Session) error {
+					return tc.err
+				}),
+			}, nil)
+			defer cleanup()
+			var stderr bytes.Buffer
+			session.Stderr = &stderr
+			err := session.Run("")
+			if tc.status == 0 && tc.signal == "" {
+				if err != nil {
+					t.Fatalf("expected nil but got %v", err)
+				}
+			} else {
+				var exitErr *gossh.ExitError
+				if !errors.As(err, &exitErr) {
+					t.Fatalf("expected ExitError but got %T %v", err, err)
+				}
+				if exitErr.Signal() != tc.signal {
+					t.Fatalf("signal = %q; want %q", exitErr.Signal(), tc.signal)
+				}
+				// the message is only written to stderr
+				if exitErr.Msg() != "" {
+					t.Fatalf("exit message = %q; want none", exitErr.Msg())
+				}
+				if tc.signal == "" && exitErr.ExitStatus() != tc.status {
+					t.Fatalf("status = %d; want %d", exitErr.ExitStatus(), tc.status)
+				}
+			}
+			if stderr.String() != tc.stderr {
+				t.Fatalf("stderr = %q; want %q", stderr.String(), tc.stderr)
+			}
+		})
+	}
+}
+
+func TestErrorSubsystemHandler(t *testing.T) {
+	t.Parallel()
+	_, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {},
+		SubsystemHandlers: map[string]SubsystemHandler{
+			"test": ErrorSubsystemHandler(func(s Session) error {
+				return ExitErrorf(5, "unsupported")
+			}),
+		},
+	}, nil)
+	defer cleanup()
+	// the client session doesn't wait for subsystems, so use a raw channel
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	ok, err := ch.SendRequest("subsystem", true, gossh.Marshal(struct{ Name string }{"test"}))
+	if err != nil || !ok {
+		t.Fatalf("subsystem request failed: %v %v", ok, err)
+	}
+	stderr, err := io.ReadAll(ch.Stderr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stderr) != "unsupported\n" {
+		t.Fatalf("stderr = %q; want %q", stderr, "unsupported\n")
+	}
+	for req := range reqs {
+		if req.Type != "exit-status" {
+			continue
+		}
+		var status struct{ Status uint32 }
+		gossh.Unmarshal(req.Payload, &status)
+		if status.Status != 5 {
+			t.Fatalf("status = %d; want 5", status.Status)
+		}
+		return
+	}
+	t.Fatal("no exit-status received")
+}
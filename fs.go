@@ -0,0 +1,377 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WritableFS is a file system that can be modified, for use by file transfer
+// subsystems. Names are slash-separated paths as accepted by fs.ValidPath.
+type WritableFS interface {
+	fs.FS
+
+	// OpenFile opens a file with flags like os.OpenFile, such as
+	// os.O_RDWR|os.O_CREATE|os.O_TRUNC.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+
+	// Mkdir creates a directory.
+	Mkdir(name string, perm fs.FileMode) error
+
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+
+	// Rename renames a file or directory, replacing newname if it exists.
+	Rename(oldname, newname string) error
+}
+
+// File is an open file of a WritableFS.
+type File interface {
+	fs.File
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+
+	// Truncate changes the size of the file.
+	Truncate(size int64) error
+}
+
+// ChmodFS is a WritableFS that can change file modes.
+type ChmodFS interface {
+	WritableFS
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// ChownFS is a WritableFS that can change file ownership.
+type ChownFS interface {
+	WritableFS
+	Chown(name string, uid, gid int) error
+}
+
+// ChtimesFS is a WritableFS that can change file access and modification
+// times.
+type ChtimesFS interface {
+	WritableFS
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// SymlinkFS is a file system with symbolic links.
+type SymlinkFS interface {
+	fs.FS
+
+	// Lstat returns information about a file without following a final
+	// symbolic link.
+	Lstat(name string) (fs.FileInfo, error)
+
+	// ReadLink returns the target of a symbolic link.
+	ReadLink(name string) (string, error)
+
+	// Symlink creates newname as a symbolic link to oldname. Implementations
+	// may refuse targets outside of the file system.
+	Symlink(oldname, newname string) error
+}
+
+// LinkFS is a WritableFS with hard links.
+type LinkFS interface {
+	WritableFS
+	Link(oldname, newname string) error
+}
+
+// StatVFS holds file system statistics, as returned by statvfs(3).
+type StatVFS struct {
+	BlockSize       uint64 // file system block size
+	FragmentSize    uint64 // fundamental block size
+	Blocks          uint64 // size of the file system in fragments
+	BlocksFree      uint64 // free blocks
+	BlocksAvailable uint64 // free blocks available to unprivileged users
+	Files           uint64 // number of inodes
+	FilesFree       uint64 // free inodes
+	FilesAvailable  uint64 // free inodes available to unprivileged users
+	ID              uint64 // file system ID
+	Flags           uint64 // mount flags, like StatVFSReadOnly
+	MaxNameLength   uint64 // maximum file name length
+}
+
+// Mount flags for StatVFS.Flags.
+const (
+	StatVFSReadOnly = 0x1
+	StatVFSNoSUID   = 0x2
+)
+
+// StatVFSFS is a file system that can report its statistics.
+type StatVFSFS interface {
+	fs.FS
+	StatVFS(name string) (*StatVFS, error)
+}
+
+// FileOp is a kind of file operation performed by a file transfer subsystem.
+type FileOp int
+
+const (
+	FileRead    FileOp = iota + 1 // reading a file
+	FileWrite                     // creating, writing or truncating a file
+	FileList                      // listing a directory
+	FileStat                      // reading attributes or the target of a symbolic link
+	FileSetstat                   // changing attributes, and also FileWrite to change the size
+	FileMkdir                     // creating a directory
+	FileRemove                    // removing a file or directory
+	FileRename                    // renaming a file or directory
+	FileLink                      // creating a hard or symbolic link
+)
+
+var fileOpNames = map[FileOp]string{
+	FileRead:    "read",
+	FileWrite:   "write",
+	FileList:    "list",
+	FileStat:    "stat",
+	FileSetstat: "setstat",
+	FileMkdir:   "mkdir",
+	FileRemove:  "remove",
+	FileRename:  "rename",
+	FileLink:    "link",
+}
+
+func (op FileOp) String() string {
+	if name, ok := fileOpNames[op]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// FileRequest describes a file operation for a FileAuthorizer.
+type FileRequest struct {
+	// Op is the kind of operation.
+	Op FileOp
+
+	// Path is the file the operation applies to, as a path in the file
+	// system.
+	Path string
+
+	// Target is the new path for FileRename and the path of the new link
+	// for FileLink.
+	Target string
+}
+
+// FileAuthorizer is a hook for authorizing file operations in file transfer
+// subsystems. Returning an error denies the operation, and the error is
+// reported to the client.
+type FileAuthorizer func(s Session, req FileRequest) error
+
+// fileAuthError is an error returned by a FileAuthorizer. Its message is
+// reported to the client.
+type fileAuthError struct {
+	err error
+}
+
+func (e *fileAuthError) Error() string { return e.err.Error() }
+func (e *fileAuthError) Unwrap() error { return e.err }
+
+func (e *fileAuthError) Is(target error) bool {
+	return target == fs.ErrPermission
+}
+
+func authorizeFile(auth FileAuthorizer, s Session, req FileRequest) error {
+	if auth == nil {
+		return nil
+	}
+	if err := auth(s, req); err != nil {
+		return &fileAuthError{err}
+	}
+	return nil
+}
+
+// errUnsupported is returned for operations a file system doesn't support.
+var errUnsupported = errors.New("operation not supported")
+
+// fsPath converts a path sent by a client into a path in a file system,
+// treating the root of the file system as both "/" and the working
+// directory.
+func fsPath(p string) string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+// writableFS returns the file system if it can be modified.
+func writableFS(fsys fs.FS) (WritableFS, error) {
+	wfs, ok := fsys.(WritableFS)
+	if !ok {
+		return nil, fs.ErrPermission
+	}
+	return wfs, nil
+}
+
+// lstatFS is like fs.Stat, but doesn't follow a final symbolic link if the
+// file system supports them.
+func lstatFS(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if lfs, ok := fsys.(SymlinkFS); ok {
+		return lfs.Lstat(name)
+	}
+	return fs.Stat(fsys, name)
+}
+
+// OSFS returns a WritableFS for the directory tree rooted at dir, which also
+// implements ChmodFS, ChownFS, ChtimesFS, SymlinkFS and LinkFS, and StatVFSFS
+// on Linux.
+//
+// Like os.DirFS, OSFS keeps names from reaching outside of dir, but it follows
+// symbolic links that already exist in the tree, which may point anywhere. It
+// refuses to create symbolic links with absolute targets or targets with ".."
+// elements, which could leave the tree once the link is renamed.
+func OSFS(dir string) WritableFS {
+	return osFS(dir)
+}
+
+type osFS string
+
+func (dir osFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(string(dir), filepath.FromSlash(name)), nil
+}
+
+func (dir osFS) Open(name string) (fs.File, error) {
+	return dir.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (dir osFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	full, err := dir.join("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(full, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (dir osFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := dir.join("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(full)
+}
+
+func (dir osFS) Lstat(name string) (fs.FileInfo, error) {
+	full, err := dir.join("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(full)
+}
+
+func (dir osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := dir.join("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(full)
+}
+
+func (dir osFS) Mkdir(name string, perm fs.FileMode) error {
+	full, err := dir.join("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(full, perm)
+}
+
+func (dir osFS) Remove(name string) error {
+	full, err := dir.join("remove", name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	return os.Remove(full)
+}
+
+func (dir osFS) Rename(oldname, newname string) error {
+	oldFull, err := dir.join("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newFull, err := dir.join("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldFull, newFull)
+}
+
+func (dir osFS) Chmod(name string, mode fs.FileMode) error {
+	full, err := dir.join("chmod", name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(full, mode)
+}
+
+func (dir osFS) Chown(name string, uid, gid int) error {
+	full, err := dir.join("chown", name)
+	if err != nil {
+		return err
+	}
+	return os.Chown(full, uid, gid)
+}
+
+func (dir osFS) Chtimes(name string, atime, mtime time.Time) error {
+	full, err := dir.join("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(full, atime, mtime)
+}
+
+func (dir osFS) ReadLink(name string) (string, error) {
+	full, err := dir.join("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(full)
+}
+
+func (dir osFS) Symlink(oldname, newname string) error {
+	full, err := dir.join("symlink", newname)
+	if err != nil {
+		return err
+	}
+	// the target is resolved relative to wherever the link is moved, so it
+	// may not climb up the tree at all
+	if path.IsAbs(oldname) || hasDotDot(oldname) {
+		return &fs.PathError{Op: "symlink", Path: oldname, Err: fs.ErrPermission}
+	}
+	return os.Symlink(filepath.FromSlash(oldname), full)
+}
+
+// hasDotDot reports whether a slash-separated path has a ".." element.
+func hasDotDot(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func (dir osFS) Link(oldname, newname string) error {
+	oldFull, err := dir.join("link", oldname)
+	if err != nil {
+		return err
+	}
+	newFull, err := dir.join("link", newname)
+	if err != nil {
+		return err
+	}
+	return os.Link(oldFull, newFull)
+}
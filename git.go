@@ -0,0 +1,359 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GitAccess is the kind of access a git command needs to a repository.
+type GitAccess int
+
+const (
+	GitRead  GitAccess = iota + 1 // fetching and cloning
+	GitWrite                      // pushing
+)
+
+func (a GitAccess) String() string {
+	switch a {
+	case GitRead:
+		return "read"
+	case GitWrite:
+		return "write"
+	}
+	return "unknown"
+}
+
+// gitServices maps the git commands run over SSH to the access they need.
+var gitServices = map[string]GitAccess{
+	"git-upload-pack":    GitRead,
+	"git-upload-archive": GitRead,
+	"git-receive-pack":   GitWrite,
+}
+
+// GitRequest describes a git command run by a client.
+type GitRequest struct {
+	// Service is the git command, like "git-upload-pack" or
+	// "git-receive-pack".
+	Service string
+
+	// Repo is the requested repository as a clean relative path, like
+	// "team/project.git".
+	Repo string
+
+	// Dir is the directory of the repository on disk.
+	Dir string
+
+	// Access is the access the command needs.
+	Access GitAccess
+
+	// Protocol is the value of the GIT_PROTOCOL environment variable sent
+	// by the client, like "version=2", or empty.
+	Protocol string
+}
+
+// RefUpdate is a change to a ref pushed by a client. Old is empty when the
+// ref is created and New is empty when it is deleted.
+type RefUpdate struct {
+	Ref string
+	Old string
+	New string
+}
+
+// GitServer serves git repositories over SSH by running the local git
+// binary for the git-upload-pack, git-upload-archive and git-receive-pack
+// commands run by git clients. Clients can only request protocol version 2
+// if the server accepts GIT_PROTOCOL in "env" requests.
+type GitServer struct {
+	// Root is the directory holding the repositories. Repositories are
+	// looked up by their path relative to Root, with or without a ".git"
+	// suffix.
+	Root string
+
+	// GitPath is the path of the git binary. It defaults to "git".
+	GitPath string
+
+	// Authorize is called before running a git command. Returning an error
+	// refuses the command and reports the error to the client. Authorize may
+	// create the repository, for example to allow pushing new repositories.
+	// If it is nil, repositories are read-only.
+	Authorize func(s Session, req GitRequest) error
+
+	// PreReceive, if non-nil, is called with the ref updates of a push
+	// before they are passed to git. Returning an error rejects the push
+	// and reports the error to the client.
+	PreReceive func(s Session, req GitRequest, updates []RefUpdate) error
+
+	// PostReceive, if non-nil, is called with the ref updates that git
+	// applied once a push has completed.
+	PostReceive func(s Session, req GitRequest, updates []RefUpdate)
+}
+
+// HandleSession runs the git command requested by the session and can be
+// used as a Handler. Other commands are rejected with exit status 1.
+func (srv *GitServer) HandleSession(s Session) {
+	exitWithError(s, srv.serve(s))
+}
+
+func (srv *GitServer) serve(s Session) error {
+	req, err := parseGitCommand(s.Command())
+	if err != nil {
+		return ExitErrorf(1, "%s", err)
+	}
+	req.Dir = filepath.Join(srv.Root, filepath.FromSlash(req.Repo))
+	if !isDir(req.Dir) && !strings.HasSuffix(req.Repo, ".git") && isDir(req.Dir+".git") {
+		req.Repo += ".git"
+		req.Dir += ".git"
+	}
+	req.Protocol, _ = s.LookupEnv("GIT_PROTOCOL")
+	if srv.Authorize != nil {
+		if err := srv.Authorize(s, req); err != nil {
+			return ExitErrorf(1, "fatal: %s", err)
+		}
+	} else if req.Access == GitWrite {
+		return ExitErrorf(1, "fatal: push access denied")
+	}
+	if !isDir(req.Dir) {
+		return ExitErrorf(128, "fatal: '%s' does not appear to be a git repository", req.Repo)
+	}
+
+	gitPath := srv.GitPath
+	if gitPath == "" {
+		gitPath = "git"
+	}
+	ctx, cancel := context.WithCancel(s.Context())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, gitPath, strings.TrimPrefix(req.Service, "git-"), req.Dir)
+	cmd.Env = os.Environ()
+	if req.Protocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+req.Protocol)
+	}
+	cmd.Stdout = s
+	cmd.Stderr = s.Stderr()
+	// copy stdin ourselves, since git may exit before the client closes
+	// its end and cmd.Wait would wait for the copy
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var updates []RefUpdate
+	var rejected error
+	go func() {
+		defer stdin.Close()
+		if req.Access != GitWrite || (srv.PreReceive == nil && srv.PostReceive == nil) {
+			io.Copy(stdin, s)
+			return
+		}
+		r := bufio.NewReader(s)
+		var raw bytes.Buffer
+		u, err := readRefUpdates(io.TeeReader(r, &raw))
+		if err == nil && srv.PreReceive != nil && len(u) > 0 {
+			if err := srv.PreReceive(s, req, u); err != nil {
+				mu.Lock()
+				rejected = err
+				mu.Unlock()
+				cancel()
+				return
+			}
+		}
+		mu.Lock()
+		updates = u
+		mu.Unlock()
+		if _, err := stdin.Write(raw.Bytes()); err != nil {
+			return
+		}
+		io.Copy(stdin, r)
+	}()
+
+	err = cmd.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if rejected != nil {
+		return ExitErrorf(1, "error: push rejected: %s", rejected)
+	}
+	if err != nil {
+		return err
+	}
+	if srv.PostReceive != nil && len(updates) > 0 {
+		if applied := gitAppliedUpdates(gitPath, req.Dir, updates); len(applied) > 0 {
+			srv.PostReceive(s, req, applied)
+		}
+	}
+	return nil
+}
+
+func isDir(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
+
+// parseGitCommand parses a git command like "git-upload-pack '/repo.git'"
+// or "git upload-pack repo.git", validating the repository path.
+func parseGitCommand(args []string) (GitRequest, error) {
+	if len(args) == 3 && args[0] == "git" {
+		args = []string{"git-" + args[1], args[2]}
+	}
+	if len(args) != 2 {
+		return GitRequest{}, errors.New("only git commands are supported")
+	}
+	access, ok := gitServices[args[0]]
+	if !ok {
+		return GitRequest{}, errors.New("only git commands are supported")
+	}
+	repo, err := cleanRepoPath(args[1])
+	if err != nil {
+		return GitRequest{}, err
+	}
+	return GitRequest{Service: args[0], Repo: repo, Access: access}, nil
+}
+
+// cleanRepoPath validates a repository path sent by a client and returns it
+// as a clean relative path.
+func cleanRepoPath(p string) (string, error) {
+	repo := strings.TrimPrefix(p, "~/")
+	for _, c := range repo {
+		if c < ' ' || c == 0x7f || c == '\\' || c == ':' {
+			return "", fmt.Errorf("invalid repository path %q", p)
+		}
+	}
+	repo = path.Clean("/" + repo)[1:]
+	if repo == "" || strings.HasPrefix(repo, "-") {
+		return "", fmt.Errorf("invalid repository path %q", p)
+	}
+	for _, elem := range strings.Split(repo, "/") {
+		// keep clients out of .git directories and other hidden files
+		if strings.HasPrefix(elem, ".") {
+			return "", fmt.Errorf("invalid repository path %q", p)
+		}
+	}
+	return repo, nil
+}
+
+// readRefUpdates reads the commands at the start of a push, up to the flush
+// packet that ends them.
+func readRefUpdates(r io.Reader) ([]RefUpdate, error) {
+	var updates []RefUpdate
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			return updates, nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if i := bytes.IndexByte(line, 0); i >= 0 {
+			// capabilities follow the first command
+			line = line[:i]
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) != 3 {
+			// like "shallow <id>" lines
+			continue
+		}
+		u := RefUpdate{Old: fields[0], New: fields[1], Ref: fields[2]}
+		if isZeroObjectID(u.Old) {
+			u.Old = ""
+		}
+		if isZeroObjectID(u.New) {
+			u.New = ""
+		}
+		updates = append(updates, u)
+	}
+}
+
+func isZeroObjectID(id string) bool {
+	return strings.Trim(id, "0") == ""
+}
+
+// gitAppliedUpdates returns the updates that are reflected in the
+// repository, leaving out those git refused.
+func gitAppliedUpdates(gitPath, dir string, updates []RefUpdate) []RefUpdate {
+	var applied []RefUpdate
+	for _, u := range updates {
+		out, err := exec.Command(gitPath, "--git-dir", dir, "rev-parse", "--verify", "--quiet", u.Ref).Output()
+		current := strings.TrimSpace(string(out))
+		if err != nil {
+			current = ""
+		}
+		if current == u.New {
+			applied = append(applied, u)
+		}
+	}
+	return applied
+}
+
+// maxPktLine is the largest pkt-line allowed by git.
+const maxPktLine = 65520
+
+// errDelimPkt is returned by readPktLine for a delimiter packet, which
+// separates sections of a message in newer protocols.
+var errDelimPkt = errors.New("delimiter packet")
+
+// readPktLine reads a pkt-line, returning nil for a flush packet and an
+// empty slice for an empty packet.
+func readPktLine(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", hdr)
+	}
+	switch {
+	case n == 0:
+		return nil, nil
+	case n == 1:
+		return nil, errDelimPkt
+	case n < 4 || n > maxPktLine:
+		return nil, fmt.Errorf("invalid pkt-line length %q", hdr)
+	}
+	line := make([]byte, n-4)
+	if _, err := io.ReadFull(r, line); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return line, nil
+}
+
+// writePktLine writes data as a pkt-line.
+func writePktLine(w io.Writer, data []byte) error {
+	if len(data)+4 > maxPktLine {
+		return errors.New("pkt-line too long")
+	}
+	if _, err := fmt.Fprintf(w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// writeFlushPkt writes a flush packet.
+func writeFlushPkt(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+// writeDelimPkt writes a delimiter packet.
+func writeDelimPkt(w io.Writer) error {
+	_, err := io.WriteString(w, "0001")
+	return err
+}
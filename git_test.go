@@ -0,0 +1,209 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseGitCommand(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		args    []string
+		service string
+		repo    string
+	}{
+		{[]string{"git-upload-pack", "/repo.git"}, "git-upload-pack", "repo.git"},
+		{[]string{"git-receive-pack", "team/repo"}, "git-receive-pack", "team/repo"},
+		{[]string{"git", "upload-archive", "~/repo"}, "git-upload-archive", "repo"},
+		{[]string{"git-upload-pack", "/a/../../../etc"}, "git-upload-pack", "etc"},
+		{[]string{"git-upload-pack", "repo/.git"}, "", ""},
+		{[]string{"git-upload-pack", "../.ssh"}, "", ""},
+		{[]string{"git-upload-pack", "/"}, "", ""},
+		{[]string{"git-upload-pack", "--help"}, "", ""},
+		{[]string{"git-upload-pack", "a\nb"}, "", ""},
+		{[]string{"git-upload-pack"}, "", ""},
+		{[]string{"git-shell", "repo"}, "", ""},
+		{[]string{"sh", "-c", "git-upload-pack repo"}, "", ""},
+	} {
+		req, err := parseGitCommand(tt.args)
+		if tt.service == "" {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if req.Service != tt.service || req.Repo != tt.repo {
+			t.Errorf("%q: got %s %s; want %s %s", tt.args, req.Service, req.Repo, tt.service, tt.repo)
+		}
+	}
+}
+
+func TestReadRefUpdates(t *testing.T) {
+	t.Parallel()
+	zero := strings.Repeat("0", 40)
+	a, b := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	var buf bytes.Buffer
+	for _, line := range []string{
+		"shallow " + a + "\n",
+		a + " " + b + " refs/heads/main\x00report-status side-band-64k\n",
+		zero + " " + a + " refs/heads/new\n",
+		b + " " + zero + " refs/tags/old\n",
+	} {
+		fmt.Fprintf(&buf, "%04x%s", len(line)+4, line)
+	}
+	buf.WriteString("0000PACK")
+	updates, err := readRefUpdates(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RefUpdate{
+		{Ref: "refs/heads/main", Old: a, New: b},
+		{Ref: "refs/heads/new", New: a},
+		{Ref: "refs/tags/old", Old: b},
+	}
+	if fmt.Sprint(updates) != fmt.Sprint(want) {
+		t.Fatalf("updates = %v; want %v", updates, want)
+	}
+	if buf.String() != "PACK" {
+		t.Fatalf("read past the flush packet")
+	}
+}
+
+// gitTestServer serves git repositories in a temporary directory, and
+// returns a function to run git commands against it.
+func gitTestServer(t *testing.T, gs *GitServer) func(dir string, args ...string) (string, error) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found")
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found")
+	}
+	l := newLocalListener()
+	srv := &Server{Handler: gs.HandleSession}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	_, port, _ := strings.Cut(l.Addr().String(), ":")
+	sshCommand := "ssh -F /dev/null -p " + port + " -o StrictHostKeyChecking=no " +
+		"-o UserKnownHostsFile=/dev/null -o BatchMode=yes -o LogLevel=ERROR"
+	return func(dir string, args ...string) (string, error) {
+		cmd := exec.Command(gitPath, append([]string{
+			"-c", "user.name=test", "-c", "user.email=test@example.com",
+			"-c", "init.defaultBranch=main",
+		}, args...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND="+sshCommand, "GIT_SSH_VARIANT=ssh")
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+}
+
+func TestGitServer(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	var mu sync.Mutex
+	var log []string
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		log = append(log, fmt.Sprintf(format, args...))
+	}
+	git := gitTestServer(t, &GitServer{
+		Root: root,
+		Authorize: func(s Session, req GitRequest) error {
+			logf("%s %s %s %s", req.Access, req.Service, req.Repo, req.Protocol)
+			if req.Access == GitWrite && !isDir(req.Dir) {
+				return exec.Command("git", "init", "-q", "--bare", "--initial-branch=main", req.Dir).Run()
+			}
+			return nil
+		},
+		PreReceive: func(s Session, req GitRequest, updates []RefUpdate) error {
+			for _, u := range updates {
+				if u.Ref == "refs/heads/protected" {
+					return errors.New("protected is read-only")
+				}
+				logf("pre %s %t", u.Ref, u.Old == "" && u.New != "")
+			}
+			return nil
+		},
+		PostReceive: func(s Session, req GitRequest, updates []RefUpdate) {
+			for _, u := range updates {
+				logf("post %s", u.Ref)
+			}
+		},
+	})
+
+	local := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"commit", "-q", "--allow-empty", "-m", "first"},
+		{"push", "-q", "127.0.0.1:project.git", "main"},
+	} {
+		if out, err := git(local, args...); err != nil {
+			t.Fatalf("git %s: %v\n%s", args[0], err, out)
+		}
+	}
+	out, err := git(local, "push", "127.0.0.1:project", "main:protected")
+	if err == nil || !strings.Contains(out, "protected is read-only") {
+		t.Fatalf("push to protected branch not rejected: %v\n%s", err, out)
+	}
+	clone := filepath.Join(t.TempDir(), "clone")
+	if out, err := git(".", "-c", "protocol.version=2", "clone", "-q", "127.0.0.1:/project", clone); err != nil {
+		t.Fatalf("git clone: %v\n%s", err, out)
+	}
+	if out, err := git(clone, "log", "--format=%s"); err != nil || strings.TrimSpace(out) != "first" {
+		t.Fatalf("unexpected clone contents: %v\n%s", err, out)
+	}
+	if out, err := git(".", "ls-remote", "127.0.0.1:.git"); err == nil {
+		t.Fatalf("expected hidden path to be refused\n%s", out)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"write git-receive-pack project.git ",
+		"pre refs/heads/main true",
+		"post refs/heads/main",
+		"write git-receive-pack project.git ",
+		"read git-upload-pack project.git version=2",
+	}
+	if strings.Join(log, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("log:\n%s\nwant:\n%s", strings.Join(log, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGitServerReadOnlyByDefault(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	git := gitTestServer(t, &GitServer{Root: root})
+	if out, err := git(root, "init", "-q", "--bare", "project.git"); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	local := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"commit", "-q", "--allow-empty", "-m", "first"},
+	} {
+		if out, err := git(local, args...); err != nil {
+			t.Fatalf("git %s: %v\n%s", args[0], err, out)
+		}
+	}
+	out, err := git(local, "push", "127.0.0.1:project.git", "main")
+	if err == nil || !strings.Contains(out, "push access denied") {
+		t.Fatalf("push without Authorize not rejected: %v\n%s", err, out)
+	}
+	if out, err := git(".", "ls-remote", "127.0.0.1:project"); err != nil {
+		t.Fatalf("git ls-remote: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,611 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+
+	// RPCServerError is the code of errors returned by methods that are not
+	// an *RPCError.
+	RPCServerError = -32000
+
+	// RPCRequestCancelled is the code of calls that failed after the client
+	// cancelled them.
+	RPCRequestCancelled = -32800
+)
+
+// RPCFraming selects how JSON-RPC messages are delimited.
+type RPCFraming int
+
+const (
+	// RPCFramingAuto detects the framing from the first message sent by the
+	// client.
+	RPCFramingAuto RPCFraming = iota
+
+	// RPCFramingNewline delimits messages with newlines.
+	RPCFramingNewline
+
+	// RPCFramingContentLength precedes messages with a Content-Length
+	// header, as in the Language Server Protocol.
+	RPCFramingContentLength
+)
+
+// rpcCancelMethod is the notification a client sends to cancel a call.
+const rpcCancelMethod = "$/cancelRequest"
+
+// defaultRPCMaxMessage is the default limit for messages read by RPCServer.
+const defaultRPCMaxMessage = 4 << 20
+
+var (
+	errRPCHeader          = errors.New("jsonrpc: invalid message header")
+	errRPCMessageTooLarge = errors.New("jsonrpc: message too large")
+)
+
+// RPCError is a JSON-RPC error object. Methods return it to choose the error
+// sent to the client; other errors are sent with the code RPCServerError and
+// their message.
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("jsonrpc: %s (%d)", e.Message, e.Code)
+}
+
+// RPCServer serves JSON-RPC 2.0 on the stdin and stdout of a session. It is
+// mounted as the Handler of a command, for example with SessionMux, or as a
+// SubsystemHandler:
+//
+//	rpc := &ssh.RPCServer{}
+//	rpc.Register("Repo", &RepoService{})
+//	mux.Handle("rpc", rpc.HandleSession)
+//
+// Calls run concurrently. Their Context is canceled when the session ends or
+// when the client sends a "$/cancelRequest" notification with the id of the
+// call as params, {"id": 1}.
+type RPCServer struct {
+	Framing            RPCFraming // framing of messages, detected if zero
+	MaxConcurrentCalls int        // limit of calls running at once, unlimited if zero
+	MaxMessageSize     int        // limit of message size, 4 MiB if zero
+
+	mu      sync.RWMutex
+	methods map[string]*rpcMethod
+}
+
+// Register registers the exported methods of rcvr as methods named
+// "name.Method", or just "Method" if name is empty. Methods must have one of
+// the forms
+//
+//	func (t T) Method(ctx ssh.Context) error
+//	func (t T) Method(ctx ssh.Context, params P) error
+//	func (t T) Method(ctx ssh.Context, params P) (R, error)
+//
+// where ctx may also be a Session, params are decoded into P and R is encoded
+// as the result. Other methods are ignored, but rcvr must have at least one
+// suitable method.
+func (srv *RPCServer) Register(name string, rcvr interface{}) error {
+	v := reflect.ValueOf(rcvr)
+	if !v.IsValid() {
+		return errors.New("jsonrpc: nil receiver")
+	}
+	prefix := ""
+	if name != "" {
+		prefix = name + "."
+	}
+	found := false
+	for i := 0; i < v.NumMethod(); i++ {
+		m, err := newRPCMethod(v.Method(i))
+		if err != nil {
+			continue
+		}
+		srv.handle(prefix+v.Type().Method(i).Name, m)
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("jsonrpc: %s has no suitable methods", v.Type())
+	}
+	return nil
+}
+
+// RegisterFunc registers fn as the method name. It must have one of the forms
+// described for Register, without the receiver.
+func (srv *RPCServer) RegisterFunc(name string, fn interface{}) error {
+	m, err := newRPCMethod(reflect.ValueOf(fn))
+	if err != nil {
+		return fmt.Errorf("jsonrpc: %s: %v", name, err)
+	}
+	srv.handle(name, m)
+	return nil
+}
+
+func (srv *RPCServer) handle(name string, m *rpcMethod) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.methods == nil {
+		srv.methods = make(map[string]*rpcMethod)
+	}
+	srv.methods[name] = m
+}
+
+func (srv *RPCServer) method(name string) *rpcMethod {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.methods[name]
+}
+
+// HandleSession serves calls until the client closes stdin, and waits for
+// pending calls before returning. It can be used as a Handler or a
+// SubsystemHandler.
+func (srv *RPCServer) HandleSession(s Session) {
+	exitWithError(s, srv.serve(s))
+}
+
+func (srv *RPCServer) serve(s Session) error {
+	c := &rpcConn{
+		srv:     srv,
+		s:       s,
+		r:       bufio.NewReader(s),
+		framing: srv.Framing,
+		max:     srv.MaxMessageSize,
+		calls:   make(map[string]*rpcCall),
+	}
+	if c.max <= 0 {
+		c.max = defaultRPCMaxMessage
+	}
+	if srv.MaxConcurrentCalls > 0 {
+		c.sem = make(chan struct{}, srv.MaxConcurrentCalls)
+	}
+	defer c.wg.Wait()
+	for {
+		msg, err := c.readMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.handle(msg)
+	}
+}
+
+var (
+	rpcContextType = reflect.TypeOf((*Context)(nil)).Elem()
+	rpcSessionType = reflect.TypeOf((*Session)(nil)).Elem()
+	rpcErrorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// rpcMethod is a registered method.
+type rpcMethod struct {
+	fn      reflect.Value
+	session bool         // the first argument is a Session
+	params  reflect.Type // nil if the method takes no params
+	result  bool         // the method returns a result
+}
+
+func newRPCMethod(fn reflect.Value) (*rpcMethod, error) {
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return nil, errors.New("not a function")
+	}
+	t := fn.Type()
+	if t.IsVariadic() || t.NumIn() < 1 || t.NumIn() > 2 || t.NumOut() < 1 || t.NumOut() > 2 {
+		return nil, errors.New("unsupported signature")
+	}
+	m := &rpcMethod{fn: fn, result: t.NumOut() == 2}
+	switch t.In(0) {
+	case rpcContextType:
+	case rpcSessionType:
+		m.session = true
+	default:
+		return nil, errors.New("first parameter must be a Context or Session")
+	}
+	if t.NumIn() == 2 {
+		m.params = t.In(1)
+	}
+	if t.Out(t.NumOut()-1) != rpcErrorType {
+		return nil, errors.New("last result must be an error")
+	}
+	return m, nil
+}
+
+func (m *rpcMethod) call(ctx Context, s Session, params json.RawMessage) (interface{}, error) {
+	args := []reflect.Value{reflect.ValueOf(ctx)}
+	if m.session {
+		args[0] = reflect.ValueOf(&rpcSession{Session: s, ctx: ctx})
+	}
+	if m.params != nil {
+		p := reflect.New(m.params)
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, p.Interface()); err != nil {
+				return nil, &RPCError{Code: RPCInvalidParams, Message: "invalid params: " + err.Error()}
+			}
+		}
+		args = append(args, p.Elem())
+	}
+	out := m.fn.Call(args)
+	if err, _ := out[len(out)-1].Interface().(error); err != nil {
+		return nil, err
+	}
+	if m.result {
+		return out[0].Interface(), nil
+	}
+	return nil, nil
+}
+
+// rpcSession is the Session passed to methods, whose Context is the one of
+// the call.
+type rpcSession struct {
+	Session
+	ctx Context
+}
+
+func (s *rpcSession) Context() Context {
+	return s.ctx
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"` // nil for notifications
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      json.RawMessage  `json:"id"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError        `json:"error,omitempty"`
+}
+
+func newRPCErrorResponse(id json.RawMessage, err *RPCError) *rpcResponse {
+	return &rpcResponse{JSONRPC: "2.0", ID: id, Error: err}
+}
+
+// rpcConn is a session served by an RPCServer.
+type rpcConn struct {
+	srv     *RPCServer
+	s       Session
+	r       *bufio.Reader
+	framing RPCFraming
+	max     int
+	sem     chan struct{} // limits running calls, if not nil
+	wg      sync.WaitGroup
+
+	mu    sync.Mutex
+	calls map[string]*rpcCall // running calls by id
+
+	wmu sync.Mutex
+}
+
+// rpcCall is a call of a method.
+type rpcCall struct {
+	c      *rpcConn
+	req    *rpcRequest
+	method *rpcMethod
+	ctx    Context
+	cancel func()
+}
+
+func (c *rpcConn) readMessage() ([]byte, error) {
+	if c.framing == RPCFramingAuto {
+		for {
+			b, err := c.r.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if !isJSONSpace(b[0]) {
+				break
+			}
+			c.r.ReadByte()
+		}
+		if b, _ := c.r.Peek(1); b[0] == '{' || b[0] == '[' {
+			c.framing = RPCFramingNewline
+		} else {
+			c.framing = RPCFramingContentLength
+		}
+	}
+	if c.framing == RPCFramingContentLength {
+		return c.readContentLength()
+	}
+	return c.readLine()
+}
+
+// readLine reads the next non-empty line.
+func (c *rpcConn) readLine() ([]byte, error) {
+	for {
+		var line []byte
+		for {
+			b, err := c.r.ReadSlice('\n')
+			line = append(line, b...)
+			if len(line) > c.max+2 {
+				return nil, errRPCMessageTooLarge
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil && (err != io.EOF || len(line) == 0) {
+				return nil, err
+			}
+			break
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// readContentLength reads a message preceded by headers.
+func (c *rpcConn) readContentLength() ([]byte, error) {
+	length := -1
+	headers := 0
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if err == io.EOF && headers == 0 && len(line) == 0 {
+			return nil, io.EOF
+		}
+		if err == bufio.ErrBufferFull {
+			return nil, errRPCHeader
+		}
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		h := strings.TrimRight(string(line), "\r\n")
+		if h == "" {
+			if headers == 0 {
+				continue
+			}
+			break
+		}
+		headers++
+		k, v, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, errRPCHeader
+		}
+		if strings.EqualFold(strings.TrimSpace(k), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || length < 0 {
+				return nil, errRPCHeader
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("jsonrpc: missing Content-Length header")
+	}
+	if length > c.max {
+		return nil, errRPCMessageTooLarge
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(c.r, msg); err != nil {
+		return nil, noEOF(err)
+	}
+	return bytes.TrimSpace(msg), nil
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func (c *rpcConn) write(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if c.framing == RPCFramingContentLength {
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n\r\n", len(b))
+		buf.Write(b)
+	} else {
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.s.Write(buf.Bytes())
+}
+
+// handle starts the calls of a message and writes their responses once they
+// completed.
+func (c *rpcConn) handle(msg []byte) {
+	if !json.Valid(msg) {
+		c.write(newRPCErrorResponse(nil, &RPCError{Code: RPCParseError, Message: "parse error"}))
+		return
+	}
+	if msg[0] != '[' {
+		call, resp := c.prepare(msg)
+		if resp != nil {
+			c.write(resp)
+		}
+		if call != nil {
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				c.acquire()
+				defer c.release()
+				if resp := call.run(); resp != nil {
+					c.write(resp)
+				}
+			}()
+		}
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(msg, &batch); err != nil || len(batch) == 0 {
+		c.write(newRPCErrorResponse(nil, &RPCError{Code: RPCInvalidRequest, Message: "invalid request"}))
+		return
+	}
+	calls := make([]*rpcCall, 0, len(batch))
+	var responses []*rpcResponse
+	for _, raw := range batch {
+		call, resp := c.prepare(raw)
+		if resp != nil {
+			responses = append(responses, resp)
+		}
+		if call != nil {
+			calls = append(calls, call)
+		}
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, call := range calls {
+			call := call
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.acquire()
+				defer c.release()
+				if resp := call.run(); resp != nil {
+					mu.Lock()
+					responses = append(responses, resp)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		// a batch of notifications has no response
+		if len(responses) > 0 {
+			c.write(responses)
+		}
+	}()
+}
+
+func (c *rpcConn) acquire() {
+	if c.sem != nil {
+		c.sem <- struct{}{}
+	}
+}
+
+func (c *rpcConn) release() {
+	if c.sem != nil {
+		<-c.sem
+	}
+}
+
+// prepare parses a request and returns either the call to run or an error
+// response. Notifications of the client that need no call, and invalid ones,
+// return neither.
+func (c *rpcConn) prepare(raw json.RawMessage) (*rpcCall, *rpcResponse) {
+	req := new(rpcRequest)
+	if err := json.Unmarshal(raw, req); err != nil || !validRPCID(req.ID) {
+		return nil, newRPCErrorResponse(nil, &RPCError{Code: RPCInvalidRequest, Message: "invalid request"})
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" || !validRPCParams(req.Params) {
+		if req.ID == nil {
+			return nil, nil
+		}
+		return nil, newRPCErrorResponse(req.ID, &RPCError{Code: RPCInvalidRequest, Message: "invalid request"})
+	}
+	if req.Method == rpcCancelMethod {
+		var params struct{ ID json.RawMessage }
+		if json.Unmarshal(req.Params, &params) == nil && params.ID != nil {
+			c.mu.Lock()
+			if call := c.calls[string(params.ID)]; call != nil {
+				call.cancel()
+			}
+			c.mu.Unlock()
+		}
+		return nil, nil
+	}
+	m := c.srv.method(req.Method)
+	if m == nil {
+		if req.ID == nil {
+			return nil, nil
+		}
+		return nil, newRPCErrorResponse(req.ID, &RPCError{Code: RPCMethodNotFound, Message: "method not found: " + req.Method})
+	}
+	ctx, cancel := newChildContext(c.s.Context())
+	call := &rpcCall{c: c, req: req, method: m, ctx: ctx, cancel: cancel}
+	if req.ID != nil {
+		c.mu.Lock()
+		c.calls[string(req.ID)] = call
+		c.mu.Unlock()
+	}
+	return call, nil
+}
+
+func validRPCID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+func validRPCParams(params json.RawMessage) bool {
+	return params == nil || params[0] == '{' || params[0] == '['
+}
+
+// run calls the method and returns the response, or nil for notifications.
+func (call *rpcCall) run() (resp *rpcResponse) {
+	defer func() {
+		call.cancel()
+		if call.req.ID != nil {
+			call.c.mu.Lock()
+			if call.c.calls[string(call.req.ID)] == call {
+				delete(call.c.calls, string(call.req.ID))
+			}
+			call.c.mu.Unlock()
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			srv, _ := call.ctx.Value(ContextKeyServer).(*Server)
+			srv.handlePanic(call.ctx, "rpc "+call.req.Method, r)
+			if call.req.ID != nil {
+				resp = newRPCErrorResponse(call.req.ID, &RPCError{Code: RPCInternalError, Message: "internal error"})
+			}
+		}
+	}()
+	var result interface{}
+	var err error
+	if err = call.ctx.Err(); err == nil {
+		result, err = call.method.call(call.ctx, call.c.s, call.req.Params)
+	}
+	if call.req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		return newRPCErrorResponse(call.req.ID, call.error(err))
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return newRPCErrorResponse(call.req.ID, &RPCError{Code: RPCInternalError, Message: "internal error: " + err.Error()})
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: call.req.ID, Result: (*json.RawMessage)(&b)}
+}
+
+// error converts an error returned by a method to an error object.
+func (call *rpcCall) error(err error) *RPCError {
+	var rpcErr *RPCError
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case call.ctx.Err() != nil && call.c.s.Context().Err() == nil:
+		return &RPCError{Code: RPCRequestCancelled, Message: "request cancelled"}
+	default:
+		return &RPCError{Code: RPCServerError, Message: err.Error()}
+	}
+}
@@ -0,0 +1,263 @@
+package ssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type rpcTestService struct {
+	started chan struct{}
+}
+
+type rpcTestArgs struct {
+	A, B int
+}
+
+func (rpcTestService) Add(ctx Context, args rpcTestArgs) (int, error) {
+	return args.A + args.B, nil
+}
+
+func (rpcTestService) Whoami(s Session) (string, error) {
+	return s.Context().User() + " " + s.User(), nil
+}
+
+func (rpcTestService) Fail(ctx Context, args []string) error {
+	if len(args) > 0 {
+		return &RPCError{Code: 1, Message: args[0]}
+	}
+	return errors.New("failed")
+}
+
+func (svc rpcTestService) Wait(ctx Context) error {
+	svc.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (rpcTestService) unexported(ctx Context) error { return nil }
+
+func (rpcTestService) Unsuitable(n int) error { return nil }
+
+// rpcTestClient runs a session of srv and returns its stdin and stdout.
+func rpcTestClient(t *testing.T, srv *RPCServer) (io.WriteCloser, *bufio.Reader, func()) {
+	session, _, cleanup := newTestSession(t, &Server{Handler: srv.HandleSession}, nil)
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("rpc"); err != nil {
+		t.Fatal(err)
+	}
+	return stdin, bufio.NewReader(stdout), cleanup
+}
+
+func newRPCTestServer(t *testing.T) (*RPCServer, rpcTestService) {
+	svc := rpcTestService{started: make(chan struct{}, 1)}
+	srv := &RPCServer{}
+	if err := srv.Register("Test", svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RegisterFunc("ping", func(ctx Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return srv, svc
+}
+
+func readRPCLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestRPCRegister(t *testing.T) {
+	t.Parallel()
+	srv, _ := newRPCTestServer(t)
+	var names []string
+	for name := range srv.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "Test.Add Test.Fail Test.Wait Test.Whoami ping" {
+		t.Fatalf("methods = %s", got)
+	}
+	if err := srv.Register("", struct{}{}); err == nil {
+		t.Fatal("expected error for receiver without methods")
+	}
+	if err := srv.RegisterFunc("bad", func(n int) int { return n }); err == nil {
+		t.Fatal("expected error for unsuitable function")
+	}
+}
+
+func TestRPCNewline(t *testing.T) {
+	t.Parallel()
+	srv, _ := newRPCTestServer(t)
+	stdin, stdout, cleanup := rpcTestClient(t, srv)
+	defer cleanup()
+
+	for _, tt := range []struct {
+		request, response string
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"Test.Add","params":{"A":2,"B":3}}`, `{"jsonrpc":"2.0","id":1,"result":5}`},
+		{`{"jsonrpc":"2.0","id":"a","method":"Test.Whoami"}`, `{"jsonrpc":"2.0","id":"a","result":"testuser testuser"}`},
+		{`{"jsonrpc":"2.0","id":2,"method":"ping"}`, `{"jsonrpc":"2.0","id":2,"result":null}`},
+		{`{"jsonrpc":"2.0","id":3,"method":"Test.Fail"}`, `{"jsonrpc":"2.0","id":3,"error":{"code":-32000,"message":"failed"}}`},
+		{`{"jsonrpc":"2.0","id":4,"method":"Test.Fail","params":["custom"]}`, `{"jsonrpc":"2.0","id":4,"error":{"code":1,"message":"custom"}}`},
+		{`{"jsonrpc":"2.0","id":5,"method":"Test.Add","params":{"A":"x"}}`, `"code":-32602`},
+		{`{"jsonrpc":"2.0","id":6,"method":"Test.Missing"}`, `{"jsonrpc":"2.0","id":6,"error":{"code":-32601,"message":"method not found: Test.Missing"}}`},
+		{`{"jsonrpc":"2.0","id":7}`, `{"jsonrpc":"2.0","id":7,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`{"jsonrpc":"2.0","id":{},"method":"ping"}`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`{"jsonrpc":`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"parse error"}}`},
+	} {
+		io.WriteString(stdin, tt.request+"\n")
+		if got := readRPCLine(t, stdout); !strings.Contains(got, tt.response) {
+			t.Fatalf("%s:\ngot  %s\nwant %s", tt.request, got, tt.response)
+		}
+	}
+
+	// notifications have no response, so the batch response only contains
+	// the calls
+	io.WriteString(stdin, `[{"jsonrpc":"2.0","method":"ping"},{"jsonrpc":"2.0","method":"Test.Missing"},`+
+		`{"jsonrpc":"2.0","id":1,"method":"Test.Add","params":{"A":1,"B":1}},{"jsonrpc":"2.0","id":2,"method":"ping"}]`+"\n")
+	var batch []rpcResponse
+	if err := json.Unmarshal([]byte(readRPCLine(t, stdout)), &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 {
+		t.Fatalf("batch response has %d responses", len(batch))
+	}
+	sort.Slice(batch, func(i, j int) bool { return string(batch[i].ID) < string(batch[j].ID) })
+	// a null result decodes as nil
+	if batch[0].Result == nil || string(*batch[0].Result) != "2" || batch[1].Result != nil || batch[1].Error != nil {
+		t.Fatalf("unexpected batch response %+v", batch)
+	}
+	io.WriteString(stdin, `[{"jsonrpc":"2.0","method":"ping"}]`+"\n")
+	stdin.Close()
+	if rest, _ := io.ReadAll(stdout); len(rest) != 0 {
+		t.Fatalf("unexpected output %q", rest)
+	}
+}
+
+func TestRPCContentLength(t *testing.T) {
+	t.Parallel()
+	srv, _ := newRPCTestServer(t)
+	stdin, stdout, cleanup := rpcTestClient(t, srv)
+	defer cleanup()
+
+	for i := 1; i <= 2; i++ {
+		body := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"Test.Add","params":{"A":%d,"B":1}}`, i, i)
+		fmt.Fprintf(stdin, "Content-Length: %d\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n%s", len(body), body)
+		want := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":%d}`, i, i+1)
+		if hdr := readRPCLine(t, stdout); hdr != fmt.Sprintf("Content-Length: %d", len(want)) {
+			t.Fatalf("header = %q", hdr)
+		}
+		if blank := readRPCLine(t, stdout); blank != "" {
+			t.Fatalf("expected end of headers, got %q", blank)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(stdout, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("response = %s; want %s", got, want)
+		}
+	}
+}
+
+func TestRPCCancel(t *testing.T) {
+	t.Parallel()
+	srv, svc := newRPCTestServer(t)
+	srv.Framing = RPCFramingNewline
+	stdin, stdout, cleanup := rpcTestClient(t, srv)
+	defer cleanup()
+
+	io.WriteString(stdin, `{"jsonrpc":"2.0","id":1,"method":"Test.Wait"}`+"\n")
+	<-svc.started
+	// other calls proceed while one is blocked
+	io.WriteString(stdin, `{"jsonrpc":"2.0","id":2,"method":"ping"}`+"\n")
+	if got := readRPCLine(t, stdout); got != `{"jsonrpc":"2.0","id":2,"result":null}` {
+		t.Fatalf("ping response = %s", got)
+	}
+	io.WriteString(stdin, `{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":1}}`+"\n")
+	if got := readRPCLine(t, stdout); got != `{"jsonrpc":"2.0","id":1,"error":{"code":-32800,"message":"request cancelled"}}` {
+		t.Fatalf("cancelled response = %s", got)
+	}
+}
+
+func TestRPCSessionEnd(t *testing.T) {
+	t.Parallel()
+	srv, svc := newRPCTestServer(t)
+	done := make(chan error, 1)
+	srv.RegisterFunc("wait", func(ctx Context) error {
+		svc.started <- struct{}{}
+		<-ctx.Done()
+		done <- ctx.Err()
+		return nil
+	})
+	stdin, _, cleanup := rpcTestClient(t, srv)
+	io.WriteString(stdin, `{"jsonrpc":"2.0","id":1,"method":"wait"}`+"\n")
+	<-svc.started
+	cleanup()
+	if err := <-done; err == nil {
+		t.Fatal("call not canceled")
+	}
+}
+
+func TestRPCMaxConcurrentCalls(t *testing.T) {
+	t.Parallel()
+	srv, svc := newRPCTestServer(t)
+	srv.MaxConcurrentCalls = 1
+	stdin, stdout, cleanup := rpcTestClient(t, srv)
+	defer cleanup()
+
+	io.WriteString(stdin, `{"jsonrpc":"2.0","id":1,"method":"Test.Wait"}`+"\n")
+	<-svc.started
+	io.WriteString(stdin, `{"jsonrpc":"2.0","id":2,"method":"ping"}`+"\n")
+	io.WriteString(stdin, `{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":1}}`+"\n")
+	// the ping waits for the blocked call, but cancellation is still read
+	for _, want := range []string{`"id":1`, `"id":2`} {
+		if got := readRPCLine(t, stdout); !strings.Contains(got, want) {
+			t.Fatalf("response = %s; want %s", got, want)
+		}
+	}
+}
+
+func TestRPCPanic(t *testing.T) {
+	t.Parallel()
+	panics := make(chan *HandlerPanic, 2)
+	srv, _ := newRPCTestServer(t)
+	srv.RegisterFunc("panic", func(ctx Context) error { panic("secret detail") })
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler:       srv.HandleSession,
+		PanicCallback: func(ctx Context, p *HandlerPanic) { panics <- p },
+	}, nil)
+	defer cleanup()
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Start("rpc"); err != nil {
+		t.Fatal(err)
+	}
+	// panics in notifications are reported too
+	io.WriteString(stdin, `{"jsonrpc":"2.0","method":"panic"}`+"\n")
+	io.WriteString(stdin, `{"jsonrpc":"2.0","id":1,"method":"panic"}`+"\n")
+	if got := readRPCLine(t, bufio.NewReader(stdout)); got != `{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"internal error"}}` {
+		t.Fatalf("response = %s", got)
+	}
+	for i := 0; i < 2; i++ {
+		if p := <-panics; p.Source != "rpc panic" || p.Value != "secret detail" {
+			t.Fatalf("unexpected panic report %+v", p)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const keepaliveRequestType = "keepalive@openssh.com"
+
+// defaultClientAliveCountMax is used when ClientAliveCountMax is not set. It
+// matches the default of OpenSSH.
+const defaultClientAliveCountMax = 3
+
+// ErrClientAliveTimeout is reported to the ConnectionFailedCallback when a
+// connection is closed because the client stopped replying to keepalives.
+var ErrClientAliveTimeout = errors.New("ssh: client stopped replying to keepalives")
+
+// clientAlive returns the keepalive settings for the connection.
+func (srv *Server) clientAlive(ctx Context) (interval time.Duration, countMax int) {
+	if srv.ClientAliveCallback != nil {
+		interval, countMax = srv.ClientAliveCallback(ctx)
+	} else {
+		interval, countMax = srv.ClientAliveInterval, srv.ClientAliveCountMax
+	}
+	if countMax <= 0 {
+		countMax = defaultClientAliveCountMax
+	}
+	return
+}
+
+// keepAlive sends keepalive requests to the client every interval, and closes
+// the connection once countMax intervals have passed without a reply. Any
+// reply counts, since clients answer unknown global requests with a failure.
+// Global requests are answered in order, so a new request is only sent once
+// the previous one has been answered.
+func (srv *Server) keepAlive(ctx Context, sshConn *gossh.ServerConn, conn net.Conn) {
+	interval, countMax := srv.clientAlive(ctx)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pending chan struct{}
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if pending != nil {
+			select {
+			case <-pending:
+				missed = 0
+			default:
+				missed++
+				if missed >= countMax {
+					if srv.ConnectionFailedCallback != nil {
+						srv.ConnectionFailedCallback(conn, ErrClientAliveTimeout)
+					}
+					sshConn.Close()
+					return
+				}
+				continue
+			}
+		}
+		reply := make(chan struct{})
+		pending = reply
+		go func() {
+			defer close(reply)
+			sshConn.SendRequest(keepaliveRequestType, true, nil)
+		}()
+	}
+}
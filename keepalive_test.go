@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// freezableConn stops delivering data to the client once frozen, simulating
+// a client that silently went away.
+type freezableConn struct {
+	net.Conn
+	frozen atomic.Bool
+	closed chan struct{}
+}
+
+func (c *freezableConn) Read(p []byte) (int, error) {
+	if c.frozen.Load() {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Read(p)
+}
+
+func TestClientAliveHealthy(t *testing.T) {
+	t.Parallel()
+	failed := make(chan error, 1)
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			time.Sleep(300 * time.Millisecond)
+		},
+		ClientAliveInterval: 25 * time.Millisecond,
+		ClientAliveCountMax: 8,
+		ConnectionFailedCallback: func(conn net.Conn, err error) {
+			failed <- err
+		},
+	}, nil)
+	defer cleanup()
+	if err := session.Run(""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-failed:
+		t.Fatalf("healthy client was disconnected: %v", err)
+	default:
+	}
+}
+
+func TestClientAliveTimeout(t *testing.T) {
+	t.Parallel()
+	failed := make(chan error, 1)
+	srv := &Server{
+		Handler: func(s Session) {
+			<-s.Context().Done()
+		},
+		ClientAliveCallback: func(ctx Context) (time.Duration, int) {
+			return 20 * time.Millisecond, 2
+		},
+		ConnectionFailedCallback: func(conn net.Conn, err error) {
+			failed <- err
+		},
+	}
+	l := newLocalListener()
+	go srv.serveOnce(l)
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &freezableConn{Conn: raw, closed: make(chan struct{})}
+	defer close(conn.closed)
+	c, chans, reqs, err := gossh.NewClientConn(conn, l.Addr().String(), &gossh.ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gossh.NewClient(c, chans, reqs)
+	defer client.Close()
+	conn.frozen.Store(true)
+
+	select {
+	case err := <-failed:
+		if err != ErrClientAliveTimeout {
+			t.Fatalf("err = %v; want %v", err, ErrClientAliveTimeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("unresponsive client was not disconnected")
+	}
+}
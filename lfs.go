@@ -0,0 +1,754 @@
+package ssh
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LFSObjectStore stores the Git LFS objects of a repository by their
+// SHA-256 object ID.
+type LFSObjectStore interface {
+	// Size returns the size of an object, or an error wrapping
+	// fs.ErrNotExist if it doesn't exist.
+	Size(oid string) (int64, error)
+
+	// Open opens an object for reading.
+	Open(oid string) (io.ReadCloser, error)
+
+	// Put stores an object read from r. The reader returns an error instead
+	// of io.EOF if the content doesn't match the object ID, in which case
+	// the object must not be stored.
+	Put(oid string, r io.Reader) error
+}
+
+// LFSLock is a Git LFS file lock.
+type LFSLock struct {
+	ID       string
+	Path     string
+	Owner    string
+	LockedAt time.Time
+}
+
+// ErrLFSLockExists is returned by LFSLockStore.Lock if a path is already
+// locked.
+var ErrLFSLockExists = errors.New("ssh: lfs lock already exists")
+
+// LFSLockStore stores the Git LFS file locks of a repository.
+type LFSLockStore interface {
+	// Lock locks a path for owner. If the path is already locked, it returns
+	// the existing lock and ErrLFSLockExists.
+	Lock(path, owner string) (LFSLock, error)
+
+	// Locks returns all locks in a stable order.
+	Locks() ([]LFSLock, error)
+
+	// Unlock removes a lock, or returns an error wrapping fs.ErrNotExist if
+	// it doesn't exist.
+	Unlock(id string) error
+}
+
+// LFSRequest describes a git-lfs-transfer command run by a client.
+type LFSRequest struct {
+	// Repo is the requested repository as a clean relative path.
+	Repo string
+
+	// Operation is "upload" or "download".
+	Operation string
+
+	// Access is the access the operation needs.
+	Access GitAccess
+}
+
+// LFSServer implements the SSH transfer protocol of Git LFS, used by clients
+// that run "git-lfs-transfer <repo> upload" or "git-lfs-transfer <repo>
+// download" instead of using an HTTP endpoint. It supports the batch,
+// put-object, verify-object and get-object commands for the basic transfer
+// adapter, and file locking if Locks is set.
+type LFSServer struct {
+	// Objects returns the object store of a repository.
+	Objects func(s Session, req LFSRequest) (LFSObjectStore, error)
+
+	// Locks, if non-nil, returns the lock store of a repository. Locks are
+	// owned by the session's user.
+	Locks func(s Session, req LFSRequest) (LFSLockStore, error)
+
+	// Authorize, if non-nil, is called before serving a repository.
+	// Returning an error refuses the command and reports the error to the
+	// client. If it is nil, repositories are read-only: uploads, and so
+	// locking, are refused.
+	Authorize func(s Session, req LFSRequest) error
+
+	// ForceUnlock, if non-nil, is called when a client forces the release
+	// of a lock owned by another user. Returning nil allows it. If it is
+	// nil, only the owner of a lock can release it.
+	ForceUnlock func(s Session, req LFSRequest, lock LFSLock) error
+}
+
+// HandleSession serves a git-lfs-transfer command on the session and can be
+// used as a Handler, typically for commands routed by their first argument.
+// Other commands are rejected with exit status 1.
+func (srv *LFSServer) HandleSession(s Session) {
+	exitWithError(s, srv.serve(s))
+}
+
+func (srv *LFSServer) serve(s Session) error {
+	req, err := parseLFSCommand(s.Command())
+	if err != nil {
+		return ExitErrorf(1, "%s", err)
+	}
+	if srv.Authorize != nil {
+		if err := srv.Authorize(s, req); err != nil {
+			return ExitErrorf(1, "fatal: %s", err)
+		}
+	} else if req.Access == GitWrite {
+		return ExitErrorf(1, "fatal: upload access denied")
+	}
+	if srv.Objects == nil {
+		return errors.New("git-lfs-transfer: no object store")
+	}
+	c := &lfsConn{sess: s, req: req, r: bufio.NewReader(s), forceUnlock: srv.ForceUnlock}
+	if c.objects, err = srv.Objects(s, req); err != nil {
+		return err
+	}
+	if srv.Locks != nil {
+		if c.locks, err = srv.Locks(s, req); err != nil {
+			return err
+		}
+	}
+	return c.serve()
+}
+
+// parseLFSCommand parses a command like "git-lfs-transfer repo.git upload".
+func parseLFSCommand(args []string) (LFSRequest, error) {
+	if len(args) != 3 || args[0] != "git-lfs-transfer" {
+		return LFSRequest{}, errors.New("only git-lfs-transfer commands are supported")
+	}
+	repo, err := cleanRepoPath(args[1])
+	if err != nil {
+		return LFSRequest{}, err
+	}
+	req := LFSRequest{Repo: repo, Operation: args[2]}
+	switch args[2] {
+	case "download":
+		req.Access = GitRead
+	case "upload":
+		req.Access = GitWrite
+	default:
+		return LFSRequest{}, fmt.Errorf("invalid operation %q", args[2])
+	}
+	return req, nil
+}
+
+// Status codes of git-lfs-transfer responses, which follow HTTP.
+const (
+	lfsStatusOK         = 200
+	lfsStatusCreated    = 201
+	lfsStatusBadRequest = 400
+	lfsStatusForbidden  = 403
+	lfsStatusNotFound   = 404
+	lfsStatusConflict   = 409
+	lfsStatusError      = 500
+)
+
+// lfsMaxData is the most data sent in a single pkt-line.
+const lfsMaxData = maxPktLine - 4
+
+// lfsMaxLocks is the most locks returned by a single list-lock response.
+const lfsMaxLocks = 100
+
+// lfsError is an error reported to the client with a status code.
+type lfsError struct {
+	status int
+	msg    string
+}
+
+func (e *lfsError) Error() string { return e.msg }
+
+func lfsErrorf(status int, format string, args ...interface{}) error {
+	return &lfsError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+type lfsConn struct {
+	sess    Session
+	req     LFSRequest
+	r       *bufio.Reader
+	objects LFSObjectStore
+	locks   LFSLockStore
+
+	forceUnlock func(s Session, req LFSRequest, lock LFSLock) error
+}
+
+// lfsRequest is a command with its arguments. If the command has data,
+// body reads it until the closing flush packet.
+type lfsRequest struct {
+	command string
+	args    map[string]string
+	body    *pktDataReader
+}
+
+func (c *lfsConn) serve() error {
+	if err := c.write(0, []string{"version=1"}, nil); err != nil {
+		return err
+	}
+	req, err := c.readRequest()
+	if err != nil {
+		return err
+	}
+	if req.command != "version 1" {
+		return fmt.Errorf("git-lfs-transfer: unsupported version %q", req.command)
+	}
+	if err := c.write(lfsStatusOK, nil, nil); err != nil {
+		return err
+	}
+	for {
+		req, err := c.readRequest()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.command == "quit" {
+			return c.write(lfsStatusOK, nil, nil)
+		}
+		if err := c.handle(req); err != nil {
+			var lfsErr *lfsError
+			if !errors.As(err, &lfsErr) {
+				return err
+			}
+			if err := c.write(lfsErr.status, nil, []string{lfsErr.msg}); err != nil {
+				return err
+			}
+		}
+		// skip data the command didn't read
+		if req.body != nil {
+			if _, err := io.Copy(io.Discard, req.body); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *lfsConn) readRequest() (*lfsRequest, error) {
+	line, err := readPktLine(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if line == nil {
+		return nil, errors.New("git-lfs-transfer: unexpected flush packet")
+	}
+	req := &lfsRequest{
+		command: strings.TrimSuffix(string(line), "\n"),
+		args:    make(map[string]string),
+	}
+	for {
+		line, err := readPktLine(c.r)
+		if err == errDelimPkt {
+			req.body = &pktDataReader{r: c.r}
+			return req, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			return req, nil
+		}
+		k, v, _ := strings.Cut(strings.TrimSuffix(string(line), "\n"), "=")
+		req.args[k] = v
+	}
+}
+
+// write writes a response. A status of 0 leaves out the status line.
+func (c *lfsConn) write(status int, args []string, lines []string) error {
+	w := bufio.NewWriter(c.sess)
+	if status != 0 {
+		writePktLine(w, []byte(fmt.Sprintf("status %03d\n", status)))
+	}
+	for _, arg := range args {
+		writePktLine(w, []byte(arg+"\n"))
+	}
+	if lines != nil {
+		writeDelimPkt(w)
+		for _, line := range lines {
+			writePktLine(w, []byte(line+"\n"))
+		}
+	}
+	writeFlushPkt(w)
+	return w.Flush()
+}
+
+func (c *lfsConn) handle(req *lfsRequest) error {
+	command, arg, _ := strings.Cut(req.command, " ")
+	switch command {
+	case "batch":
+		return c.batch(req)
+	case "put-object":
+		return c.putObject(arg, req)
+	case "verify-object":
+		return c.verifyObject(arg, req)
+	case "get-object":
+		return c.getObject(arg)
+	case "lock":
+		return c.lock(req)
+	case "list-lock":
+		return c.listLocks(req)
+	case "unlock":
+		return c.unlock(arg, req)
+	}
+	return lfsErrorf(lfsStatusBadRequest, "unknown command %q", command)
+}
+
+func (c *lfsConn) batch(req *lfsRequest) error {
+	if t, ok := req.args["transfer"]; ok && t != "basic" {
+		return lfsErrorf(lfsStatusBadRequest, "unsupported transfer %q", t)
+	}
+	if h, ok := req.args["hash-algo"]; ok && h != "sha256" {
+		return lfsErrorf(lfsStatusBadRequest, "unsupported hash algorithm %q", h)
+	}
+	if req.body == nil {
+		return lfsErrorf(lfsStatusBadRequest, "missing objects")
+	}
+	var lines []string
+	for {
+		line, err := req.body.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		oid, sizeStr, _ := strings.Cut(line, " ")
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if !isLFSObjectID(oid) || err != nil || size < 0 {
+			return lfsErrorf(lfsStatusBadRequest, "invalid object %q", line)
+		}
+		_, err = c.objects.Size(oid)
+		present := err == nil
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return lfsErrorf(lfsStatusError, "internal error")
+		}
+		action := "noop"
+		switch {
+		case c.req.Operation == "upload" && !present:
+			action = "upload"
+		case c.req.Operation == "download" && present:
+			action = "download"
+		}
+		lines = append(lines, fmt.Sprintf("%s %d %s", oid, size, action))
+	}
+	return c.write(lfsStatusOK, []string{"hash-algo=sha256"}, lines)
+}
+
+func (c *lfsConn) putObject(oid string, req *lfsRequest) error {
+	if c.req.Operation != "upload" {
+		return lfsErrorf(lfsStatusForbidden, "not allowed in a download")
+	}
+	size, err := strconv.ParseInt(req.args["size"], 10, 64)
+	if !isLFSObjectID(oid) || err != nil || size < 0 || req.body == nil {
+		return lfsErrorf(lfsStatusBadRequest, "invalid object")
+	}
+	r := &lfsVerifyReader{r: req.body, oid: oid, size: size, hash: sha256.New()}
+	if err := c.objects.Put(oid, r); err != nil {
+		if r.err != nil {
+			return lfsErrorf(lfsStatusBadRequest, "%s", r.err)
+		}
+		return lfsErrorf(lfsStatusError, "internal error")
+	}
+	return c.write(lfsStatusOK, nil, nil)
+}
+
+func (c *lfsConn) verifyObject(oid string, req *lfsRequest) error {
+	size, err := strconv.ParseInt(req.args["size"], 10, 64)
+	if !isLFSObjectID(oid) || err != nil {
+		return lfsErrorf(lfsStatusBadRequest, "invalid object")
+	}
+	actual, err := c.objects.Size(oid)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return lfsErrorf(lfsStatusNotFound, "object not found")
+		}
+		return lfsErrorf(lfsStatusError, "internal error")
+	}
+	if actual != size {
+		return lfsErrorf(lfsStatusConflict, "object size mismatch")
+	}
+	return c.write(lfsStatusOK, nil, nil)
+}
+
+func (c *lfsConn) getObject(oid string) error {
+	if !isLFSObjectID(oid) {
+		return lfsErrorf(lfsStatusBadRequest, "invalid object")
+	}
+	size, err := c.objects.Size(oid)
+	if err == nil {
+		var f io.ReadCloser
+		if f, err = c.objects.Open(oid); err == nil {
+			defer f.Close()
+		}
+		if err == nil {
+			return c.sendObject(f, size)
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return lfsErrorf(lfsStatusNotFound, "object not found")
+	}
+	return lfsErrorf(lfsStatusError, "internal error")
+}
+
+// sendObject sends an object's data. Errors after the status line can only
+// be reported by closing the session.
+func (c *lfsConn) sendObject(r io.Reader, size int64) error {
+	w := bufio.NewWriter(c.sess)
+	writePktLine(w, []byte(fmt.Sprintf("status %03d\n", lfsStatusOK)))
+	writePktLine(w, []byte(fmt.Sprintf("size=%d\n", size)))
+	writeDelimPkt(w)
+	buf := make([]byte, lfsMaxData)
+	var sent int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			sent += int64(n)
+			if err := writePktLine(w, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if sent != size {
+		return fmt.Errorf("git-lfs-transfer: object size changed while sending")
+	}
+	writeFlushPkt(w)
+	return w.Flush()
+}
+
+func (c *lfsConn) lock(req *lfsRequest) error {
+	if c.locks == nil {
+		return lfsErrorf(lfsStatusNotFound, "locking not supported")
+	}
+	if c.req.Operation != "upload" {
+		return lfsErrorf(lfsStatusForbidden, "not allowed in a download")
+	}
+	path := req.args["path"]
+	if path == "" {
+		return lfsErrorf(lfsStatusBadRequest, "missing path")
+	}
+	lock, err := c.locks.Lock(path, c.sess.User())
+	switch {
+	case errors.Is(err, ErrLFSLockExists):
+		return c.write(lfsStatusConflict, lfsLockArgs(lock), []string{"lock already exists"})
+	case err != nil:
+		return lfsErrorf(lfsStatusError, "internal error")
+	}
+	return c.write(lfsStatusCreated, lfsLockArgs(lock), nil)
+}
+
+func (c *lfsConn) listLocks(req *lfsRequest) error {
+	if c.locks == nil {
+		return lfsErrorf(lfsStatusNotFound, "locking not supported")
+	}
+	limit := lfsMaxLocks
+	if s, ok := req.args["limit"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return lfsErrorf(lfsStatusBadRequest, "invalid limit")
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	locks, err := c.locks.Locks()
+	if err != nil {
+		return lfsErrorf(lfsStatusError, "internal error")
+	}
+	// the cursor is the ID of the first lock to return
+	cursor := req.args["cursor"]
+	var args, lines []string
+	for _, lock := range locks {
+		if cursor != "" {
+			if lock.ID != cursor {
+				continue
+			}
+			cursor = ""
+		}
+		if id := req.args["id"]; id != "" && lock.ID != id {
+			continue
+		}
+		if path := req.args["path"]; path != "" && lock.Path != path {
+			continue
+		}
+		if len(lines) == 5*limit {
+			args = append(args, "next-cursor="+lock.ID)
+			break
+		}
+		owner := "theirs"
+		if lock.Owner == c.sess.User() {
+			owner = "ours"
+		}
+		lines = append(lines,
+			"lock "+lock.ID,
+			"path "+lock.ID+" "+lock.Path,
+			"locked-at "+lock.ID+" "+lock.LockedAt.UTC().Format(time.RFC3339),
+			"ownername "+lock.ID+" "+lock.Owner,
+			"owner "+lock.ID+" "+owner,
+		)
+	}
+	if lines == nil {
+		lines = []string{}
+	}
+	return c.write(lfsStatusOK, args, lines)
+}
+
+func (c *lfsConn) unlock(id string, req *lfsRequest) error {
+	if c.locks == nil {
+		return lfsErrorf(lfsStatusNotFound, "locking not supported")
+	}
+	if c.req.Operation != "upload" {
+		return lfsErrorf(lfsStatusForbidden, "not allowed in a download")
+	}
+	locks, err := c.locks.Locks()
+	if err != nil {
+		return lfsErrorf(lfsStatusError, "internal error")
+	}
+	for _, lock := range locks {
+		if lock.ID != id {
+			continue
+		}
+		if lock.Owner != c.sess.User() {
+			if req.args["force"] != "true" || c.forceUnlock == nil {
+				return lfsErrorf(lfsStatusForbidden, "lock is owned by %s", lock.Owner)
+			}
+			if err := c.forceUnlock(c.sess, c.req, lock); err != nil {
+				return lfsErrorf(lfsStatusForbidden, "%s", err)
+			}
+		}
+		if err := c.locks.Unlock(id); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			return lfsErrorf(lfsStatusError, "internal error")
+		}
+		return c.write(lfsStatusOK, lfsLockArgs(lock), nil)
+	}
+	return lfsErrorf(lfsStatusNotFound, "lock not found")
+}
+
+func lfsLockArgs(lock LFSLock) []string {
+	return []string{
+		"id=" + lock.ID,
+		"path=" + lock.Path,
+		"locked-at=" + lock.LockedAt.UTC().Format(time.RFC3339),
+		"ownername=" + lock.Owner,
+	}
+}
+
+func isLFSObjectID(oid string) bool {
+	if len(oid) != 64 {
+		return false
+	}
+	for _, c := range oid {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// pktDataReader reads the data of pkt-lines until a flush packet.
+type pktDataReader struct {
+	r    io.Reader
+	buf  []byte
+	done bool
+}
+
+func (r *pktDataReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		line, err := readPktLine(r.r)
+		if err != nil {
+			return 0, err
+		}
+		if line == nil {
+			r.done = true
+		}
+		r.buf = line
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// readLine reads a pkt-line holding a line of text.
+func (r *pktDataReader) readLine() (string, error) {
+	if r.done {
+		return "", io.EOF
+	}
+	line, err := readPktLine(r.r)
+	if err != nil {
+		return "", err
+	}
+	if line == nil {
+		r.done = true
+		return "", io.EOF
+	}
+	return strings.TrimSuffix(string(line), "\n"), nil
+}
+
+// lfsVerifyReader checks that an object matches its ID and size.
+type lfsVerifyReader struct {
+	r    io.Reader
+	oid  string
+	size int64
+	n    int64
+	hash hash.Hash
+	err  error
+}
+
+func (r *lfsVerifyReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	r.hash.Write(b[:n])
+	switch {
+	case r.n > r.size:
+		r.err = errors.New("object larger than its size")
+	case err == io.EOF && r.n < r.size:
+		r.err = errors.New("object smaller than its size")
+	case err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.oid:
+		r.err = errors.New("object does not match its ID")
+	default:
+		return n, err
+	}
+	return 0, r.err
+}
+
+// LFSDirStore returns an LFSObjectStore that keeps objects in dir, using the
+// same layout as the local object store of Git LFS.
+func LFSDirStore(dir string) LFSObjectStore {
+	return lfsDirStore(dir)
+}
+
+type lfsDirStore string
+
+func (dir lfsDirStore) path(oid string) (string, error) {
+	if !isLFSObjectID(oid) {
+		return "", fs.ErrInvalid
+	}
+	return filepath.Join(string(dir), oid[0:2], oid[2:4], oid), nil
+}
+
+func (dir lfsDirStore) Size(oid string) (int64, error) {
+	name, err := dir.path(oid)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (dir lfsDirStore) Open(oid string) (io.ReadCloser, error) {
+	name, err := dir.path(oid)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+func (dir lfsDirStore) Put(oid string, r io.Reader) error {
+	name, err := dir.path(oid)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	// write to a temporary file, so only complete objects are stored
+	f, err := os.CreateTemp(filepath.Dir(name), oid+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// MemoryLFSLocks is an LFSLockStore that keeps locks in memory.
+type MemoryLFSLocks struct {
+	mu    sync.Mutex
+	locks []LFSLock
+}
+
+// NewMemoryLFSLocks returns an empty MemoryLFSLocks.
+func NewMemoryLFSLocks() *MemoryLFSLocks {
+	return &MemoryLFSLocks{}
+}
+
+func (m *MemoryLFSLocks) Lock(path, owner string) (LFSLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, lock := range m.locks {
+		if lock.Path == path {
+			return lock, ErrLFSLockExists
+		}
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return LFSLock{}, err
+	}
+	lock := LFSLock{
+		ID:       hex.EncodeToString(id[:]),
+		Path:     path,
+		Owner:    owner,
+		LockedAt: time.Now(),
+	}
+	m.locks = append(m.locks, lock)
+	return lock, nil
+}
+
+func (m *MemoryLFSLocks) Locks() ([]LFSLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]LFSLock(nil), m.locks...), nil
+}
+
+func (m *MemoryLFSLocks) Unlock(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, lock := range m.locks {
+		if lock.ID == id {
+			m.locks = append(m.locks[:i], m.locks[i+1:]...)
+			return nil
+		}
+	}
+	return fs.ErrNotExist
+}
@@ -0,0 +1,277 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// lfsTestClient speaks the git-lfs-transfer protocol for testing.
+type lfsTestClient struct {
+	t *testing.T
+	w io.Writer
+	r *bufio.Reader
+}
+
+func newLFSTestClient(t *testing.T, srv *LFSServer, operation string) (*lfsTestClient, func()) {
+	session, _, cleanup := newTestSession(t, &Server{Handler: srv.HandleSession}, nil)
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("git-lfs-transfer repo.git " + operation); err != nil {
+		t.Fatal(err)
+	}
+	c := &lfsTestClient{t: t, w: stdin, r: bufio.NewReader(stdout)}
+	if status, args, _ := c.read(false); status != "" || strings.Join(args, ",") != "version=1" {
+		t.Fatalf("unexpected capabilities %q", args)
+	}
+	if status, _, _ := c.request("version 1", nil, nil); status != "status 200" {
+		t.Fatalf("version status = %q", status)
+	}
+	return c, cleanup
+}
+
+// request sends a command and returns the response. Data packets, if
+// non-nil, are sent after a delimiter.
+func (c *lfsTestClient) request(command string, args []string, data []string) (string, []string, []byte) {
+	c.t.Helper()
+	var buf bytes.Buffer
+	writePktLine(&buf, []byte(command+"\n"))
+	for _, arg := range args {
+		writePktLine(&buf, []byte(arg+"\n"))
+	}
+	if data != nil {
+		writeDelimPkt(&buf)
+		for _, pkt := range data {
+			writePktLine(&buf, []byte(pkt))
+		}
+	}
+	writeFlushPkt(&buf)
+	if _, err := c.w.Write(buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read(true)
+}
+
+// read reads a response, returning the status line, the arguments and the
+// data after a delimiter.
+func (c *lfsTestClient) read(withStatus bool) (string, []string, []byte) {
+	c.t.Helper()
+	var status string
+	var args []string
+	var data []byte
+	inData := false
+	for {
+		line, err := readPktLine(c.r)
+		if err == errDelimPkt {
+			inData = true
+			continue
+		}
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		switch {
+		case line == nil:
+			return status, args, data
+		case inData:
+			data = append(data, line...)
+		case withStatus && status == "":
+			status = strings.TrimSuffix(string(line), "\n")
+		default:
+			args = append(args, strings.TrimSuffix(string(line), "\n"))
+		}
+	}
+}
+
+func lfsObject(content string) (string, []byte) {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:]), []byte(content)
+}
+
+// lfsChunks splits data into packets.
+func lfsChunks(data []byte) []string {
+	var pkts []string
+	for len(data) > 0 {
+		n := len(data)
+		if n > 1000 {
+			n = 1000
+		}
+		pkts = append(pkts, string(data[:n]))
+		data = data[n:]
+	}
+	return pkts
+}
+
+func TestLFSTransfer(t *testing.T) {
+	t.Parallel()
+	store := LFSDirStore(t.TempDir())
+	srv := &LFSServer{
+		Objects:   func(s Session, req LFSRequest) (LFSObjectStore, error) { return store, nil },
+		Authorize: func(s Session, req LFSRequest) error { return nil },
+	}
+	oid, data := lfsObject(strings.Repeat("large file contents\n", 5000))
+	missing, _ := lfsObject("missing")
+	batch := []string{fmt.Sprintf("%s %d\n", oid, len(data)), missing + " 7\n"}
+
+	up, cleanup := newLFSTestClient(t, srv, "upload")
+	defer cleanup()
+	status, _, lines := up.request("batch", []string{"transfer=basic", "hash-algo=sha256", "refname=refs/heads/main"}, batch)
+	want := fmt.Sprintf("%s %d upload\n%s 7 upload\n", oid, len(data), missing)
+	if status != "status 200" || string(lines) != want {
+		t.Fatalf("batch: %s %q", status, lines)
+	}
+	if status, _, _ := up.request("put-object "+oid, []string{fmt.Sprintf("size=%d", len(data))}, lfsChunks(data)); status != "status 200" {
+		t.Fatalf("put-object status = %q", status)
+	}
+	if status, _, _ := up.request("verify-object "+oid, []string{fmt.Sprintf("size=%d", len(data))}, nil); status != "status 200" {
+		t.Fatalf("verify-object status = %q", status)
+	}
+	if status, _, _ := up.request("verify-object "+missing, []string{"size=7"}, nil); status != "status 404" {
+		t.Fatalf("verify-object of missing object status = %q", status)
+	}
+	// objects must match their ID
+	status, _, msg := up.request("put-object "+missing, []string{"size=7"}, []string{"corrupt"})
+	if status != "status 400" || !strings.Contains(string(msg), "does not match") {
+		t.Fatalf("put-object of corrupt object: %s %q", status, msg)
+	}
+	if _, err := store.Size(missing); err == nil {
+		t.Fatal("corrupt object was stored")
+	}
+	if status, _, _ := up.request("quit", nil, nil); status != "status 200" {
+		t.Fatalf("quit status = %q", status)
+	}
+
+	down, cleanup := newLFSTestClient(t, srv, "download")
+	defer cleanup()
+	_, _, lines = down.request("batch", nil, batch)
+	want = fmt.Sprintf("%s %d download\n%s 7 noop\n", oid, len(data), missing)
+	if string(lines) != want {
+		t.Fatalf("batch: %q", lines)
+	}
+	status, args, got := down.request("get-object "+oid, nil, nil)
+	if status != "status 200" || args[0] != fmt.Sprintf("size=%d", len(data)) || !bytes.Equal(got, data) {
+		t.Fatalf("get-object: %s %q, %d bytes", status, args, len(got))
+	}
+	if status, _, _ := down.request("get-object "+missing, nil, nil); status != "status 404" {
+		t.Fatalf("get-object of missing object status = %q", status)
+	}
+	if status, _, _ := down.request("put-object "+oid, []string{fmt.Sprintf("size=%d", len(data))}, lfsChunks(data)); status != "status 403" {
+		t.Fatalf("put-object in download status = %q", status)
+	}
+	if status, _, _ := down.request("bogus", nil, nil); status != "status 400" {
+		t.Fatalf("unknown command status = %q", status)
+	}
+}
+
+func TestLFSLocks(t *testing.T) {
+	t.Parallel()
+	locks := NewMemoryLFSLocks()
+	srv := &LFSServer{
+		Objects:   func(s Session, req LFSRequest) (LFSObjectStore, error) { return LFSDirStore(t.TempDir()), nil },
+		Locks:     func(s Session, req LFSRequest) (LFSLockStore, error) { return locks, nil },
+		Authorize: func(s Session, req LFSRequest) error { return nil },
+	}
+	other, err := locks.Lock("theirs.bin", "someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, cleanup := newLFSTestClient(t, srv, "upload")
+	defer cleanup()
+	status, args, _ := c.request("lock", []string{"path=ours.bin", "refname=refs/heads/main"}, nil)
+	if status != "status 201" || !strings.HasPrefix(args[0], "id=") || args[1] != "path=ours.bin" || args[3] != "ownername=testuser" {
+		t.Fatalf("lock: %s %q", status, args)
+	}
+	id := strings.TrimPrefix(args[0], "id=")
+	status, args, _ = c.request("lock", []string{"path=theirs.bin"}, nil)
+	if status != "status 409" || args[0] != "id="+other.ID {
+		t.Fatalf("lock of locked path: %s %q", status, args)
+	}
+
+	status, args, lines := c.request("list-lock", []string{"limit=1"}, nil)
+	if status != "status 200" || len(args) != 1 || args[0] != "next-cursor="+id {
+		t.Fatalf("list-lock: %s %q", status, args)
+	}
+	if !strings.Contains(string(lines), "path "+other.ID+" theirs.bin\n") || !strings.Contains(string(lines), "owner "+other.ID+" theirs\n") {
+		t.Fatalf("list-lock lines: %q", lines)
+	}
+	_, args, lines = c.request("list-lock", []string{"cursor=" + id}, nil)
+	if len(args) != 0 || !strings.Contains(string(lines), "owner "+id+" ours\n") {
+		t.Fatalf("list-lock from cursor: %q %q", args, lines)
+	}
+
+	if status, _, _ := c.request("unlock "+other.ID, nil, nil); status != "status 403" {
+		t.Fatalf("unlock of other's lock status = %q", status)
+	}
+	if status, _, _ := c.request("unlock "+other.ID, []string{"force=true"}, nil); status != "status 403" {
+		t.Fatalf("forced unlock without ForceUnlock status = %q", status)
+	}
+	var forced LFSLock
+	srv.ForceUnlock = func(s Session, req LFSRequest, lock LFSLock) error {
+		forced = lock
+		return nil
+	}
+	c, cleanup = newLFSTestClient(t, srv, "upload")
+	defer cleanup()
+	if status, _, _ := c.request("unlock "+other.ID, []string{"force=true"}, nil); status != "status 200" {
+		t.Fatalf("forced unlock status = %q", status)
+	}
+	if forced.ID != other.ID {
+		t.Fatalf("ForceUnlock got %+v", forced)
+	}
+	if status, _, _ := c.request("unlock "+id, nil, nil); status != "status 200" {
+		t.Fatalf("unlock status = %q", status)
+	}
+	if status, _, _ := c.request("unlock "+id, nil, nil); status != "status 404" {
+		t.Fatalf("unlock of missing lock status = %q", status)
+	}
+	if l, _ := locks.Locks(); len(l) != 0 {
+		t.Fatalf("locks remain: %v", l)
+	}
+}
+
+func TestLFSReadOnlyByDefault(t *testing.T) {
+	t.Parallel()
+	srv := &LFSServer{
+		Objects: func(s Session, req LFSRequest) (LFSObjectStore, error) { return LFSDirStore(t.TempDir()), nil },
+		Locks:   func(s Session, req LFSRequest) (LFSLockStore, error) { return NewMemoryLFSLocks(), nil },
+	}
+	session, _, cleanup := newTestSession(t, &Server{Handler: srv.HandleSession}, nil)
+	defer cleanup()
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	err := session.Run("git-lfs-transfer repo.git upload")
+	if exitErr, ok := err.(*gossh.ExitError); !ok || exitErr.ExitStatus() != 1 || !strings.Contains(stderr.String(), "upload access denied") {
+		t.Fatalf("upload without Authorize not rejected: %v %q", err, stderr.String())
+	}
+
+	down, cleanup := newLFSTestClient(t, srv, "download")
+	defer cleanup()
+	if status, _, _ := down.request("lock", []string{"path=file.bin"}, nil); status != "status 403" {
+		t.Fatalf("lock in download status = %q", status)
+	}
+}
+
+func TestLFSUnsupportedCommand(t *testing.T) {
+	t.Parallel()
+	for _, cmd := range []string{"git-lfs-authenticate repo.git upload", "git-lfs-transfer ../repo.git upload", "git-lfs-transfer repo.git push"} {
+		session, _, cleanup := newTestSession(t, &Server{Handler: (&LFSServer{}).HandleSession}, nil)
+		err := session.Run(cmd)
+		cleanup()
+		if exitErr, ok := err.(*gossh.ExitError); !ok || exitErr.ExitStatus() != 1 {
+			t.Fatalf("%s: expected exit status 1, got %v", cmd, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package ssh
+
+import (
+	"sync/atomic"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const sessionChannelType = "session"
+
+// Metrics is a snapshot of a server's counters, for monitoring.
+type Metrics struct {
+	Connections      int    // currently open connections
+	Sessions         int    // currently open session channels
+	Channels         int    // currently open channels of all types
+	RejectedChannels uint64 // channels rejected because of channel or session limits
+}
+
+// Metrics returns a snapshot of the server's counters. Channels are counted
+// as open until their ChannelHandler returns.
+func (srv *Server) Metrics() Metrics {
+	srv.mu.RLock()
+	conns := len(srv.conns)
+	srv.mu.RUnlock()
+
+	return Metrics{
+		Connections:      conns,
+		Sessions:         int(srv.sessionCount.Load()),
+		Channels:         int(srv.channelCount.Load()),
+		RejectedChannels: srv.rejectedChannels.Load(),
+	}
+}
+
+// connChannels counts the open channels of a single connection.
+type connChannels struct {
+	channels atomic.Int64
+	sessions atomic.Int64
+}
+
+// acquireChannel counts a new channel against the connection and server
+// limits. If a limit would be exceeded, the channel is rejected with
+// ResourceShortage and false is returned. Each case of the switch only
+// increments its counter if the previous ones passed, so a rejection undoes
+// the increments of the cases before it.
+func (srv *Server) acquireChannel(cc *connChannels, newChan gossh.NewChannel) bool {
+	isSession := newChan.ChannelType() == sessionChannelType
+	reason := ""
+	switch {
+	case exceeds(&cc.channels, srv.MaxChannelsPerConn):
+		reason = "too many channels"
+	case isSession && exceeds(&cc.sessions, srv.MaxSessionsPerConn):
+		cc.channels.Add(-1)
+		reason = "too many sessions"
+	case isSession && exceeds(&srv.sessionCount, srv.MaxSessions):
+		cc.channels.Add(-1)
+		cc.sessions.Add(-1)
+		reason = "too many sessions"
+	}
+	if reason != "" {
+		srv.rejectedChannels.Add(1)
+		newChan.Reject(gossh.ResourceShortage, reason)
+		return false
+	}
+	srv.channelCount.Add(1)
+	return true
+}
+
+// releaseChannel undoes acquireChannel once the channel's handler returns.
+func (srv *Server) releaseChannel(cc *connChannels, newChan gossh.NewChannel) {
+	cc.channels.Add(-1)
+	srv.channelCount.Add(-1)
+	if newChan.ChannelType() == sessionChannelType {
+		cc.sessions.Add(-1)
+		srv.sessionCount.Add(-1)
+	}
+}
+
+// exceeds increments the counter and reports whether it went over max, in
+// which case the increment is undone. A max of zero means no limit.
+func exceeds(counter *atomic.Int64, max int) bool {
+	n := counter.Add(1)
+	if max > 0 && n > int64(max) {
+		counter.Add(-1)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func waitForMetrics(t *testing.T, srv *Server, ok func(Metrics) bool) Metrics {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		m := srv.Metrics()
+		if ok(m) {
+			return m
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected metrics %+v", m)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMaxSessionsPerConn(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	srv := &Server{
+		Handler: func(s Session) {
+			<-release
+		},
+		MaxSessionsPerConn: 1,
+	}
+	session, client, cleanup := newTestSession(t, srv, nil)
+	defer cleanup()
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	waitForMetrics(t, srv, func(m Metrics) bool { return m.Sessions == 1 })
+
+	_, err := client.NewSession()
+	if err == nil || !strings.Contains(err.Error(), "too many sessions") {
+		t.Fatalf("expected session to be rejected but got %v", err)
+	}
+	if m := srv.Metrics(); m.RejectedChannels != 1 || m.Channels != 1 {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+
+	close(release)
+	session.Wait()
+	waitForMetrics(t, srv, func(m Metrics) bool { return m.Sessions == 0 && m.Channels == 0 })
+	session2, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("expected session after the first one closed: %v", err)
+	}
+	session2.Close()
+}
+
+func TestMaxChannelsPerConn(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	defer close(release)
+	srv := &Server{
+		Handler: func(s Session) {
+			<-release
+		},
+		MaxChannelsPerConn: 1,
+	}
+	session, client, cleanup := newTestSession(t, srv, nil)
+	defer cleanup()
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	waitForMetrics(t, srv, func(m Metrics) bool { return m.Channels == 1 })
+	_, err := client.Dial("tcp", "127.0.0.1:1")
+	if err == nil || !strings.Contains(err.Error(), "too many channels") {
+		t.Fatalf("expected channel to be rejected but got %v", err)
+	}
+}
+
+func TestMaxSessionsServerWide(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	defer close(release)
+	srv := &Server{
+		Handler: func(s Session) {
+			<-release
+		},
+		MaxSessions: 1,
+	}
+	l := newLocalListener()
+	go srv.Serve(l)
+	defer srv.Close()
+
+	session, _, cleanup := newClientSession(t, l.Addr().String(), nil)
+	defer cleanup()
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	waitForMetrics(t, srv, func(m Metrics) bool { return m.Sessions == 1 })
+
+	config := &gossh.ClientConfig{User: "testuser", HostKeyCallback: gossh.InsecureIgnoreHostKey()}
+	client, err := gossh.Dial("tcp", l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.NewSession()
+	if err == nil || !strings.Contains(err.Error(), "too many sessions") {
+		t.Fatalf("expected session to be rejected but got %v", err)
+	}
+	if m := srv.Metrics(); m.Connections != 2 {
+		t.Fatalf("connections = %d; want 2", m.Connections)
+	}
+}
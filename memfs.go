@@ -0,0 +1,447 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an in-memory WritableFS, which also implements ChmodFS, ChtimesFS
+// and LinkFS. It is safe for concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	mode    fs.FileMode
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{nodes: map[string]*memNode{
+		".": {mode: fs.ModeDir | 0755, modTime: time.Now()},
+	}}
+}
+
+// lookup returns the node for a name. It must be called with fsys.mu held.
+func (fsys *MemFS) lookup(op, name string) (*memNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n, ok := fsys.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return n, nil
+}
+
+// checkParent checks that a new entry can be created at name. It must be
+// called with fsys.mu held.
+func (fsys *MemFS) checkParent(op, name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	parent, ok := fsys.nodes[path.Dir(name)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !parent.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return nil
+}
+
+var (
+	errNotDir   = errors.New("not a directory")
+	errIsDir    = errors.New("is a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
+
+// children returns the sorted names of the entries in a directory. It must
+// be called with fsys.mu held.
+func (fsys *MemFS) children(dir string) []string {
+	var names []string
+	for name := range fsys.nodes {
+		if name != "." && path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fsys *MemFS) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fsys *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	n, err := fsys.lookup("open", name)
+	switch {
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case err == nil:
+		if n.mode.IsDir() && writable {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+		}
+		if writable && flag&os.O_TRUNC != 0 {
+			n.data = nil
+			n.modTime = time.Now()
+		}
+	case errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE != 0:
+		if err := fsys.checkParent("open", name); err != nil {
+			return nil, err
+		}
+		n = &memNode{mode: perm & fs.ModePerm, modTime: time.Now()}
+		fsys.nodes[name] = n
+	default:
+		return nil, err
+	}
+	return &memFile{fsys: fsys, name: name, node: n, flag: flag}, nil
+}
+
+func (fsys *MemFS) Stat(name string) (fs.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(name), nil
+}
+
+func (fsys *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	var entries []fs.DirEntry
+	for _, child := range fsys.children(name) {
+		entries = append(entries, fs.FileInfoToDirEntry(fsys.nodes[child].info(child)))
+	}
+	return entries, nil
+}
+
+func (fsys *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if _, ok := fsys.nodes[name]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := fsys.checkParent("mkdir", name); err != nil {
+		return err
+	}
+	fsys.nodes[name] = &memNode{mode: fs.ModeDir | perm&fs.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+func (fsys *MemFS) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	if n.mode.IsDir() && len(fsys.children(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	delete(fsys.nodes, name)
+	return nil
+}
+
+func (fsys *MemFS) Rename(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup("rename", oldname)
+	if err != nil {
+		return err
+	}
+	if oldname == "." || strings.HasPrefix(newname, oldname+"/") {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	}
+	if err := fsys.checkParent("rename", newname); err != nil {
+		return err
+	}
+	if oldname == newname {
+		return nil
+	}
+	if existing, ok := fsys.nodes[newname]; ok {
+		switch {
+		case existing.mode.IsDir() && !n.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newname, Err: errIsDir}
+		case !existing.mode.IsDir() && n.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newname, Err: errNotDir}
+		case existing.mode.IsDir() && len(fsys.children(newname)) > 0:
+			return &fs.PathError{Op: "rename", Path: newname, Err: errNotEmpty}
+		}
+	}
+	for name, child := range fsys.nodes {
+		if strings.HasPrefix(name, oldname+"/") {
+			delete(fsys.nodes, name)
+			fsys.nodes[newname+strings.TrimPrefix(name, oldname)] = child
+		}
+	}
+	delete(fsys.nodes, oldname)
+	fsys.nodes[newname] = n
+	return nil
+}
+
+func (fsys *MemFS) Chmod(name string, mode fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup("chmod", name)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&fs.ModeType | mode&fs.ModePerm
+	return nil
+}
+
+func (fsys *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup("chtimes", name)
+	if err != nil {
+		return err
+	}
+	n.modTime = mtime
+	return nil
+}
+
+func (fsys *MemFS) Link(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup("link", oldname)
+	if err != nil {
+		return err
+	}
+	if n.mode.IsDir() {
+		return &fs.PathError{Op: "link", Path: oldname, Err: errIsDir}
+	}
+	if _, ok := fsys.nodes[newname]; ok {
+		return &fs.PathError{Op: "link", Path: newname, Err: fs.ErrExist}
+	}
+	if err := fsys.checkParent("link", newname); err != nil {
+		return err
+	}
+	fsys.nodes[newname] = n
+	return nil
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	return &memFileInfo{
+		name:    path.Base(name),
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+type memFile struct {
+	fsys   *MemFS
+	name   string
+	node   *memNode
+	flag   int
+	offset int64
+	dirPos int
+	closed bool
+}
+
+// check returns an error if the file can't be used for an operation. It
+// must be called with f.fsys.mu held.
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	writable := f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+	readable := f.flag&os.O_WRONLY == 0
+	if write && !writable || !write && !readable {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	if f.node.mode.IsDir() && op != "readdir" {
+		return &fs.PathError{Op: op, Path: f.name, Err: errIsDir}
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	n, err := f.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, f.node.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	off := f.offset
+	if f.flag&os.O_APPEND != 0 {
+		off = int64(len(f.node.data))
+	}
+	n, err := f.writeAt(p, off)
+	f.offset = off + int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return copy(f.node.data[off:], p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if err := f.check("readdir", false); err != nil {
+		return nil, err
+	}
+	if !f.node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errNotDir}
+	}
+	names := f.fsys.children(f.name)
+	if f.dirPos > len(names) {
+		f.dirPos = len(names)
+	}
+	names = names[f.dirPos:]
+	if count > 0 && len(names) > count {
+		names = names[:count]
+	}
+	if count > 0 && len(names) == 0 {
+		return nil, io.EOF
+	}
+	f.dirPos += len(names)
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fs.FileInfoToDirEntry(f.fsys.nodes[name].info(name)))
+	}
+	return entries, nil
+}
+
+// Sync does nothing, since the file is only in memory.
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,52 @@
+package ssh
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMemFS(t *testing.T) {
+	t.Parallel()
+	fsys := NewMemFS()
+	if err := fsys.Mkdir("a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/one", "a/b/two", "three"} {
+		f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	if err := fstest.TestFS(fsys, "a/one", "a/b/two", "three"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fsys.Mkdir("missing/dir", 0755); err == nil {
+		t.Fatal("expected error creating directory without parent")
+	}
+	if err := fsys.Remove("a"); err == nil {
+		t.Fatal("expected error removing non-empty directory")
+	}
+	if err := fsys.Rename("a", "a/b/c"); err == nil {
+		t.Fatal("expected error moving directory into itself")
+	}
+	if err := fsys.Rename("a", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(fsys, "moved/b/two")
+	if err != nil || string(data) != "a/b/two" {
+		t.Fatalf("unexpected contents %q %v", data, err)
+	}
+	if _, err := fsys.Stat("a/one"); !os.IsNotExist(err) {
+		t.Fatalf("expected old path to be gone, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package ssh
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a Handler to add behavior before or after it runs, such
+// as logging or access checks.
+type Middleware func(Handler) Handler
+
+// Chain returns a Middleware that applies the given middlewares in order, so
+// the first middleware is the outermost one.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+		return h
+	}
+}
+
+// WrapSubsystem applies the given middlewares to a SubsystemHandler, in the
+// same order as Chain.
+func WrapSubsystem(h SubsystemHandler, middlewares ...Middleware) SubsystemHandler {
+	return SubsystemHandler(Chain(middlewares...)(Handler(h)))
+}
+
+// exitStatusSession records the exit status passed to Exit, or the signal
+// passed to ExitSignal.
+type exitStatusSession struct {
+	Session
+
+	mu     sync.Mutex
+	status int
+	signal Signal
+	exited bool
+}
+
+func (s *exitStatusSession) Exit(code int) error {
+	s.mu.Lock()
+	if !s.exited {
+		s.exited = true
+		s.status = code
+	}
+	s.mu.Unlock()
+	return s.Session.Exit(code)
+}
+
+func (s *exitStatusSession) ExitSignal(sig Signal, msg string) error {
+	s.mu.Lock()
+	if !s.exited {
+		s.exited = true
+		s.signal = sig
+	}
+	s.mu.Unlock()
+	return s.Session.ExitSignal(sig, msg)
+}
+
+// exitStatus formats the exit status for logging.
+func (s *exitStatusSession) exitStatus() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signal != "" {
+		return "signal=" + string(s.signal)
+	}
+	return "status=" + strconv.Itoa(s.status)
+}
+
+// AccessLog returns a Middleware that logs a line for every session when its
+// handler returns, including the user, remote address, command, exit status
+// or signal and duration. If logger is nil, the standard logger is used.
+//
+// A handler that panics is logged with status 255, the status the session
+// exits with. Exits made outside the middleware chain, such as by the
+// server's session timeouts, are not seen, so the status is the one passed to
+// the session by the handler and middlewares, or 0.
+func AccessLog(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next Handler) Handler {
+		return func(s Session) {
+			start := time.Now()
+			es := &exitStatusSession{Session: s}
+			panicking := true
+			defer func() {
+				status := es.exitStatus()
+				if panicking {
+					status = "status=" + strconv.Itoa(exitStatusPanic)
+				}
+				kind, cmd := "shell", s.RawCommand()
+				switch {
+				case s.Subsystem() != "":
+					kind, cmd = "subsystem", s.Subsystem()
+				case cmd != "":
+					kind = "exec"
+				}
+				logger.Printf("ssh: user=%s remote=%s %s=%q %s duration=%s",
+					s.User(), s.RemoteAddr(), kind, cmd, status, time.Since(start))
+			}()
+			next(es)
+			panicking = false
+		}
+	}
+}
+
+// Recover returns a Middleware that recovers panics in the handler. The panic
+// and its stack are reported to the server's PanicCallback, a generic error is
+// written to the session's stderr and the session exits with status 255.
+//
+// Session handlers are always run with panic recovery, so Recover is only
+// needed to handle panics before outer middlewares see them.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(s Session) {
+			defer func() {
+				if r := recover(); r != nil {
+					srv, _ := s.Context().Value(ContextKeyServer).(*Server)
+					srv.handlePanic(s.Context(), "session", r)
+					fmt.Fprintln(s.Stderr(), "ssh: internal server error")
+					s.Exit(exitStatusPanic)
+				}
+			}()
+			next(s)
+		}
+	}
+}
+
+// RequireExtensions returns a Middleware that only calls the handler if all
+// of the given keys were set in Permissions.Extensions during authentication.
+// Otherwise, "permission denied" is written to stderr and the session exits
+// with status 1.
+func RequireExtensions(keys ...string) Middleware {
+	return func(next Handler) Handler {
+		return func(s Session) {
+			exts := s.Permissions().Extensions
+			for _, key := range keys {
+				if _, ok := exts[key]; !ok {
+					fmt.Fprintln(s.Stderr(), "permission denied")
+					s.Exit(1)
+					return
+				}
+			}
+			next(s)
+		}
+	}
+}
+
+// Deadline returns a Middleware that limits the duration of each session. When
+// the deadline passes, a message is written to stderr and the session exits
+// with status 124, which closes the channel. The handler is not interrupted,
+// but any further I/O on the session will fail.
+func Deadline(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(s Session) {
+			timer := time.AfterFunc(d, func() {
+				fmt.Fprintln(s.Stderr(), "ssh: session deadline exceeded")
+				s.Exit(124)
+			})
+			defer timer.Stop()
+			next(s)
+		}
+	}
+}
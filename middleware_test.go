@@ -0,0 +1,198 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(s Session) {
+				order = append(order, name)
+				next(s)
+			}
+		}
+	}
+	Chain(mw("a"), mw("b"), mw("c"))(func(s Session) {
+		order = append(order, "handler")
+	})(nil)
+	if got := strings.Join(order, ","); got != "a,b,c,handler" {
+		t.Fatalf("order = %s; want a,b,c,handler", got)
+	}
+}
+
+func TestMiddlewareSubsystem(t *testing.T) {
+	t.Parallel()
+	tag := func(next Handler) Handler {
+		return func(s Session) {
+			io.WriteString(s, "mw:")
+			next(s)
+		}
+	}
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: func(s Session) {},
+		SubsystemHandlers: map[string]SubsystemHandler{
+			"test": func(s Session) {
+				io.WriteString(s, "subsystem")
+			},
+		},
+	}, nil, Use(tag))
+	defer cleanup()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestSubsystem("test"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "mw:subsystem" {
+		t.Fatalf("stdout = %q; want %q", out, "mw:subsystem")
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: func(s Session) {
+			panic("boom")
+		},
+	}, nil, Use(Recover()))
+	defer cleanup()
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	err := session.Run("")
+	e, ok := err.(*gossh.ExitError)
+	if !ok {
+		t.Fatalf("expected ExitError but got %T", err)
+	}
+	if e.ExitStatus() != 255 {
+		t.Fatalf("exit-status = %d; want 255", e.ExitStatus())
+	}
+	if !strings.Contains(stderr.String(), "internal server error") {
+		t.Fatalf("stderr = %q; want internal server error", stderr.String())
+	}
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logged := make(chan struct{})
+	logger := log.New(&buf, "", 0)
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: func(s Session) {
+			s.Exit(3)
+		},
+	}, nil, Use(func(next Handler) Handler {
+		return func(s Session) {
+			defer close(logged)
+			next(s)
+		}
+	}, AccessLog(logger)))
+	defer cleanup()
+	session.Run("do thing")
+	<-logged
+	line := buf.String()
+	for _, want := range []string{"user=testuser", `exec="do thing"`, "status=3"} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("log = %q; missing %q", line, want)
+		}
+	}
+}
+
+func TestAccessLogMiddlewareSignal(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logged := make(chan struct{})
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: ErrorHandler(func(s Session) error {
+			return &ExitError{Signal: SIGTERM}
+		}),
+	}, nil, Use(func(next Handler) Handler {
+		return func(s Session) {
+			defer close(logged)
+			next(s)
+		}
+	}, AccessLog(log.New(&buf, "", 0))))
+	defer cleanup()
+	session.Run("")
+	<-logged
+	if line := buf.String(); !strings.Contains(line, "signal=TERM") || strings.Contains(line, "status=") {
+		t.Fatalf("log = %q; want signal=TERM", line)
+	}
+}
+
+func TestAccessLogMiddlewarePanic(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logged := make(chan struct{})
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler:       func(s Session) { panic("boom") },
+		PanicCallback: func(ctx Context, p *HandlerPanic) {},
+	}, nil, Use(func(next Handler) Handler {
+		return func(s Session) {
+			defer close(logged)
+			next(s)
+		}
+	}, AccessLog(log.New(&buf, "", 0))))
+	defer cleanup()
+	session.Run("")
+	<-logged
+	if line := buf.String(); !strings.Contains(line, "status=255") {
+		t.Fatalf("log = %q; want status=255", line)
+	}
+}
+
+func TestRequireExtensionsMiddleware(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: func(s Session) {
+			io.WriteString(s, "allowed")
+		},
+	}, nil, Use(RequireExtensions("admin")), PasswordAuth(func(ctx Context, password string) bool {
+		return true
+	}))
+	defer cleanup()
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	err := session.Run("")
+	e, ok := err.(*gossh.ExitError)
+	if !ok {
+		t.Fatalf("expected ExitError but got %T", err)
+	}
+	if e.ExitStatus() != 1 {
+		t.Fatalf("exit-status = %d; want 1", e.ExitStatus())
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("stdout = %q; handler should not run", stdout.String())
+	}
+}
+
+func TestDeadlineMiddleware(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: func(s Session) {
+			time.Sleep(time.Second)
+		},
+	}, nil, Use(Deadline(10*time.Millisecond)))
+	defer cleanup()
+	err := session.Run("")
+	e, ok := err.(*gossh.ExitError)
+	if !ok {
+		t.Fatalf("expected ExitError but got %T", err)
+	}
+	if e.ExitStatus() != 124 {
+		t.Fatalf("exit-status = %d; want 124", e.ExitStatus())
+	}
+}
@@ -0,0 +1,244 @@
+package ssh
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// ExitCommandNotFound is the exit status used by SessionMux when no handler
+// matches the requested command. It follows the POSIX shell convention.
+const ExitCommandNotFound = 127
+
+// ExitUsage is the exit status used by ParseFlags when the command line could
+// not be parsed.
+const ExitUsage = 2
+
+// SessionMux is an SSH session multiplexer. It matches the command of each
+// exec session against a list of registered patterns and calls the handler
+// for the pattern that most closely matches the command name, similar to
+// http.ServeMux.
+//
+// Patterns are either exact command names, like "deploy", or path.Match
+// style globs, like "git-*". Exact names take precedence over globs, and
+// globs are tried in the order they were registered.
+//
+// Sessions without a command (shell requests) are routed to the handler set
+// with HandleShell. A SessionMux can also be mounted as a SubsystemHandler, in
+// which case the subsystem name is used as the command name.
+type SessionMux struct {
+	// Name is used as the program name in generated help output. If empty,
+	// no program name is printed.
+	Name string
+
+	// NotFound is called when no handler matches the command. If nil, an
+	// error and the help text are written to stderr and the session exits
+	// with ExitCommandNotFound.
+	NotFound Handler
+
+	mu      sync.RWMutex
+	exact   map[string]*muxEntry
+	globs   []*muxEntry
+	shell   Handler
+	ordered []*muxEntry
+}
+
+type muxEntry struct {
+	pattern string
+	usage   string
+	handler Handler
+}
+
+// NewSessionMux allocates and returns a new SessionMux.
+func NewSessionMux() *SessionMux {
+	return &SessionMux{}
+}
+
+// Handle registers the handler for the given pattern. If a handler already
+// exists for pattern, Handle panics.
+func (mux *SessionMux) Handle(pattern string, handler Handler) {
+	mux.HandleCommand(pattern, "", handler)
+}
+
+// HandleCommand registers the handler for the given pattern along with a
+// one-line usage summary that is shown in the generated help output. If a
+// handler already exists for pattern, HandleCommand panics.
+func (mux *SessionMux) HandleCommand(pattern, usage string, handler Handler) {
+	if pattern == "" {
+		panic("ssh: invalid pattern")
+	}
+	if handler == nil {
+		panic("ssh: nil handler")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic("ssh: invalid pattern " + pattern + ": " + err.Error())
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if mux.exact == nil {
+		mux.exact = make(map[string]*muxEntry)
+	}
+	e := &muxEntry{pattern: pattern, usage: usage, handler: handler}
+	if isGlob(pattern) {
+		for _, g := range mux.globs {
+			if g.pattern == pattern {
+				panic("ssh: multiple registrations for " + pattern)
+			}
+		}
+		mux.globs = append(mux.globs, e)
+	} else {
+		if _, exists := mux.exact[pattern]; exists {
+			panic("ssh: multiple registrations for " + pattern)
+		}
+		mux.exact[pattern] = e
+	}
+	mux.ordered = append(mux.ordered, e)
+}
+
+// HandleShell registers the handler for sessions that did not provide a
+// command, which is what happens when the client requests an interactive
+// shell.
+func (mux *SessionMux) HandleShell(handler Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	mux.shell = handler
+}
+
+// Handler returns the handler to use for the given session along with the
+// pattern that matched. If no handler matches, a nil handler and an empty
+// pattern are returned. Shell sessions match the empty pattern.
+func (mux *SessionMux) Handler(s Session) (h Handler, pattern string) {
+	name := commandName(s)
+
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	if name == "" {
+		return mux.shell, ""
+	}
+	if e, ok := mux.exact[name]; ok {
+		return e.handler, e.pattern
+	}
+	for _, e := range mux.globs {
+		if ok, _ := path.Match(e.pattern, name); ok {
+			return e.handler, e.pattern
+		}
+	}
+	return nil, ""
+}
+
+// HandleSession dispatches the session to the handler whose pattern matches
+// the requested command. It has the signature of both Handler and
+// SubsystemHandler, so mux.HandleSession can be used for either.
+//
+// If the command is "help" and no handler is registered for it, the help text
+// is written to the session and it exits with status 0.
+func (mux *SessionMux) HandleSession(s Session) {
+	h, _ := mux.Handler(s)
+	if h != nil {
+		h(s)
+		return
+	}
+	name := commandName(s)
+	switch {
+	case name == "help":
+		mux.WriteHelp(s)
+		s.Exit(0)
+	case name == "":
+		mux.WriteHelp(s.Stderr())
+		s.Exit(1)
+	case mux.NotFound != nil:
+		mux.NotFound(s)
+	default:
+		fmt.Fprintf(s.Stderr(), "%sunknown command: %s\n", mux.prefix(), name)
+		mux.WriteHelp(s.Stderr())
+		s.Exit(ExitCommandNotFound)
+	}
+}
+
+// WriteHelp writes the list of registered commands and their usage summaries
+// to w.
+func (mux *SessionMux) WriteHelp(w io.Writer) {
+	mux.mu.RLock()
+	entries := append([]*muxEntry(nil), mux.ordered...)
+	mux.mu.RUnlock()
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].pattern < entries[j].pattern
+	})
+
+	if mux.Name != "" {
+		fmt.Fprintf(w, "Usage: %s <command> [arguments]\n\n", mux.Name)
+	}
+	fmt.Fprintln(w, "Available commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, e := range entries {
+		fmt.Fprintf(tw, "  %s\t%s\n", e.pattern, e.usage)
+	}
+	tw.Flush()
+}
+
+func (mux *SessionMux) prefix() string {
+	if mux.Name == "" {
+		return ""
+	}
+	return mux.Name + ": "
+}
+
+// CommandArgs returns the arguments of the session's command, not including
+// the command name itself.
+func CommandArgs(s Session) []string {
+	cmd := s.Command()
+	if len(cmd) < 2 {
+		return []string{}
+	}
+	return cmd[1:]
+}
+
+// NewFlagSet returns a flag.FlagSet named after the session's command that
+// writes usage and errors to the session's stderr. The FlagSet uses
+// flag.ContinueOnError, since any other error handling policy would affect
+// the whole server process rather than the session.
+func NewFlagSet(s Session) *flag.FlagSet {
+	fs := flag.NewFlagSet(commandName(s), flag.ContinueOnError)
+	fs.SetOutput(s.Stderr())
+	return fs
+}
+
+// ParseFlags parses the session's command arguments with fs. If parsing
+// fails, the session is exited with ExitUsage, or 0 if help was requested with
+// -h or -help, and false is returned. Handlers should return immediately when
+// ParseFlags returns false.
+func ParseFlags(s Session, fs *flag.FlagSet) bool {
+	err := fs.Parse(CommandArgs(s))
+	switch {
+	case err == nil:
+		return true
+	case err == flag.ErrHelp:
+		s.Exit(0)
+	default:
+		s.Exit(ExitUsage)
+	}
+	return false
+}
+
+// commandName returns the name of the command requested by the session. For
+// subsystem sessions, the subsystem name is returned.
+func commandName(s Session) string {
+	if cmd := s.Command(); len(cmd) > 0 {
+		return cmd[0]
+	}
+	return s.Subsystem()
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
@@ -0,0 +1,137 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestMux() *SessionMux {
+	mux := NewSessionMux()
+	mux.Name = "tool"
+	mux.HandleCommand("echo", "print arguments", func(s Session) {
+		io.WriteString(s, strings.Join(CommandArgs(s), " "))
+	})
+	mux.HandleCommand("git-*", "git commands", func(s Session) {
+		io.WriteString(s, "git:"+s.Command()[0])
+	})
+	mux.Handle("greet", func(s Session) {
+		fs := NewFlagSet(s)
+		name := fs.String("name", "world", "who to greet")
+		if !ParseFlags(s, fs) {
+			return
+		}
+		io.WriteString(s, "hello "+*name)
+	})
+	mux.HandleShell(func(s Session) {
+		io.WriteString(s, "shell")
+	})
+	return mux
+}
+
+func TestSessionMuxRouting(t *testing.T) {
+	t.Parallel()
+	for cmd, want := range map[string]string{
+		"echo a 'b c'":             "a b c",
+		"git-upload-pack repo.git": "git:git-upload-pack",
+		"greet -name gopher":       "hello gopher",
+		"greet":                    "hello world",
+		"":                         "shell",
+	} {
+		session, _, cleanup := newTestSession(t, &Server{
+			Handler: newTestMux().HandleSession,
+		}, nil)
+		var stdout bytes.Buffer
+		session.Stdout = &stdout
+		if err := session.Run(cmd); err != nil {
+			t.Fatalf("%q: %v", cmd, err)
+		}
+		cleanup()
+		if stdout.String() != want {
+			t.Fatalf("%q: stdout = %q; want %q", cmd, stdout.String(), want)
+		}
+	}
+}
+
+func TestSessionMuxUnknownCommand(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: newTestMux().HandleSession,
+	}, nil)
+	defer cleanup()
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	err := session.Run("bogus")
+	e, ok := err.(*gossh.ExitError)
+	if !ok {
+		t.Fatalf("expected ExitError but got %T", err)
+	}
+	if e.ExitStatus() != ExitCommandNotFound {
+		t.Fatalf("exit-status = %d; want %d", e.ExitStatus(), ExitCommandNotFound)
+	}
+	if !strings.Contains(stderr.String(), "tool: unknown command: bogus") {
+		t.Fatalf("stderr = %q; missing error", stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "print arguments") {
+		t.Fatalf("stderr = %q; missing help", stderr.String())
+	}
+}
+
+func TestSessionMuxBadFlags(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: newTestMux().HandleSession,
+	}, nil)
+	defer cleanup()
+	err := session.Run("greet -bogus")
+	e, ok := err.(*gossh.ExitError)
+	if !ok {
+		t.Fatalf("expected ExitError but got %T", err)
+	}
+	if e.ExitStatus() != ExitUsage {
+		t.Fatalf("exit-status = %d; want %d", e.ExitStatus(), ExitUsage)
+	}
+}
+
+func TestSessionMuxSubsystem(t *testing.T) {
+	t.Parallel()
+	mux := NewSessionMux()
+	mux.Handle("echo", func(s Session) {
+		io.WriteString(s, "subsystem:"+s.Subsystem())
+	})
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {},
+		SubsystemHandlers: map[string]SubsystemHandler{
+			"default": mux.HandleSession,
+		},
+	}, nil)
+	defer cleanup()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestSubsystem("echo"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "subsystem:echo" {
+		t.Fatalf("stdout = %q; want %q", out, "subsystem:echo")
+	}
+}
+
+func TestSessionMuxDuplicatePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on duplicate registration")
+		}
+	}()
+	mux := NewSessionMux()
+	mux.Handle("a", func(Session) {})
+	mux.Handle("a", func(Session) {})
+}
@@ -0,0 +1,402 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// NETCONF base capabilities, which determine the message framing.
+const (
+	NETCONFBase10 = "urn:ietf:params:netconf:base:1.0"
+	NETCONFBase11 = "urn:ietf:params:netconf:base:1.1"
+)
+
+const (
+	netconfNamespace = "urn:ietf:params:xml:ns:netconf:base:1.0"
+
+	// netconfEOM ends messages in NETCONF 1.0 and the hello messages of
+	// later versions.
+	netconfEOM = "]]>]]>"
+
+	// netconfMaxChunk is the largest chunk size allowed by RFC 6242.
+	netconfMaxChunk = 4294967295
+
+	// defaultNETCONFMaxMessage is the default limit for ReadMessage.
+	defaultNETCONFMaxMessage = 16 << 20
+)
+
+// ErrNETCONFMessageTooLarge is returned by NETCONFSession.ReadMessage for
+// messages larger than the server's limit.
+var ErrNETCONFMessageTooLarge = errors.New("ssh: netconf message too large")
+
+// NETCONFServer serves the "netconf" subsystem as specified in RFC 6242. It
+// performs the hello exchange, which negotiates the base protocol version
+// and thus the framing of messages, and then passes a message-oriented
+// NETCONFSession to Handler.
+type NETCONFServer struct {
+	// Capabilities are advertised to clients in addition to the base
+	// capabilities.
+	Capabilities []string
+
+	// Handler handles a session once the hello exchange completed. The
+	// returned error determines the exit status as for ErrorHandler.
+	Handler func(s *NETCONFSession) error
+
+	// DisableChunkedFraming limits sessions to NETCONF 1.0 and its
+	// end-of-message framing.
+	DisableChunkedFraming bool
+
+	// MaxMessageSize limits the size of messages read with ReadMessage. It
+	// defaults to 16 MiB.
+	MaxMessageSize int
+
+	lastSessionID uint32
+}
+
+// NETCONF returns a functional option that serves the "netconf" subsystem
+// with the given NETCONFServer.
+func NETCONF(netconf *NETCONFServer) Option {
+	return func(srv *Server) error {
+		if srv.SubsystemHandlers == nil {
+			srv.SubsystemHandlers = map[string]SubsystemHandler{}
+			for k, v := range DefaultSubsystemHandlers {
+				srv.SubsystemHandlers[k] = v
+			}
+		}
+		srv.SubsystemHandlers["netconf"] = netconf.HandleSession
+		return nil
+	}
+}
+
+// HandleSession performs the hello exchange and runs Handler. It can be used
+// as a SubsystemHandler.
+func (srv *NETCONFServer) HandleSession(s Session) {
+	exitWithError(s, srv.serve(s))
+}
+
+func (srv *NETCONFServer) serve(s Session) error {
+	if srv.Handler == nil {
+		return errors.New("netconf: no handler")
+	}
+	ns := &NETCONFSession{
+		Session: s,
+		id:      atomic.AddUint32(&srv.lastSessionID, 1),
+		r:       bufio.NewReader(s),
+		max:     srv.MaxMessageSize,
+	}
+	if ns.max <= 0 {
+		ns.max = defaultNETCONFMaxMessage
+	}
+	caps := []string{NETCONFBase10}
+	if !srv.DisableChunkedFraming {
+		caps = append(caps, NETCONFBase11)
+	}
+	caps = append(caps, srv.Capabilities...)
+	if err := ns.WriteMessage(netconfHelloMessage(caps, ns.id)); err != nil {
+		return err
+	}
+	msg, err := ns.ReadMessage()
+	if err != nil {
+		return err
+	}
+	var hello struct {
+		XMLName      xml.Name `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 hello"`
+		Capabilities []string `xml:"capabilities>capability"`
+		SessionID    *string  `xml:"session-id"`
+	}
+	if err := xml.Unmarshal(msg, &hello); err != nil {
+		return fmt.Errorf("netconf: invalid hello message: %v", err)
+	}
+	if hello.SessionID != nil {
+		return errors.New("netconf: client hello must not contain a session-id")
+	}
+	for _, c := range hello.Capabilities {
+		ns.capabilities = append(ns.capabilities, strings.TrimSpace(c))
+	}
+	switch {
+	case ns.HasCapability(NETCONFBase11) && !srv.DisableChunkedFraming:
+		ns.chunked = true
+	case ns.HasCapability(NETCONFBase10):
+	default:
+		return errors.New("netconf: no common base capability")
+	}
+	return srv.Handler(ns)
+}
+
+func netconfHelloMessage(caps []string, id uint32) []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<hello xmlns="` + netconfNamespace + `"><capabilities>`)
+	for _, c := range caps {
+		b.WriteString("<capability>")
+		xml.EscapeText(&b, []byte(c))
+		b.WriteString("</capability>")
+	}
+	fmt.Fprintf(&b, "</capabilities><session-id>%d</session-id></hello>", id)
+	return b.Bytes()
+}
+
+// NETCONFSession is a NETCONF session whose hello exchange completed. It
+// reads and writes whole messages, framed according to the negotiated
+// protocol version. Reading and writing may happen concurrently, but only
+// one message can be read and one written at a time.
+type NETCONFSession struct {
+	Session
+
+	id           uint32
+	capabilities []string
+	chunked      bool
+	max          int
+
+	r      *bufio.Reader
+	reader io.Reader // the current message, if any
+	wmu    sync.Mutex
+}
+
+// SessionID returns the session-id sent to the client.
+func (s *NETCONFSession) SessionID() uint32 {
+	return s.id
+}
+
+// Capabilities returns the capabilities advertised by the client.
+func (s *NETCONFSession) Capabilities() []string {
+	return append([]string(nil), s.capabilities...)
+}
+
+// HasCapability reports whether the client advertised a capability.
+// Parameters of the capability URI are ignored.
+func (s *NETCONFSession) HasCapability(uri string) bool {
+	for _, c := range s.capabilities {
+		if c == uri || strings.HasPrefix(c, uri+"?") {
+			return true
+		}
+	}
+	return false
+}
+
+// Chunked reports whether messages use the chunked framing of NETCONF 1.1.
+func (s *NETCONFSession) Chunked() bool {
+	return s.chunked
+}
+
+// NextReader returns a reader for the next message. Any unread part of the
+// previous message is discarded.
+func (s *NETCONFSession) NextReader() (io.Reader, error) {
+	if s.reader != nil {
+		if _, err := io.Copy(io.Discard, s.reader); err != nil {
+			return nil, err
+		}
+	}
+	// there is no next message if the client closed the session
+	if _, err := s.r.Peek(1); err != nil {
+		return nil, err
+	}
+	if s.chunked {
+		s.reader = &netconfChunkedReader{r: s.r}
+	} else {
+		s.reader = &netconfEOMReader{r: s.r}
+	}
+	return s.reader, nil
+}
+
+// ReadMessage reads the next message.
+func (s *NETCONFSession) ReadMessage() ([]byte, error) {
+	r, err := s.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := io.ReadAll(io.LimitReader(r, int64(s.max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > s.max {
+		return nil, ErrNETCONFMessageTooLarge
+	}
+	return msg, nil
+}
+
+// NextWriter returns a writer for a new message, which is complete once the
+// writer is closed. Other messages can't be written until then.
+func (s *NETCONFSession) NextWriter() io.WriteCloser {
+	s.wmu.Lock()
+	w := &netconfWriter{s: s}
+	w.bw = bufio.NewWriter(netconfFrameWriter{w})
+	return w
+}
+
+// WriteMessage writes a message.
+func (s *NETCONFSession) WriteMessage(msg []byte) error {
+	w := s.NextWriter()
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// netconfWriter buffers a message, so it is written in reasonably sized
+// chunks.
+type netconfWriter struct {
+	s      *NETCONFSession
+	bw     *bufio.Writer
+	closed bool
+}
+
+func (w *netconfWriter) Write(b []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("netconf: write to closed message")
+	}
+	return w.bw.Write(b)
+}
+
+func (w *netconfWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.s.wmu.Unlock()
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	// the hello message is always framed with the end-of-message marker
+	end := netconfEOM
+	if w.s.chunked {
+		end = "\n##\n"
+	}
+	_, err := io.WriteString(w.s.Session, end)
+	return err
+}
+
+// netconfFrameWriter frames the data of a message.
+type netconfFrameWriter struct {
+	w *netconfWriter
+}
+
+func (f netconfFrameWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if f.w.s.chunked {
+		if _, err := fmt.Fprintf(f.w.s.Session, "\n#%d\n", len(b)); err != nil {
+			return 0, err
+		}
+	}
+	return f.w.s.Session.Write(b)
+}
+
+// netconfEOMReader reads a message up to the end-of-message marker.
+type netconfEOMReader struct {
+	r       *bufio.Reader
+	pending []byte // a partial match of the marker
+	done    bool
+}
+
+func (r *netconfEOMReader) Read(b []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	n := 0
+	for {
+		// pass on bytes that can no longer start the marker
+		for len(r.pending) > 0 && !strings.HasPrefix(netconfEOM, string(r.pending)) && n < len(b) {
+			b[n] = r.pending[0]
+			n++
+			r.pending = r.pending[1:]
+		}
+		if n == len(b) || (n > 0 && r.r.Buffered() == 0) {
+			// don't block for more data
+			return n, nil
+		}
+		c, err := r.r.ReadByte()
+		if err != nil {
+			return n, noEOF(err)
+		}
+		r.pending = append(r.pending, c)
+		if string(r.pending) == netconfEOM {
+			r.done = true
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		}
+	}
+}
+
+// netconfChunkedReader reads a message with chunked framing.
+type netconfChunkedReader struct {
+	r         *bufio.Reader
+	remaining uint64 // in the current chunk
+	done      bool
+}
+
+var errNETCONFFraming = errors.New("netconf: invalid chunked framing")
+
+func (r *netconfChunkedReader) Read(b []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	if r.remaining == 0 {
+		if err := r.readHeader(); err != nil {
+			return 0, err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+	}
+	if uint64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.r.Read(b)
+	r.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readHeader reads "\n#<size>\n" or the end of chunks, "\n##\n".
+func (r *netconfChunkedReader) readHeader() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return noEOF(err)
+	}
+	if hdr != [2]byte{'\n', '#'} {
+		return errNETCONFFraming
+	}
+	line, err := r.r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return errNETCONFFraming
+		}
+		return noEOF(err)
+	}
+	size := string(line[:len(line)-1])
+	if size == "#" {
+		r.done = true
+		return nil
+	}
+	if size == "" || size[0] < '1' || size[0] > '9' {
+		return errNETCONFFraming
+	}
+	n, err := strconv.ParseUint(size, 10, 64)
+	if err != nil || n > netconfMaxChunk {
+		return errNETCONFFraming
+	}
+	r.remaining = n
+	return nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
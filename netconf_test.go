@@ -0,0 +1,184 @@
+package ssh
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestNETCONFEOMReader(t *testing.T) {
+	t.Parallel()
+	r := bufio.NewReader(strings.NewReader("<a>]]</a>]]]>]]>next]]>]]>"))
+	for _, want := range []string{"<a>]]</a>]", "next"} {
+		msg, err := io.ReadAll(&netconfEOMReader{r: r})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != want {
+			t.Fatalf("message = %q; want %q", msg, want)
+		}
+	}
+	if _, err := io.ReadAll(&netconfEOMReader{r: bufio.NewReader(strings.NewReader("<a/>]]>"))}); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestNETCONFChunkedReader(t *testing.T) {
+	t.Parallel()
+	r := bufio.NewReader(strings.NewReader("\n#4\n<rpc\n#17\n message-id=\"1\"/>\n##\n\n#3\nabc\n##\n"))
+	for _, want := range []string{`<rpc message-id="1"/>`, "abc"} {
+		msg, err := io.ReadAll(&netconfChunkedReader{r: r})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != want {
+			t.Fatalf("message = %q; want %q", msg, want)
+		}
+	}
+	for _, bad := range []string{"#4\nabcd\n##\n", "\n#0\n\n##\n", "\n#04\nabcd\n##\n", "\n#x\n", "\n#4294967296\n", "\n#4\nab"} {
+		_, err := io.ReadAll(&netconfChunkedReader{r: bufio.NewReader(strings.NewReader(bad))})
+		if err == nil {
+			t.Fatalf("%q: expected error", bad)
+		}
+	}
+}
+
+// netconfTestChannel starts the netconf subsystem of a server set up with
+// the NETCONF option, and returns the channel, its requests and a reader for
+// its output.
+func netconfTestChannel(t *testing.T, netconf *NETCONFServer) (gossh.Channel, <-chan *gossh.Request, *bufio.Reader, func()) {
+	srv := &Server{Handler: func(s Session) {}}
+	if err := srv.SetOption(NETCONF(netconf)); err != nil {
+		t.Fatal(err)
+	}
+	l := newLocalListener()
+	go srv.serveOnce(l)
+	_, client, cleanup := newClientSession(t, l.Addr().String(), nil)
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ch.SendRequest("subsystem", true, gossh.Marshal(struct{ Name string }{"netconf"})); err != nil || !ok {
+		t.Fatalf("subsystem request failed: %v %v", ok, err)
+	}
+	return ch, reqs, bufio.NewReader(ch), func() {
+		ch.Close()
+		cleanup()
+	}
+}
+
+func readNETCONFHello(t *testing.T, r *bufio.Reader) string {
+	hello, err := io.ReadAll(&netconfEOMReader{r: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hello)
+}
+
+func TestNETCONFChunked(t *testing.T) {
+	t.Parallel()
+	caps := make(chan []string, 1)
+	ch, reqs, r, cleanup := netconfTestChannel(t, &NETCONFServer{
+		Capabilities: []string{"urn:ietf:params:netconf:capability:candidate:1.0"},
+		Handler: func(s *NETCONFSession) error {
+			caps <- s.Capabilities()
+			if !s.Chunked() {
+				return ExitErrorf(2, "expected chunked framing")
+			}
+			for {
+				msg, err := s.ReadMessage()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := s.WriteMessage(append([]byte("reply:"), msg...)); err != nil {
+					return err
+				}
+			}
+		},
+	})
+	defer cleanup()
+	go gossh.DiscardRequests(reqs)
+
+	hello := readNETCONFHello(t, r)
+	for _, want := range []string{NETCONFBase10, NETCONFBase11, "candidate:1.0", "<session-id>1</session-id>"} {
+		if !strings.Contains(hello, want) {
+			t.Fatalf("server hello %q lacks %q", hello, want)
+		}
+	}
+	io.WriteString(ch, `<?xml version="1.0"?><hello xmlns="urn:ietf:params:xml:ns:netconf:base:1.0">`+
+		`<capabilities><capability> urn:ietf:params:netconf:base:1.1 </capability></capabilities></hello>]]>]]>`)
+	io.WriteString(ch, "\n#5\n<rpc>\n#3\n1</\n#4\nrpc>\n##\n")
+	if got := <-caps; len(got) != 1 || got[0] != NETCONFBase11 {
+		t.Fatalf("client capabilities = %q", got)
+	}
+	reply, err := io.ReadAll(&netconfChunkedReader{r: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "reply:<rpc>1</rpc>" {
+		t.Fatalf("reply = %q", reply)
+	}
+}
+
+func TestNETCONFBase10(t *testing.T) {
+	t.Parallel()
+	ch, reqs, r, cleanup := netconfTestChannel(t, &NETCONFServer{
+		Handler: func(s *NETCONFSession) error {
+			if s.Chunked() {
+				return ExitErrorf(2, "expected end-of-message framing")
+			}
+			w := s.NextWriter()
+			r, err := s.NextReader()
+			if err != nil {
+				return err
+			}
+			io.Copy(w, r)
+			return w.Close()
+		},
+	})
+	defer cleanup()
+	go gossh.DiscardRequests(reqs)
+	readNETCONFHello(t, r)
+	io.WriteString(ch, `<hello xmlns="urn:ietf:params:xml:ns:netconf:base:1.0"><capabilities>`+
+		`<capability>urn:ietf:params:netconf:base:1.0</capability></capabilities></hello>]]>]]>`+
+		`<rpc message-id="1"><get/></rpc>]]>]]>`)
+	reply, err := io.ReadAll(&netconfEOMReader{r: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != `<rpc message-id="1"><get/></rpc>` {
+		t.Fatalf("reply = %q", reply)
+	}
+}
+
+func TestNETCONFBadHello(t *testing.T) {
+	t.Parallel()
+	for _, hello := range []string{
+		`<hello xmlns="urn:ietf:params:xml:ns:netconf:base:1.0"><capabilities><capability>urn:example</capability></capabilities></hello>`,
+		`<hello xmlns="urn:ietf:params:xml:ns:netconf:base:1.0"><capabilities><capability>urn:ietf:params:netconf:base:1.0</capability></capabilities><session-id>4</session-id></hello>`,
+		`<hello><capabilities><capability>urn:ietf:params:netconf:base:1.0</capability></capabilities></hello>`,
+	} {
+		ch, reqs, _, cleanup := netconfTestChannel(t, &NETCONFServer{
+			Handler: func(s *NETCONFSession) error { return nil },
+		})
+		io.WriteString(ch, hello+netconfEOM)
+		status := -1
+		for req := range reqs {
+			if req.Type == "exit-status" {
+				var s struct{ Status uint32 }
+				gossh.Unmarshal(req.Payload, &s)
+				status = int(s.Status)
+			}
+		}
+		cleanup()
+		if status != 1 {
+			t.Fatalf("%s: exit status = %d; want 1", hello, status)
+		}
+	}
+}
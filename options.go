@@ -82,3 +82,25 @@ func WrapConn(fn ConnCallback) Option {
 		return nil
 	}
 }
+
+// Use returns a functional option that appends middlewares to the server's
+// Middleware stack.
+func Use(middlewares ...Middleware) Option {
+	return func(srv *Server) error {
+		srv.Middleware = append(srv.Middleware, middlewares...)
+		return nil
+	}
+}
+
+// AcceptEnv returns a functional option that only allows the client to set
+// environment variables whose names match one of the path.Match patterns,
+// like "LANG" or "LC_*".
+func AcceptEnv(patterns ...string) Option {
+	return func(srv *Server) error {
+		if srv.EnvPolicy == nil {
+			srv.EnvPolicy = &EnvPolicy{}
+		}
+		srv.EnvPolicy.Allow = append(srv.EnvPolicy.Allow, patterns...)
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+package ssh
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// deliveryQueue delivers values to a registered channel from its own
+// goroutine, so that a slow receiver never blocks the request loop. Values are
+// buffered up to max while the receiver is busy, and counted as dropped once
+// the buffer is full.
+type deliveryQueue[T any] struct {
+	// coalesce, if set, reports whether a new value replaces a buffered
+	// one, so that only the latest of them is delivered.
+	coalesce func(old, v T) bool
+
+	// buffered makes values buffer while no channel is registered, instead
+	// of being discarded.
+	buffered bool
+
+	// closeOnDone makes the queue close the registered channel when done is
+	// closed.
+	closeOnDone bool
+
+	mu       sync.Mutex
+	c        chan<- T
+	buf      []T
+	max      int
+	dropped  atomic.Uint64
+	started  bool
+	discards uint64
+	notify   chan struct{}
+	done     <-chan struct{}
+}
+
+func newDeliveryQueue[T any](max int, done <-chan struct{}) *deliveryQueue[T] {
+	return &deliveryQueue[T]{
+		max:    max,
+		notify: make(chan struct{}, 1),
+		done:   done,
+	}
+}
+
+// register sets the channel values are delivered to. Registering nil
+// unregisters the channel and, unless the queue is buffered, discards any
+// buffered values.
+func (q *deliveryQueue[T]) register(c chan<- T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.c = c
+	if c == nil && !q.buffered {
+		q.buf = nil
+		q.discards++
+	} else if c != nil && !q.started {
+		q.started = true
+		go q.run()
+	}
+	q.wake()
+}
+
+// push queues v for delivery. It returns false if v is discarded, because no
+// channel is registered or the buffer is full.
+func (q *deliveryQueue[T]) push(v T) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.c == nil && !q.buffered {
+		return false
+	}
+	if q.coalesce != nil {
+		// the first value may be in the middle of being delivered, so
+		// only the ones after it can be replaced
+		for i := len(q.buf) - 1; i >= 1; i-- {
+			if q.coalesce(q.buf[i], v) {
+				q.buf = append(q.buf[:i], q.buf[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(q.buf) >= q.max {
+		q.dropped.Add(1)
+		return false
+	}
+	q.buf = append(q.buf, v)
+	q.wake()
+	return true
+}
+
+// wake signals the delivery goroutine. It must be called with q.mu held.
+func (q *deliveryQueue[T]) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *deliveryQueue[T]) run() {
+	defer func() {
+		if q.closeOnDone {
+			q.mu.Lock()
+			if q.c != nil {
+				close(q.c)
+			}
+			q.mu.Unlock()
+		}
+	}()
+	for {
+		q.mu.Lock()
+		c := q.c
+		discards := q.discards
+		ready := c != nil && len(q.buf) > 0
+		var v T
+		if ready {
+			v = q.buf[0]
+		}
+		q.mu.Unlock()
+
+		if !ready {
+			select {
+			case <-q.notify:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		select {
+		case c <- v:
+			q.mu.Lock()
+			// the buffer may have been discarded while sending
+			if q.discards == discards {
+				q.buf = q.buf[1:]
+			}
+			q.mu.Unlock()
+		case <-q.notify:
+			// the channel changed, so check again what to deliver where
+		case <-q.done:
+			return
+		}
+	}
+}
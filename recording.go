@@ -0,0 +1,325 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultRecordingWindow is used for the asciicast header of sessions
+// without a PTY.
+var defaultRecordingWindow = Window{Width: 80, Height: 24}
+
+// RecordingSink opens the destination for one part of a session recording.
+// The id is unique for each recording, and part starts at 0 and increases
+// each time the recording is rotated. Every part is a complete asciicast file.
+type RecordingSink func(s Session, id string, part int) (io.WriteCloser, error)
+
+// WriterSink returns a RecordingSink that writes every recording to w. Writes
+// are not synchronized between sessions, so w should only be shared by
+// sessions that are never recorded concurrently.
+func WriterSink(w io.Writer) RecordingSink {
+	return func(s Session, id string, part int) (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// FileSink returns a RecordingSink that creates a file named
+// "<id>.<part>.cast" in dir for every part of a recording.
+func FileSink(dir string) RecordingSink {
+	return func(s Session, id string, part int) (io.WriteCloser, error) {
+		name := filepath.Join(dir, fmt.Sprintf("%s.%d.cast", id, part))
+		return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Recorder records sessions in the asciicast v2 format used by asciinema.
+// Output written to the session, including stderr, is recorded as output
+// events, and window changes are recorded as resize events. Sessions without
+// a PTY are recorded with an 80x24 window.
+type Recorder struct {
+	// Sink opens the destination of each recording. It is required.
+	Sink RecordingSink
+
+	// RecordInput enables recording of input events. Input typically
+	// contains passwords typed into the terminal, so only enable it if the
+	// recordings are adequately protected.
+	RecordInput bool
+
+	// MaxSize is the size in bytes after which the recording is rotated
+	// into a new part. Zero means recordings are never rotated.
+	MaxSize int64
+}
+
+// Wrap is a Middleware that records every session. If the recording can't be
+// started, the session is refused with exit status 1 rather than being run
+// unrecorded.
+func (r *Recorder) Wrap(next Handler) Handler {
+	return func(s Session) {
+		rs, err := r.Start(s)
+		if err != nil {
+			fmt.Fprintln(s.Stderr(), "ssh: unable to record session")
+			s.Exit(1)
+			return
+		}
+		defer rs.Stop()
+		next(rs)
+	}
+}
+
+// Start begins recording s and returns the Session to use in its place. Stop
+// must be called on the returned session once the handler is done with it.
+func (r *Recorder) Start(s Session) (*RecordedSession, error) {
+	var idBytes [6]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	pty, winCh, isPty := s.Pty()
+	win := defaultRecordingWindow
+	if isPty {
+		win = pty.Window
+	}
+	rs := &RecordedSession{
+		Session:  s,
+		recorder: r,
+		id:       time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(idBytes[:]),
+		isPty:    isPty,
+		term:     pty.Term,
+		window:   win,
+	}
+	if err := rs.open(); err != nil {
+		return nil, err
+	}
+	if isPty {
+		rs.winCh = make(chan Window, 1)
+		go rs.forwardWindows(winCh)
+	}
+	return rs, nil
+}
+
+// RecordedSession is a Session that is being recorded by a Recorder.
+type RecordedSession struct {
+	Session
+
+	recorder *Recorder
+	id       string
+	isPty    bool
+	term     string
+	winCh    chan Window
+
+	mu      sync.Mutex
+	w       io.WriteCloser
+	part    int
+	start   time.Time
+	written int64
+	window  Window
+	pending map[string][]byte
+	err     error
+	stopped bool
+}
+
+// ID returns the unique identifier of the recording that was passed to the
+// RecordingSink.
+func (rs *RecordedSession) ID() string {
+	return rs.id
+}
+
+func (rs *RecordedSession) Write(p []byte) (int, error) {
+	if rs.isPty {
+		// mirror the newline normalization done by the session
+		out := bytes.Replace(p, []byte{'\n'}, []byte{'\r', '\n'}, -1)
+		out = bytes.Replace(out, []byte{'\r', '\r', '\n'}, []byte{'\r', '\n'}, -1)
+		rs.output("o", out)
+	} else {
+		rs.output("o", p)
+	}
+	return rs.Session.Write(p)
+}
+
+func (rs *RecordedSession) Read(p []byte) (int, error) {
+	n, err := rs.Session.Read(p)
+	if n > 0 && rs.recorder.RecordInput {
+		rs.output("i", p[:n])
+	}
+	return n, err
+}
+
+func (rs *RecordedSession) Stderr() io.ReadWriter {
+	return &recordedStderr{rs: rs, ReadWriter: rs.Session.Stderr()}
+}
+
+func (rs *RecordedSession) Pty() (Pty, <-chan Window, bool) {
+	pty, _, ok := rs.Session.Pty()
+	if !ok {
+		return pty, nil, false
+	}
+	return pty, rs.winCh, true
+}
+
+// Stop finishes the recording and closes the sink. It returns the first error
+// encountered while recording, if any.
+func (rs *RecordedSession) Stop() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.stopped {
+		return rs.err
+	}
+	rs.stopped = true
+	for kind, p := range rs.pending {
+		if len(p) > 0 {
+			rs.writeEvent(kind, string(p))
+		}
+	}
+	if err := rs.w.Close(); err != nil && rs.err == nil {
+		rs.err = err
+	}
+	return rs.err
+}
+
+// forwardWindows records window changes and passes them on to the handler,
+// keeping only the latest one if the handler isn't reading them.
+func (rs *RecordedSession) forwardWindows(in <-chan Window) {
+	defer close(rs.winCh)
+	for win := range in {
+		rs.resize(win)
+		select {
+		case rs.winCh <- win:
+		default:
+			select {
+			case <-rs.winCh:
+			default:
+			}
+			rs.winCh <- win
+		}
+	}
+}
+
+func (rs *RecordedSession) resize(win Window) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if win == rs.window || rs.stopped {
+		return
+	}
+	rs.window = win
+	rs.writeEvent("r", fmt.Sprintf("%dx%d", win.Width, win.Height))
+}
+
+// output records an output or input event. Incomplete UTF-8 sequences at the
+// end of p are held back until the rest of the sequence arrives, since
+// asciicast events must be valid UTF-8.
+func (rs *RecordedSession) output(kind string, p []byte) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.stopped {
+		return
+	}
+	if rs.pending == nil {
+		rs.pending = make(map[string][]byte)
+	}
+	buf := append(rs.pending[kind], p...)
+	n := completeUTF8(buf)
+	if n > 0 {
+		rs.writeEvent(kind, string(buf[:n]))
+	}
+	rs.pending[kind] = append([]byte(nil), buf[n:]...)
+}
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// open starts a new part of the recording and writes its header.
+func (rs *RecordedSession) open() error {
+	w, err := rs.recorder.Sink(rs.Session, rs.id, rs.part)
+	if err != nil {
+		return err
+	}
+	rs.w = w
+	rs.start = time.Now()
+	rs.written = 0
+	header := asciicastHeader{
+		Version:   2,
+		Width:     rs.window.Width,
+		Height:    rs.window.Height,
+		Timestamp: rs.start.Unix(),
+		Command:   rs.Session.RawCommand(),
+	}
+	if rs.term != "" {
+		header.Env = map[string]string{"TERM": rs.term}
+	}
+	b, _ := json.Marshal(header)
+	return rs.writeLine(b)
+}
+
+// writeEvent writes an event line and rotates the recording if it grew past
+// MaxSize. It must be called with rs.mu held.
+func (rs *RecordedSession) writeEvent(kind, data string) {
+	if rs.err != nil {
+		return
+	}
+	elapsed := float64(time.Since(rs.start).Microseconds()) / 1e6
+	b, _ := json.Marshal([]interface{}{elapsed, kind, data})
+	if err := rs.writeLine(b); err != nil {
+		rs.err = err
+		return
+	}
+	if rs.recorder.MaxSize > 0 && rs.written >= rs.recorder.MaxSize {
+		if err := rs.w.Close(); err != nil {
+			rs.err = err
+			return
+		}
+		rs.part++
+		if err := rs.open(); err != nil {
+			rs.err = err
+		}
+	}
+}
+
+func (rs *RecordedSession) writeLine(b []byte) error {
+	n, err := rs.w.Write(append(b, '\n'))
+	rs.written += int64(n)
+	return err
+}
+
+type recordedStderr struct {
+	io.ReadWriter
+	rs *RecordedSession
+}
+
+func (w *recordedStderr) Write(p []byte) (int, error) {
+	w.rs.output("o", p)
+	return w.ReadWriter.Write(p)
+}
+
+// completeUTF8 returns the length of the longest prefix of p that doesn't end
+// in an incomplete UTF-8 sequence.
+func completeUTF8(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if utf8.FullRune(p[i:]) {
+				return len(p)
+			}
+			return i
+		}
+	}
+	return len(p)
+}
@@ -0,0 +1,138 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type castEvent struct {
+	Time float64
+	Kind string
+	Data string
+}
+
+func parseCast(t *testing.T, data []byte) (asciicastHeader, []castEvent) {
+	t.Helper()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var header asciicastHeader
+	var events []castEvent
+	for i := 0; scanner.Scan(); i++ {
+		if i == 0 {
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var raw []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, castEvent{raw[0].(float64), raw[1].(string), raw[2].(string)})
+	}
+	return header, events
+}
+
+func TestRecorderPty(t *testing.T) {
+	t.Parallel()
+	var cast bytes.Buffer
+	rec := &Recorder{Sink: WriterSink(&cast), RecordInput: true}
+	resized := make(chan struct{})
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: func(s Session) {
+			_, winCh, _ := s.Pty()
+			<-winCh // initial window
+			io.WriteString(s, "hello\n")
+			<-winCh
+			close(resized)
+			buf := make([]byte, 3)
+			io.ReadFull(s, buf)
+			s.Stderr().Write([]byte("\xe2\x9c"))
+			s.Stderr().Write([]byte("\x93"))
+		},
+	}, nil, Use(rec.Wrap))
+	defer cleanup()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestPty("xterm-256color", 24, 100, gossh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WindowChange(30, 120); err != nil {
+		t.Fatal(err)
+	}
+	<-resized
+	io.WriteString(stdin, "abc")
+	if err := session.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, events := parseCast(t, cast.Bytes())
+	if header.Version != 2 || header.Width != 100 || header.Height != 24 || header.Env["TERM"] != "xterm-256color" {
+		t.Fatalf("unexpected header %#v", header)
+	}
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Kind+":"+e.Data)
+	}
+	want := []string{"o:hello\r\n", "r:120x30", "i:abc", "o:✓"}
+	if strings.Join(kinds, "|") != strings.Join(want, "|") {
+		t.Fatalf("events = %q; want %q", kinds, want)
+	}
+}
+
+type partSink struct {
+	mu    sync.Mutex
+	parts []*bytes.Buffer
+}
+
+func (ps *partSink) sink(s Session, id string, part int) (io.WriteCloser, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	buf := &bytes.Buffer{}
+	ps.parts = append(ps.parts, buf)
+	return nopWriteCloser{buf}, nil
+}
+
+func TestRecorderRotation(t *testing.T) {
+	t.Parallel()
+	ps := &partSink{}
+	rec := &Recorder{Sink: ps.sink, MaxSize: 100}
+	session, _, cleanup := newTestSessionWithOptions(t, &Server{
+		Handler: func(s Session) {
+			for i := 0; i < 5; i++ {
+				io.WriteString(s, strings.Repeat("x", 60))
+			}
+		},
+	}, nil, Use(rec.Wrap))
+	defer cleanup()
+	if _, err := session.Output("cmd"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.parts) < 2 {
+		t.Fatalf("expected recording to rotate, got %d parts", len(ps.parts))
+	}
+	var total int
+	for _, part := range ps.parts {
+		header, events := parseCast(t, part.Bytes())
+		if header.Version != 2 || header.Width != 80 || header.Command != "cmd" {
+			t.Fatalf("unexpected header %#v", header)
+		}
+		for _, e := range events {
+			total += len(e.Data)
+		}
+	}
+	if total != 300 {
+		t.Fatalf("recorded %d bytes of output; want 300", total)
+	}
+}
@@ -0,0 +1,109 @@
+package ssh
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// exitStatusPanic is the exit status sent to the client when a session
+// handler panics.
+const exitStatusPanic = 255
+
+// HandlerPanic describes a panic recovered from a handler.
+type HandlerPanic struct {
+	// Source describes the handler that panicked, such as "session",
+	// "subsystem sftp", "channel direct-tcpip", "request tcpip-forward" or
+	// "rpc Repo.Get" for RPCServer methods.
+	Source string
+
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func (p *HandlerPanic) Error() string {
+	return fmt.Sprintf("ssh: panic in %s handler: %v", p.Source, p.Value)
+}
+
+// handlePanic reports a recovered panic to the PanicCallback, or to the
+// standard logger if no callback is set. It must be called from the deferred
+// function that recovered the panic so the stack is still available.
+func (srv *Server) handlePanic(ctx Context, source string, v interface{}) {
+	p := &HandlerPanic{Source: source, Value: v, Stack: debug.Stack()}
+	if srv != nil && srv.PanicCallback != nil {
+		srv.PanicCallback(ctx, p)
+		return
+	}
+	log.Printf("%v (remote %v)\n%s", p, ctx.RemoteAddr(), p.Stack)
+}
+
+// serveChannel calls a ChannelHandler, recovering any panic. If the channel
+// was not yet accepted it is rejected, otherwise it is closed. Other channels
+// of the connection are left alone.
+func (srv *Server) serveChannel(handler ChannelHandler, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx Context) {
+	tracked := &trackedNewChannel{NewChannel: newChan}
+	defer func() {
+		if r := recover(); r != nil {
+			srv.handlePanic(ctx, "channel "+newChan.ChannelType(), r)
+			ch, reqs := tracked.accepted()
+			if ch == nil {
+				if err := newChan.Reject(gossh.ConnectionFailed, "internal error"); err != nil {
+					log.Printf("ssh: rejecting %s channel after panic: %v", newChan.ChannelType(), err)
+				}
+				return
+			}
+			go gossh.DiscardRequests(reqs)
+			ch.Close()
+		}
+	}()
+	handler(srv, conn, tracked, ctx)
+}
+
+// trackedNewChannel records the channel accepted by a ChannelHandler, so that
+// it can be closed if the handler panics.
+type trackedNewChannel struct {
+	gossh.NewChannel
+
+	mu   sync.Mutex
+	ch   gossh.Channel
+	reqs <-chan *gossh.Request
+}
+
+func (c *trackedNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err == nil {
+		c.mu.Lock()
+		c.ch, c.reqs = ch, reqs
+		c.mu.Unlock()
+	}
+	return ch, reqs, err
+}
+
+func (c *trackedNewChannel) accepted() (gossh.Channel, <-chan *gossh.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ch, c.reqs
+}
+
+// serveRequest calls a RequestHandler, recovering any panic. A panicking
+// request handler is replied to with a failure and the connection is closed,
+// since its connection-level state can no longer be trusted.
+func (srv *Server) serveRequest(handler RequestHandler, ctx Context, req *gossh.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			srv.handlePanic(ctx, "request "+req.Type, r)
+			req.Reply(false, nil)
+			if conn, ok := ctx.Value(ContextKeyConn).(*gossh.ServerConn); ok {
+				conn.Close()
+			}
+		}
+	}()
+	ret, payload := handler(ctx, srv, req)
+	req.Reply(ret, payload)
+}
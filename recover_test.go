@@ -0,0 +1,137 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestHandlerPanicIsolated(t *testing.T) {
+	t.Parallel()
+	panics := make(chan *HandlerPanic, 1)
+	session, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			if s.RawCommand() == "panic" {
+				panic("boom")
+			}
+			s.Write([]byte("ok"))
+		},
+		PanicCallback: func(ctx Context, p *HandlerPanic) {
+			panics <- p
+		},
+	}, nil)
+	defer cleanup()
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	err := session.Run("panic")
+	e, ok := err.(*gossh.ExitError)
+	if !ok {
+		t.Fatalf("expected ExitError but got %T", err)
+	}
+	if e.ExitStatus() != exitStatusPanic {
+		t.Fatalf("exit-status = %d; want %d", e.ExitStatus(), exitStatusPanic)
+	}
+	p := <-panics
+	if p.Source != "session" || p.Value != "boom" || len(p.Stack) == 0 {
+		t.Fatalf("unexpected panic report %#v", p)
+	}
+
+	// the connection must survive the panic
+	session2, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := session2.Output("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "ok" {
+		t.Fatalf("stdout = %q; want ok", out)
+	}
+}
+
+func TestChannelHandlerPanicRejects(t *testing.T) {
+	t.Parallel()
+	panics := make(chan *HandlerPanic, 1)
+	srv := &Server{
+		Handler: func(s Session) {},
+		PanicCallback: func(ctx Context, p *HandlerPanic) {
+			panics <- p
+		},
+	}
+	l := newLocalListener()
+	go func() {
+		srv.ensureHandlers()
+		srv.ensureHostSigner()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		srv.ChannelHandlers["custom"] = func(srv *Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx Context) {
+			panic("channel boom")
+		}
+		srv.ChannelHandlers["accepted"] = func(srv *Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx Context) {
+			newChan.Accept()
+			panic("channel boom")
+		}
+		srv.HandleConn(conn)
+	}()
+	_, client, cleanup := newClientSession(t, l.Addr().String(), nil)
+	defer cleanup()
+
+	_, _, err := client.OpenChannel("custom", nil)
+	if err == nil || !strings.Contains(err.Error(), "internal error") {
+		t.Fatalf("expected channel rejection but got %v", err)
+	}
+	if p := <-panics; p.Source != "channel custom" {
+		t.Fatalf("source = %q; want %q", p.Source, "channel custom")
+	}
+	if _, err := client.NewSession(); err != nil {
+		t.Fatalf("connection should survive a rejected channel: %v", err)
+	}
+
+	// an accepted channel is closed on its own
+	ch, reqs, err := client.OpenChannel("accepted", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gossh.DiscardRequests(reqs)
+	if _, err := io.ReadAll(ch); err != nil {
+		t.Fatal(err)
+	}
+	<-panics
+	if _, err := client.NewSession(); err != nil {
+		t.Fatalf("connection should survive a closed channel: %v", err)
+	}
+}
+
+func TestRequestHandlerPanicClosesConn(t *testing.T) {
+	t.Parallel()
+	panics := make(chan *HandlerPanic, 1)
+	_, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {},
+		RequestHandlers: map[string]RequestHandler{
+			"boom": func(ctx Context, srv *Server, req *gossh.Request) (bool, []byte) {
+				panic("request boom")
+			},
+		},
+		PanicCallback: func(ctx Context, p *HandlerPanic) {
+			panics <- p
+		},
+	}, nil)
+	defer cleanup()
+
+	ok, _, _ := client.SendRequest("boom", true, nil)
+	if ok {
+		t.Fatal("expected request to fail")
+	}
+	if p := <-panics; p.Source != "request boom" {
+		t.Fatalf("source = %q; want %q", p.Source, "request boom")
+	}
+	if err := client.Wait(); err == nil {
+		t.Fatal("expected connection to be closed")
+	}
+}
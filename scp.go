@@ -0,0 +1,611 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scpMaxLine is the longest control record accepted from the client.
+const scpMaxLine = 4096
+
+// SCPServer serves file transfers with the legacy SCP protocol, which
+// clients start by running "scp -t" to upload or "scp -f" to download files.
+// Recursive transfers (-r), preserved times and modes (-p) and directory
+// targets (-d) are supported. Like SFTPServer, each session is served from
+// the file system returned by Root, and uploads are only supported if it
+// implements WritableFS.
+type SCPServer struct {
+	// Root returns the file system to serve for a session. Paths sent by
+	// the client are resolved relative to the root of the file system,
+	// which also stands for "~".
+	Root func(s Session) (fs.FS, error)
+
+	// Authorize, if non-nil, is called before each file operation.
+	Authorize FileAuthorizer
+}
+
+// HandleSession serves an scp command on the session and can be used as a
+// Handler. Other commands are rejected with exit status 1.
+func (srv *SCPServer) HandleSession(s Session) {
+	exitWithError(s, srv.serve(s))
+}
+
+func (srv *SCPServer) serve(s Session) error {
+	cmd, err := parseSCPCommand(s.Command())
+	if err != nil {
+		return ExitErrorf(1, "%s", err)
+	}
+	if srv.Root == nil {
+		return errors.New("scp: no root file system")
+	}
+	fsys, err := srv.Root(s)
+	if err != nil {
+		return err
+	}
+	c := &scpConn{
+		srv:  srv,
+		sess: s,
+		fsys: fsys,
+		cmd:  cmd,
+		r:    bufio.NewReader(s),
+	}
+	if cmd.sink {
+		err = c.serveSink(scpPath(cmd.paths[0]))
+	} else {
+		err = c.serveSource()
+	}
+	var fatal *scpFatalError
+	if errors.As(err, &fatal) {
+		// protocol errors are reported to the client, which then gives up
+		if fatal.local {
+			fmt.Fprintf(c.sess, "\x02scp: %s\n", fatal.msg)
+		}
+		return &ExitError{Code: 1}
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if c.failed {
+		return &ExitError{Code: 1}
+	}
+	return nil
+}
+
+type scpCommand struct {
+	sink      bool // -t, receive files
+	source    bool // -f, send files
+	recursive bool // -r
+	preserve  bool // -p
+	targetDir bool // -d, the target must be a directory
+	paths     []string
+}
+
+// parseSCPCommand parses the command run by an scp client on the remote
+// host, like "scp -r -t -- dir".
+func parseSCPCommand(args []string) (*scpCommand, error) {
+	if len(args) == 0 || path.Base(args[0]) != "scp" {
+		return nil, errors.New("only scp commands are supported")
+	}
+	cmd := &scpCommand{}
+	args = args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				cmd.sink = true
+			case 'f':
+				cmd.source = true
+			case 'r':
+				cmd.recursive = true
+			case 'p':
+				cmd.preserve = true
+			case 'd':
+				cmd.targetDir = true
+			case 'v', 'q':
+			default:
+				return nil, fmt.Errorf("scp: unknown option -%c", flag)
+			}
+		}
+	}
+	cmd.paths = args
+	switch {
+	case cmd.sink == cmd.source:
+		return nil, errors.New("scp: exactly one of -t and -f is required")
+	case cmd.sink && len(args) != 1:
+		return nil, errors.New("scp: -t requires a single target")
+	case cmd.source && len(args) == 0:
+		return nil, errors.New("scp: -f requires files to send")
+	}
+	return cmd, nil
+}
+
+// scpPath converts a path sent by the client to a file system path. As the
+// root of the file system stands for the user's home directory, a leading
+// "~/" is dropped.
+func scpPath(p string) string {
+	if p == "~" {
+		return "."
+	}
+	return fsPath(strings.TrimPrefix(p, "~/"))
+}
+
+// scpFatalError aborts a transfer. Errors detected locally are reported to
+// the client, while errors from the client have already been shown to the
+// user.
+type scpFatalError struct {
+	msg   string
+	local bool
+}
+
+func (e *scpFatalError) Error() string { return "scp: " + e.msg }
+
+func scpFatal(format string, args ...interface{}) error {
+	return &scpFatalError{msg: fmt.Sprintf(format, args...), local: true}
+}
+
+// errSCPSkipped is returned when the client reports a non-fatal error, which
+// skips the current file.
+var errSCPSkipped = errors.New("scp: skipped by client")
+
+type scpConn struct {
+	srv    *SCPServer
+	sess   Session
+	fsys   fs.FS
+	cmd    *scpCommand
+	r      *bufio.Reader
+	failed bool // whether any errors were reported
+}
+
+// ack acknowledges a control record or file.
+func (c *scpConn) ack() error {
+	_, err := c.sess.Write([]byte{0})
+	return err
+}
+
+// warn reports a non-fatal error for a file to the client.
+func (c *scpConn) warn(name string, err error) error {
+	c.failed = true
+	_, werr := fmt.Fprintf(c.sess, "\x01scp: %s: %s\n", name, scpErrorText(err))
+	return werr
+}
+
+// scpErrorText describes an error for the client. Like for SFTP, only
+// messages from a FileAuthorizer are passed on as is.
+func scpErrorText(err error) string {
+	var authErr *fileAuthError
+	switch {
+	case errors.As(err, &authErr):
+		return authErr.Error()
+	case errors.Is(err, fs.ErrNotExist):
+		return "No such file or directory"
+	case errors.Is(err, fs.ErrPermission):
+		return "Permission denied"
+	case errors.Is(err, fs.ErrExist):
+		return "File exists"
+	case errors.Is(err, errUnsupported):
+		return "Operation not supported"
+	}
+	// leave out paths, which may be outside of the file system
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// scp errors returned to the client as text
+var (
+	errSCPNotDir     = errors.New("Not a directory")
+	errSCPNotRegular = errors.New("not a regular file")
+)
+
+func (c *scpConn) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) >= scpMaxLine {
+			return "", scpFatal("control record too long")
+		}
+		line = append(line, b)
+	}
+}
+
+// response reads the client's reply to a record or file: a zero byte if it
+// was accepted, or an error message.
+func (c *scpConn) response() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if b == 2 {
+			return &scpFatalError{msg: msg}
+		}
+		return errSCPSkipped
+	default:
+		return scpFatal("protocol error: unexpected response %q", b)
+	}
+}
+
+func (c *scpConn) authorize(op FileOp, name string) error {
+	return authorizeFile(c.srv.Authorize, c.sess, FileRequest{Op: op, Path: name})
+}
+
+// serveSink receives files into target.
+func (c *scpConn) serveSink(target string) error {
+	fi, err := fs.Stat(c.fsys, target)
+	targetDir := err == nil && fi.IsDir()
+	if c.cmd.targetDir && !targetDir {
+		return scpFatal("%s: %s", target, errSCPNotDir)
+	}
+	if err := c.ack(); err != nil {
+		return err
+	}
+	return c.sink(target, targetDir)
+}
+
+// sink receives files and directories until the client ends the current
+// directory or the transfer.
+func (c *scpConn) sink(target string, targetDir bool) error {
+	var mtime, atime time.Time
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return scpFatal("protocol error: empty record")
+		}
+		switch line[0] {
+		case 1, 2:
+			// the client reports its own errors to the user
+			if line[0] == 2 {
+				return &scpFatalError{msg: line[1:]}
+			}
+			continue
+		case 'E':
+			return c.ack()
+		case 'T':
+			var mt, mtUsec, at, atUsec int64
+			if _, err := fmt.Sscanf(line, "T%d %d %d %d", &mt, &mtUsec, &at, &atUsec); err != nil {
+				return scpFatal("protocol error: bad times record")
+			}
+			mtime, atime = time.Unix(mt, mtUsec*1000), time.Unix(at, atUsec*1000)
+			if err := c.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return scpFatal("protocol error: unexpected record %q", line)
+		}
+
+		fields := strings.SplitN(line[1:], " ", 3)
+		if len(fields) != 3 {
+			return scpFatal("protocol error: bad file record")
+		}
+		mode, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil || mode&^07777 != 0 {
+			return scpFatal("protocol error: bad mode")
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return scpFatal("protocol error: bad size")
+		}
+		base := fields[2]
+		if base == "" || base == "." || base == ".." || strings.Contains(base, "/") {
+			return scpFatal("unexpected filename: %s", base)
+		}
+		name := target
+		if targetDir {
+			name = path.Join(target, base)
+		}
+		attrs := scpAttrs{mode: fs.FileMode(mode), mtime: mtime, atime: atime}
+		mtime, atime = time.Time{}, time.Time{}
+
+		if line[0] == 'D' {
+			if !c.cmd.recursive {
+				return scpFatal("received directory without -r")
+			}
+			err = c.sinkDir(name, attrs)
+		} else {
+			err = c.sinkFile(name, size, attrs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type scpAttrs struct {
+	mode         fs.FileMode
+	mtime, atime time.Time
+}
+
+func (c *scpConn) sinkDir(name string, attrs scpAttrs) error {
+	created, err := c.mkdir(name, attrs.mode)
+	if err != nil {
+		return c.warn(name, err)
+	}
+	if err := c.ack(); err != nil {
+		return err
+	}
+	if err := c.sink(name, true); err != nil {
+		return err
+	}
+	if c.cmd.preserve {
+		if err := c.setattrs(name, attrs); err != nil {
+			return c.warn(name, err)
+		}
+	} else if created && attrs.mode&0700 != 0700 {
+		// like OpenSSH, give a new directory the requested mode once its
+		// files have been received
+		if cfs, ok := c.fsys.(ChmodFS); ok {
+			if err := cfs.Chmod(name, attrs.mode); err != nil {
+				return c.warn(name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mkdir creates a directory unless it exists, and reports whether it was
+// created.
+func (c *scpConn) mkdir(name string, mode fs.FileMode) (bool, error) {
+	if fi, err := fs.Stat(c.fsys, name); err == nil {
+		if !fi.IsDir() {
+			return false, errSCPNotDir
+		}
+		return false, nil
+	}
+	if err := c.authorize(FileMkdir, name); err != nil {
+		return false, err
+	}
+	wfs, err := writableFS(c.fsys)
+	if err != nil {
+		return false, err
+	}
+	// keep the directory writable until its files have been received
+	return true, wfs.Mkdir(name, mode|0700)
+}
+
+func (c *scpConn) sinkFile(name string, size int64, attrs scpAttrs) error {
+	f, err := c.create(name, attrs.mode)
+	if err != nil {
+		return c.warn(name, err)
+	}
+	if err := c.ack(); err != nil {
+		f.Close()
+		return err
+	}
+	// keep reading after a failed write, so the transfer can continue
+	var writeErr error
+	buf := make([]byte, 32*1024)
+	for remaining := size; remaining > 0; {
+		if remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		n, err := c.r.Read(buf)
+		if n > 0 && writeErr == nil {
+			_, writeErr = f.Write(buf[:n])
+		}
+		remaining -= int64(n)
+		if err != nil {
+			f.Close()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	if err := f.Close(); err != nil && writeErr == nil {
+		writeErr = err
+	}
+	if err := c.response(); err != nil {
+		if err == errSCPSkipped {
+			return nil
+		}
+		return err
+	}
+	if writeErr != nil {
+		return c.warn(name, writeErr)
+	}
+	if c.cmd.preserve {
+		if err := c.setattrs(name, attrs); err != nil {
+			return c.warn(name, err)
+		}
+	}
+	return c.ack()
+}
+
+func (c *scpConn) create(name string, mode fs.FileMode) (File, error) {
+	if err := c.authorize(FileWrite, name); err != nil {
+		return nil, err
+	}
+	wfs, err := writableFS(c.fsys)
+	if err != nil {
+		return nil, err
+	}
+	return wfs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+}
+
+// setattrs applies preserved modes and times, if the file system supports
+// changing them.
+func (c *scpConn) setattrs(name string, attrs scpAttrs) error {
+	if err := c.authorize(FileSetstat, name); err != nil {
+		return err
+	}
+	if cfs, ok := c.fsys.(ChmodFS); ok {
+		if err := cfs.Chmod(name, attrs.mode); err != nil {
+			return err
+		}
+	}
+	if cfs, ok := c.fsys.(ChtimesFS); ok && !attrs.mtime.IsZero() {
+		if err := cfs.Chtimes(name, attrs.atime, attrs.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveSource sends the requested files once the client is ready.
+func (c *scpConn) serveSource() error {
+	if err := c.response(); err != nil {
+		return err
+	}
+	for _, arg := range c.cmd.paths {
+		name := scpPath(arg)
+		names := []string{name}
+		if strings.ContainsAny(arg, `*?[\`) {
+			// expand patterns, like the shell scp is usually run by
+			matches, err := fs.Glob(c.fsys, name)
+			if err != nil || len(matches) == 0 {
+				if err := c.warn(arg, fs.ErrNotExist); err != nil {
+					return err
+				}
+				continue
+			}
+			names = matches
+		}
+		for _, name := range names {
+			if err := c.source(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// source sends a file or directory.
+func (c *scpConn) source(name string) error {
+	fi, err := fs.Stat(c.fsys, name)
+	if err != nil {
+		return c.warn(name, err)
+	}
+	if fi.IsDir() {
+		if !c.cmd.recursive {
+			return c.warn(name, errSCPNotRegular)
+		}
+		return c.sourceDir(name, fi)
+	}
+	if !fi.Mode().IsRegular() {
+		return c.warn(name, errSCPNotRegular)
+	}
+	if err := c.authorize(FileRead, name); err != nil {
+		return c.warn(name, err)
+	}
+	f, err := c.fsys.Open(name)
+	if err != nil {
+		return c.warn(name, err)
+	}
+	defer f.Close()
+	if err := c.sendRecord(fi, 'C', fi.Size()); err != nil {
+		if err == errSCPSkipped {
+			return nil
+		}
+		return err
+	}
+	n, err := io.Copy(c.sess, io.LimitReader(f, fi.Size()))
+	if err == nil && n < fi.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// pad the file to the announced size, then report the error
+		if _, err := io.CopyN(c.sess, zeroReader{}, fi.Size()-n); err != nil {
+			return err
+		}
+		if err := c.warn(name, err); err != nil {
+			return err
+		}
+	} else if err := c.ack(); err != nil {
+		return err
+	}
+	if err := c.response(); err != nil && err != errSCPSkipped {
+		return err
+	}
+	return nil
+}
+
+func (c *scpConn) sourceDir(name string, fi fs.FileInfo) error {
+	if err := c.authorize(FileList, name); err != nil {
+		return c.warn(name, err)
+	}
+	entries, err := fs.ReadDir(c.fsys, name)
+	if err != nil {
+		return c.warn(name, err)
+	}
+	if err := c.sendRecord(fi, 'D', 0); err != nil {
+		if err == errSCPSkipped {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := c.source(path.Join(name, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(c.sess, "E\n"); err != nil {
+		return err
+	}
+	if err := c.response(); err != nil && err != errSCPSkipped {
+		return err
+	}
+	return nil
+}
+
+// sendRecord sends the control records announcing a file or directory.
+func (c *scpConn) sendRecord(fi fs.FileInfo, typ byte, size int64) error {
+	if c.cmd.preserve {
+		mtime := fi.ModTime().Unix()
+		if _, err := fmt.Fprintf(c.sess, "T%d 0 %d 0\n", mtime, mtime); err != nil {
+			return err
+		}
+		if err := c.response(); err != nil {
+			return err
+		}
+	}
+	perm := fi.Mode() & fs.ModePerm
+	if _, err := fmt.Fprintf(c.sess, "%c%04o %d %s\n", typ, perm, size, fi.Name()); err != nil {
+		return err
+	}
+	return c.response()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
@@ -0,0 +1,253 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestParseSCPCommand(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		args []string
+		want scpCommand
+		err  bool
+	}{
+		{args: []string{"scp", "-t", "dir"}, want: scpCommand{sink: true, paths: []string{"dir"}}},
+		{args: []string{"/usr/bin/scp", "-v", "-r", "-p", "-d", "-t", "--", "-dir"},
+			want: scpCommand{sink: true, recursive: true, preserve: true, targetDir: true, paths: []string{"-dir"}}},
+		{args: []string{"scp", "-pf", "a", "b"}, want: scpCommand{source: true, preserve: true, paths: []string{"a", "b"}}},
+		{args: []string{"ls", "-t", "dir"}, err: true},
+		{args: []string{"scp", "-t"}, err: true},
+		{args: []string{"scp", "-t", "-f", "dir"}, err: true},
+		{args: []string{"scp", "-x", "-t", "dir"}, err: true},
+		{args: nil, err: true},
+	} {
+		cmd, err := parseSCPCommand(tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(*cmd, tt.want) {
+			t.Errorf("%q: got %+v; want %+v", tt.args, *cmd, tt.want)
+		}
+	}
+}
+
+// runSCPCommand runs an scp command on a server, writing input and returning
+// the output and exit status.
+func runSCPCommand(t *testing.T, scp *SCPServer, cmd, input string) (string, string, int) {
+	session, _, cleanup := newTestSession(t, &Server{Handler: scp.HandleSession}, nil)
+	defer cleanup()
+	var stdout, stderr bytes.Buffer
+	session.Stdin = strings.NewReader(input)
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err := session.Run(cmd)
+	var exitErr *gossh.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	code := 0
+	if exitErr != nil {
+		code = exitErr.ExitStatus()
+	}
+	return stdout.String(), stderr.String(), code
+}
+
+func TestSCPSink(t *testing.T) {
+	t.Parallel()
+	fsys := NewMemFS()
+	scp := &SCPServer{Root: func(s Session) (fs.FS, error) { return fsys, nil }}
+	input := "D0755 0 dir\n" +
+		"T1000000000 0 1000000000 0\n" +
+		"C0600 5 hello\nhello\x00" +
+		"E\n" +
+		"C0644 3 top\nabc\x00"
+	stdout, _, code := runSCPCommand(t, scp, "scp -r -p -t .", input)
+	if code != 0 || stdout != strings.Repeat("\x00", 8) {
+		t.Fatalf("exit status %d, output %q", code, stdout)
+	}
+	if err := fstest.TestFS(fsys, "dir/hello", "top"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fsys.Stat("dir/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0600 || !fi.ModTime().Equal(time.Unix(1000000000, 0)) {
+		t.Fatalf("mode and time not preserved: %v %v", fi.Mode(), fi.ModTime())
+	}
+
+	// a single file may be given a new name, relative to the home directory
+	if _, _, code := runSCPCommand(t, scp, "scp -t ~/renamed", "C0644 3 ignored\nxyz\x00"); code != 0 {
+		t.Fatalf("exit status %d", code)
+	}
+	if data, err := fs.ReadFile(fsys, "renamed"); err != nil || string(data) != "xyz" {
+		t.Fatalf("unexpected contents %q %v", data, err)
+	}
+
+	// new directories get the requested mode once filled, even without -p
+	if _, _, code := runSCPCommand(t, scp, "scp -r -t ~", "D0555 0 ro\nC0644 3 file\nabc\x00E\n"); code != 0 {
+		t.Fatalf("exit status %d", code)
+	}
+	if fi, err := fsys.Stat("ro"); err != nil || fi.Mode().Perm() != 0555 {
+		t.Fatalf("unexpected directory info %v %v", fi, err)
+	}
+	if data, err := fs.ReadFile(fsys, "ro/file"); err != nil || string(data) != "abc" {
+		t.Fatalf("unexpected contents %q %v", data, err)
+	}
+}
+
+func TestSCPSinkErrors(t *testing.T) {
+	t.Parallel()
+	ro := &SCPServer{Root: func(s Session) (fs.FS, error) {
+		return fstest.MapFS{"dir": {Mode: fs.ModeDir | 0755}}, nil
+	}}
+	stdout, _, code := runSCPCommand(t, ro, "scp -t dir", "C0644 3 file\n")
+	if code != 1 || stdout != "\x00\x01scp: dir/file: Permission denied\n" {
+		t.Fatalf("exit status %d, output %q", code, stdout)
+	}
+
+	stdout, _, code = runSCPCommand(t, ro, "scp -d -t file", "")
+	if code != 1 || stdout != "\x02scp: file: Not a directory\n" {
+		t.Fatalf("exit status %d, output %q", code, stdout)
+	}
+
+	rw := &SCPServer{Root: func(s Session) (fs.FS, error) { return NewMemFS(), nil }}
+	for _, name := range []string{"..", "a/b", "."} {
+		stdout, _, code = runSCPCommand(t, rw, "scp -t .", "C0644 3 "+name+"\nabc\x00")
+		if code != 1 || stdout != "\x00\x02scp: unexpected filename: "+name+"\n" {
+			t.Fatalf("exit status %d, output %q", code, stdout)
+		}
+	}
+	stdout, _, code = runSCPCommand(t, rw, "scp -t .", "D0755 0 dir\nE\n")
+	if code != 1 || !strings.Contains(stdout, "without -r") {
+		t.Fatalf("exit status %d, output %q", code, stdout)
+	}
+
+	auth := &SCPServer{
+		Root: func(s Session) (fs.FS, error) { return NewMemFS(), nil },
+		Authorize: func(s Session, req FileRequest) error {
+			return errors.New("uploads are disabled")
+		},
+	}
+	stdout, _, code = runSCPCommand(t, auth, "scp -t .", "C0644 3 file\n")
+	if code != 1 || stdout != "\x00\x01scp: file: uploads are disabled\n" {
+		t.Fatalf("exit status %d, output %q", code, stdout)
+	}
+}
+
+func TestSCPSource(t *testing.T) {
+	t.Parallel()
+	scp := &SCPServer{Root: func(s Session) (fs.FS, error) {
+		return fstest.MapFS{
+			"dir/a":   {Data: []byte("aa"), Mode: 0640},
+			"dir/b/c": {Data: []byte("c"), Mode: 0644},
+		}, nil
+	}}
+	// the client acknowledges each record and file
+	acks := strings.Repeat("\x00", 10)
+	stdout, _, code := runSCPCommand(t, scp, "scp -r -f /dir missing", acks)
+	want := "D0555 0 dir\nC0640 2 a\naa\x00D0555 0 b\nC0644 1 c\nc\x00E\nE\n" +
+		"\x01scp: missing: No such file or directory\n"
+	if code != 1 || stdout != want {
+		t.Fatalf("exit status %d, output %q; want %q", code, stdout, want)
+	}
+
+	stdout, _, code = runSCPCommand(t, scp, "scp -f dir/*", acks)
+	want = "C0640 2 a\naa\x00\x01scp: dir/b: not a regular file\n"
+	if code != 1 || stdout != want {
+		t.Fatalf("exit status %d, output %q; want %q", code, stdout, want)
+	}
+}
+
+func TestSCPUnsupportedCommand(t *testing.T) {
+	t.Parallel()
+	scp := &SCPServer{Root: func(s Session) (fs.FS, error) { return NewMemFS(), nil }}
+	stdout, stderr, code := runSCPCommand(t, scp, "ls -l", "")
+	if code != 1 || stdout != "" || !strings.Contains(stderr, "only scp commands") {
+		t.Fatalf("exit status %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+}
+
+// TestSCPClient transfers files with the OpenSSH scp client, if installed.
+func TestSCPClient(t *testing.T) {
+	t.Parallel()
+	scpPath, err := exec.LookPath("scp")
+	if err != nil {
+		t.Skip("scp not found")
+	}
+	local := t.TempDir()
+	remote := t.TempDir()
+	src := filepath.Join(local, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"one":       "first file\n",
+		"sub/two":   strings.Repeat("second file\n", 10000),
+		"sub/empty": "",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Unix(1234567890, 0)
+	if err := os.Chtimes(filepath.Join(src, "one"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	scp := func(args ...string) {
+		l := newLocalListener()
+		srv := &Server{Handler: (&SCPServer{
+			Root: func(s Session) (fs.FS, error) { return OSFS(remote), nil },
+		}).HandleSession}
+		go srv.serveOnce(l)
+		_, port, _ := strings.Cut(l.Addr().String(), ":")
+		args = append([]string{"-O", "-F", "/dev/null", "-P", port,
+			"-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null",
+			"-o", "BatchMode=yes", "-o", "LogLevel=ERROR"}, args...)
+		cmd := exec.Command(scpPath, args...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("scp failed: %v\n%s", err, out)
+		}
+	}
+	scp("-r", "-p", src, "127.0.0.1:dst")
+	fi, err := os.Stat(filepath.Join(remote, "dst", "one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) || fi.Mode() != 0640 {
+		t.Fatalf("mode and time not preserved: %v %v", fi.Mode(), fi.ModTime())
+	}
+
+	dst := filepath.Join(local, "dst")
+	scp("-r", "127.0.0.1:dst", dst)
+	for name, data := range files {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Fatalf("%s: contents differ", name)
+		}
+	}
+}
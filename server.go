@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	gossh "golang.org/x/crypto/ssh"
@@ -23,6 +24,13 @@ type RequestHandler func(ctx Context, srv *Server, req *gossh.Request) (ok bool,
 
 var DefaultRequestHandlers = map[string]RequestHandler{}
 
+// SessionRequestHandler is a callback for handling requests on a session
+// channel that this package doesn't handle itself, such as vendor extensions.
+// It runs on the session's request loop, so it must not block.
+type SessionRequestHandler func(sess Session, req *gossh.Request) (ok bool)
+
+var DefaultSessionRequestHandlers = map[string]SessionRequestHandler{}
+
 type ChannelHandler func(srv *Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx Context)
 
 var DefaultChannelHandlers = map[string]ChannelHandler{
@@ -46,16 +54,36 @@ type Server struct {
 	PtyCallback                   PtyCallback                   // callback for allowing PTY sessions, allows all if nil
 	ConnCallback                  ConnCallback                  // optional callback for wrapping net.Conn before handling
 	LocalPortForwardingCallback   LocalPortForwardingCallback   // callback for allowing local port forwarding, denies all if nil
+	LocalUnixForwardingCallback   LocalUnixForwardingCallback   // callback for allowing local unix socket forwarding, denies all if nil
 	ReversePortForwardingCallback ReversePortForwardingCallback // callback for allowing reverse port forwarding, denies all if nil
+	ReverseUnixForwardingCallback ReverseUnixForwardingCallback // callback for allowing reverse unix socket forwarding, denies all if nil
 	ServerConfigCallback          ServerConfigCallback          // callback for configuring detailed SSH options
 	SessionRequestCallback        SessionRequestCallback        // callback for allowing or denying SSH sessions
+	EnvPolicy                     *EnvPolicy                    // policy for environment variables set by the client, allows all if nil
+	EnvCallback                   EnvCallback                   // callback for allowing environment variables, checked after EnvPolicy
+	X11Callback                   X11Callback                   // callback for allowing X11 forwarding, denies all if nil
 
-	ConnectionFailedCallback ConnectionFailedCallback // callback to report connection failures
+	ConnectionFailedCallback ConnectionFailedCallback // callback to report failed handshakes and keepalive timeouts
+	ConnectionClosedCallback ConnectionClosedCallback // callback to report closed connections after a successful handshake
+	PanicCallback            PanicCallback            // callback to report recovered handler panics, logs if nil
 
 	HandshakeTimeout time.Duration // connection timeout until successful handshake, none if empty
 	IdleTimeout      time.Duration // connection timeout when no activity, none if empty
 	MaxTimeout       time.Duration // absolute connection timeout, none if empty
 
+	SessionIdleTimeout     time.Duration          // session timeout when no channel data activity, none if empty
+	SessionMaxTimeout      time.Duration          // absolute session timeout, none if empty
+	SessionTimeoutWarning  time.Duration          // how long before a session timeout to warn on stderr, none if empty
+	SessionTimeoutCallback SessionTimeoutCallback // callback for per-session timeouts, overrides the above
+
+	ClientAliveInterval time.Duration       // interval between keepalive requests to the client, none if empty
+	ClientAliveCountMax int                 // unanswered keepalive intervals before disconnecting, 3 if empty
+	ClientAliveCallback ClientAliveCallback // callback for per-connection keepalive settings, overrides the above
+
+	MaxSessions        int // maximum concurrent session channels server-wide, unlimited if empty
+	MaxSessionsPerConn int // maximum concurrent session channels per connection, unlimited if empty
+	MaxChannelsPerConn int // maximum concurrent channels of any type per connection, unlimited if empty
+
 	// ChannelHandlers allow overriding the built-in session handlers or provide
 	// extensions to the protocol, such as tcpip forwarding. By default only the
 	// "session" handler is enabled.
@@ -66,16 +94,30 @@ type Server struct {
 	// no handlers are enabled.
 	RequestHandlers map[string]RequestHandler
 
+	// SessionRequestHandlers provide extensions to the session protocol by
+	// handling request types on session channels that aren't built in, such as
+	// "xon-xoff" or vendor requests like "keepalive@example.com". By default
+	// no handlers are enabled.
+	SessionRequestHandlers map[string]SessionRequestHandler
+
 	// SubsystemHandlers are handlers which are similar to the usual SSH command
 	// handlers, but handle named subsystems.
 	SubsystemHandlers map[string]SubsystemHandler
 
+	// Middleware is applied to Handler and to SubsystemHandlers for every
+	// session, with the first middleware being the outermost.
+	Middleware []Middleware
+
 	listenerWg sync.WaitGroup
 	mu         sync.RWMutex
 	listeners  map[net.Listener]struct{}
 	conns      map[*gossh.ServerConn]struct{}
 	connWg     sync.WaitGroup
 	doneChan   chan struct{}
+
+	sessionCount     atomic.Int64
+	channelCount     atomic.Int64
+	rejectedChannels atomic.Uint64
 }
 
 func (srv *Server) ensureHostSigner() error {
@@ -108,6 +150,12 @@ func (srv *Server) ensureHandlers() {
 			srv.ChannelHandlers[k] = v
 		}
 	}
+	if srv.SessionRequestHandlers == nil {
+		srv.SessionRequestHandlers = map[string]SessionRequestHandler{}
+		for k, v := range DefaultSessionRequestHandlers {
+			srv.SessionRequestHandlers[k] = v
+		}
+	}
 	if srv.SubsystemHandlers == nil {
 		srv.SubsystemHandlers = map[string]SubsystemHandler{}
 		for k, v := range DefaultSubsystemHandlers {
@@ -308,10 +356,29 @@ func (srv *Server) HandleConn(newConn net.Conn) {
 	srv.trackConn(sshConn, true)
 	defer srv.trackConn(sshConn, false)
 
+	var channels sync.WaitGroup
+	defer func() {
+		traffic := contextTraffic(ctx)
+		if srv.ConnectionClosedCallback == nil {
+			traffic.close()
+			return
+		}
+		// cancel the context and give the channels a moment to finish, so
+		// the callback sees the final stats, without letting a handler that
+		// ignores the closed connection hold it up
+		cancel()
+		conn.Close()
+		waitTimeout(&channels, channelDrainTimeout)
+		traffic.close()
+		srv.ConnectionClosedCallback(ctx)
+	}()
+
 	ctx.SetValue(ContextKeyConn, sshConn)
 	applyConnMetadata(ctx, sshConn)
 	//go gossh.DiscardRequests(reqs)
 	go srv.handleRequests(ctx, reqs)
+	go srv.keepAlive(ctx, sshConn, conn)
+	var open connChannels
 	for ch := range chans {
 		handler := srv.ChannelHandlers[ch.ChannelType()]
 		if handler == nil {
@@ -321,12 +388,41 @@ func (srv *Server) HandleConn(newConn net.Conn) {
 			ch.Reject(gossh.UnknownChannelType, "unsupported channel type")
 			continue
 		}
-		go handler(srv, sshConn, ch, ctx)
+		if !srv.acquireChannel(&open, ch) {
+			continue
+		}
+		channels.Add(1)
+		go func(ch gossh.NewChannel) {
+			defer channels.Done()
+			defer srv.releaseChannel(&open, ch)
+			srv.serveChannel(handler, sshConn, ch, ctx)
+		}(ch)
+	}
+}
+
+// channelDrainTimeout limits how long a closed connection waits for its
+// channel handlers before reporting it to ConnectionClosedCallback.
+var channelDrainTimeout = 5 * time.Second
+
+// waitTimeout waits for wg, but no longer than d.
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
 	}
 }
 
 func (srv *Server) handleRequests(ctx Context, in <-chan *gossh.Request) {
+	traffic := contextTraffic(ctx)
 	for req := range in {
+		traffic.countRequest(req.Type)
 		handler := srv.RequestHandlers[req.Type]
 		if handler == nil {
 			handler = srv.RequestHandlers["default"]
@@ -337,8 +433,7 @@ func (srv *Server) handleRequests(ctx Context, in <-chan *gossh.Request) {
 		}
 		/*reqCtx, cancel := context.WithCancel(ctx)
 		defer cancel() */
-		ret, payload := handler(ctx, srv, req)
-		req.Reply(ret, payload)
+		srv.serveRequest(handler, ctx, req)
 	}
 }
 
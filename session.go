@@ -2,10 +2,12 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/anmitsu/go-shlex"
 	gossh "golang.org/x/crypto/ssh"
@@ -35,9 +37,24 @@ type Session interface {
 	// user for this session, in the form "key=value".
 	Environ() []string
 
+	// Getenv returns the value of the environment variable named by key, or
+	// an empty string if the user didn't set it. If the variable was set more
+	// than once, the last value is returned.
+	Getenv(key string) string
+
+	// LookupEnv returns the value of the environment variable named by key
+	// and whether the user set it. If the variable was set more than once,
+	// the last value is returned.
+	LookupEnv(key string) (string, bool)
+
 	// Exit sends an exit status and then closes the session.
 	Exit(code int) error
 
+	// ExitSignal reports that the session was terminated by a signal, with an
+	// optional message, and then closes the session. A session can only exit
+	// once, either way.
+	ExitSignal(sig Signal, msg string) error
+
 	// Command returns a shell parsed slice of arguments that were provided by the
 	// user. Shell parsing splits the command string according to POSIX shell rules,
 	// which considers quoting not just whitespace.
@@ -53,12 +70,15 @@ type Session interface {
 	// used it will return nil.
 	PublicKey() PublicKey
 
-	// Context returns the connection's context. The returned context is always
-	// non-nil and holds the same data as the Context passed into auth
-	// handlers and callbacks.
+	// Context returns the session's context. The returned context is always
+	// non-nil and is derived from the connection's context, so it holds the
+	// same data as the Context passed into auth handlers and callbacks, as
+	// well as session values like ContextKeyRequestType. Values set on it are
+	// only visible to this session. Use ConnContext to get the connection's
+	// context.
 	//
-	// The context is canceled when the client's connection closes or I/O
-	// operation fails.
+	// The context is canceled when the session's channel closes, the handler
+	// returns, or the client's connection closes or I/O operation fails.
 	Context() Context
 
 	// Permissions returns a copy of the Permissions object that was available for
@@ -66,22 +86,55 @@ type Session interface {
 	Permissions() Permissions
 
 	// Pty returns PTY information, a channel of window size changes, and a boolean
-	// of whether or not a PTY was accepted for this session.
+	// of whether or not a PTY was accepted for this session. Window changes the
+	// channel's receiver hasn't caught up with are coalesced, so that it always
+	// gets the latest size without blocking the request handling loop.
 	Pty() (Pty, <-chan Window, bool)
 
-	// Signals registers a channel to receive signals sent from the client. The
-	// channel must handle signal sends or it will block the SSH request loop.
-	// Registering nil will unregister the channel from signal sends. During the
-	// time no channel is registered signals are buffered up to a reasonable amount.
+	// TerminalModes returns a copy of the terminal modes requested with the
+	// PTY, or nil if no PTY was accepted.
+	TerminalModes() gossh.TerminalModes
+
+	// X11 returns the X11 forwarding request and a boolean of whether or not
+	// X11 forwarding was accepted for this session.
+	X11() (X11, bool)
+
+	// Signals registers a channel to receive signals sent from the client.
+	// Signals the channel isn't receiving are buffered up to a reasonable
+	// amount, and dropped after that, so they never block the SSH request
+	// loop. Registering nil will unregister the channel from signal sends.
+	// During the time no channel is registered signals are buffered as well.
 	// If there are buffered signals when a channel is registered, they will be
 	// sent in order on the channel immediately after registering.
 	Signals(c chan<- Signal)
 
 	// Break regisers a channel to receive notifications of break requests sent
-	// from the client. The channel must handle break requests, or it will block
-	// the request handling loop. Registering nil will unregister the channel.
-	// During the time that no channel is registered, breaks are ignored.
+	// from the client. Breaks are delivered without blocking the request
+	// handling loop, and are dropped if more than a few are waiting to be
+	// received. Registering nil will unregister the channel. During the time
+	// that no channel is registered, breaks are ignored.
 	Break(c chan<- bool)
+
+	// BreakRequests is like Break, but the channel receives the break length
+	// requested by the client. It may be used alongside Break.
+	BreakRequests(c chan<- BreakRequest)
+
+	// DroppedBreaks returns the number of break requests that were dropped
+	// because a registered channel wasn't receiving them. A break dropped by
+	// both the Break and BreakRequests channels counts once.
+	DroppedBreaks() uint64
+
+	// Stats returns the traffic statistics of the session so far. Use
+	// ConnectionStats for the totals of the connection.
+	Stats() SessionStats
+
+	// Events returns a new channel of the events that happen in the session
+	// from now on, such as window changes, signals and breaks. Events are
+	// delivered without blocking the request handling loop: window changes
+	// the receiver hasn't caught up with are coalesced, and other events are
+	// dropped if too many are waiting to be received. The channel is closed
+	// when the session's context is canceled.
+	Events() <-chan Event
 }
 
 // maxSigBufSize is how many signals will be buffered
@@ -94,44 +147,103 @@ func DefaultSessionHandler(srv *Server, conn *gossh.ServerConn, newChan gossh.Ne
 		// TODO: trigger event callback
 		return
 	}
+	sessCtx, cancel := newSessionContext(ctx)
+	defer cancel()
+	sessTraffic := newTraffic()
+	defer sessTraffic.close()
+	connTraffic := contextTraffic(ctx)
+	if connTraffic != nil {
+		connTraffic.sessions.Add(1)
+	}
+	sessCtx.SetValue(ContextKeyStartTime, sessTraffic.start)
+	eow := make(chan struct{})
+	sessCtx.SetValue(contextKeyEndOfWrite, eow)
+	activity := newActivityChannel(ch, sessTraffic, connTraffic)
+	// signals are buffered until a channel is registered
+	signals := newDeliveryQueue[Signal](maxSigBufSize, sessCtx.Done())
+	signals.buffered = true
 	sess := &session{
-		Channel:           ch,
+		Channel:           activity,
+		activity:          activity,
+		traffic:           sessTraffic,
+		connTraffic:       connTraffic,
+		srv:               srv,
 		conn:              conn,
 		handler:           srv.Handler,
+		middleware:        Chain(srv.Middleware...),
 		ptyCb:             srv.PtyCallback,
+		envPolicy:         srv.EnvPolicy,
+		envCb:             srv.EnvCallback,
+		x11Cb:             srv.X11Callback,
 		sessReqCb:         srv.SessionRequestCallback,
 		subsystemHandlers: srv.SubsystemHandlers,
-		ctx:               ctx,
+		requestHandlers:   srv.SessionRequestHandlers,
+		eow:               eow,
+		signals:           signals,
+		breaks:            newDeliveryQueue[bool](maxBreakBufSize, sessCtx.Done()),
+		breakReqs:         newDeliveryQueue[BreakRequest](maxBreakBufSize, sessCtx.Done()),
+		ctx:               sessCtx,
+		cancel:            cancel,
+		inputReady:        make(chan struct{}, 1),
+		inputSpace:        make(chan struct{}, 1),
 	}
+	defer func() {
+		if r := recover(); r != nil {
+			srv.handlePanic(sessCtx, "session", r)
+			ch.Close()
+		}
+	}()
+	go sess.readInput()
 	sess.handleRequests(reqs)
 }
 
 type session struct {
 	sync.Mutex
 	gossh.Channel
+	srv               *Server
+	activity          *activityChannel
+	traffic           *traffic
+	connTraffic       *traffic
 	conn              *gossh.ServerConn
 	handler           Handler
+	middleware        Middleware
 	subsystemHandlers map[string]SubsystemHandler
+	requestHandlers   map[string]SessionRequestHandler
+	eow               chan struct{}
 	handled           bool
 	exited            bool
 	pty               *Pty
-	winch             chan Window
+	modes             gossh.TerminalModes
+	winch             <-chan Window
+	winchQueue        *deliveryQueue[Window]
 	env               []string
 	ptyCb             PtyCallback
+	envPolicy         *EnvPolicy
+	envCb             EnvCallback
+	x11Cb             X11Callback
+	x11               *X11
 	sessReqCb         SessionRequestCallback
 	rawCmd            string
 	subsystem         string
 	ctx               Context
-	sigCh             chan<- Signal
-	sigBuf            []Signal
-	breakCh           chan<- bool
+	cancel            context.CancelFunc
+	signals           *deliveryQueue[Signal]
+	breaks            *deliveryQueue[bool]
+	breakReqs         *deliveryQueue[BreakRequest]
+	droppedBreaks     atomic.Uint64
+	subscribers       []*deliveryQueue[Event]
+	inputMu           sync.Mutex // guards pending and inputErr
+	pending           []byte     // input read ahead by readInput
+	inputErr          error
+	inputReady        chan struct{}
+	inputSpace        chan struct{}
 }
 
 func (sess *session) Write(p []byte) (n int, err error) {
 	if sess.pty != nil {
 		m := len(p)
 		// normalize \n to \r\n when pty is accepted.
-		// this is a hardcoded shortcut since we don't support terminal modes.
+		// this is a hardcoded shortcut since terminal modes are not interpreted.
 		p = bytes.Replace(p, []byte{'\n'}, []byte{'\r', '\n'}, -1)
 		p = bytes.Replace(p, []byte{'\r', '\r', '\n'}, []byte{'\r', '\n'}, -1)
 		n, err = sess.Channel.Write(p)
@@ -178,6 +290,21 @@ func (sess *session) Exit(code int) error {
 	return sess.Close()
 }
 
+func (sess *session) ExitSignal(sig Signal, msg string) error {
+	sess.Lock()
+	defer sess.Unlock()
+	if sess.exited {
+		return errors.New("Session.Exit called multiple times")
+	}
+	sess.exited = true
+
+	payload := gossh.Marshal(&exitSignalMsg{Signal: string(sig), Message: msg})
+	if _, err := sess.SendRequest("exit-signal", false, payload); err != nil {
+		return err
+	}
+	return sess.Close()
+}
+
 func (sess *session) User() string {
 	return sess.conn.User()
 }
@@ -194,6 +321,15 @@ func (sess *session) Environ() []string {
 	return append([]string(nil), sess.env...)
 }
 
+func (sess *session) Getenv(key string) string {
+	v, _ := lookupEnv(sess.env, key)
+	return v
+}
+
+func (sess *session) LookupEnv(key string) (string, bool) {
+	return lookupEnv(sess.env, key)
+}
+
 func (sess *session) RawCommand() string {
 	return sess.rawCmd
 }
@@ -214,27 +350,66 @@ func (sess *session) Pty() (Pty, <-chan Window, bool) {
 	return Pty{}, sess.winch, false
 }
 
-func (sess *session) Signals(c chan<- Signal) {
-	sess.Lock()
-	defer sess.Unlock()
-	sess.sigCh = c
-	if len(sess.sigBuf) > 0 {
-		go func() {
-			for _, sig := range sess.sigBuf {
-				sess.sigCh <- sig
-			}
-		}()
+func (sess *session) TerminalModes() gossh.TerminalModes {
+	if sess.pty == nil {
+		return nil
+	}
+	modes := make(gossh.TerminalModes, len(sess.modes))
+	for k, v := range sess.modes {
+		modes[k] = v
+	}
+	return modes
+}
+
+func (sess *session) X11() (X11, bool) {
+	if sess.x11 != nil {
+		return *sess.x11, true
 	}
+	return X11{}, false
+}
+
+func (sess *session) Signals(c chan<- Signal) {
+	sess.signals.register(c)
 }
 
 func (sess *session) Break(c chan<- bool) {
-	sess.Lock()
-	defer sess.Unlock()
-	sess.breakCh = c
+	sess.breaks.register(c)
+}
+
+func (sess *session) BreakRequests(c chan<- BreakRequest) {
+	sess.breakReqs.register(c)
+}
+
+func (sess *session) DroppedBreaks() uint64 {
+	return sess.droppedBreaks.Load()
+}
+
+// runHandler runs the handler with the session's middleware and exits the
+// session when it returns. If the handler panics, the panic is reported to the
+// server and the session exits with status 255. Session timeouts are enforced
+// while the handler runs.
+func (sess *session) runHandler(source string, handler Handler) {
+	done := make(chan struct{})
+	defer close(done)
+	defer sess.cancel()
+	if t := sess.sessionTimeouts(); t.enabled() {
+		go sess.watchTimeouts(t, done)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			sess.srv.handlePanic(sess.ctx, source, r)
+			fmt.Fprintln(sess.Stderr(), "ssh: internal server error")
+			sess.Exit(exitStatusPanic)
+		}
+	}()
+	sess.middleware(handler)(sess)
+	sess.Exit(0)
 }
 
 func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
 	for req := range reqs {
+		sess.traffic.countRequest(req.Type)
+		sess.connTraffic.countRequest(req.Type)
 		switch req.Type {
 		case "shell", "exec":
 			if sess.handled {
@@ -255,12 +430,10 @@ func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
 			}
 
 			sess.handled = true
+			sess.ctx.SetValue(ContextKeyRequestType, req.Type)
 			req.Reply(true, nil)
 
-			go func() {
-				sess.handler(sess)
-				sess.Exit(0)
-			}()
+			go sess.runHandler("session", sess.handler)
 		case "subsystem":
 			if sess.handled {
 				req.Reply(false, nil)
@@ -289,39 +462,42 @@ func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
 			}
 
 			sess.handled = true
+			sess.ctx.SetValue(ContextKeyRequestType, req.Type)
 			req.Reply(true, nil)
 
-			go func() {
-				handler(sess)
-				sess.Exit(0)
-			}()
+			go sess.runHandler("subsystem "+payload.Value, Handler(handler))
 		case "env":
 			if sess.handled {
 				req.Reply(false, nil)
 				continue
 			}
 			var kv struct{ Key, Value string }
-			gossh.Unmarshal(req.Payload, &kv)
+			if err := gossh.Unmarshal(req.Payload, &kv); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			if !sess.envPolicy.allows(kv.Key, kv.Value, len(sess.env)) {
+				req.Reply(false, nil)
+				continue
+			}
+			if sess.envCb != nil && !sess.envCb(sess, kv.Key, kv.Value) {
+				req.Reply(false, nil)
+				continue
+			}
 			sess.env = append(sess.env, fmt.Sprintf("%s=%s", kv.Key, kv.Value))
+			sess.publish(EnvEvent{kv.Key, kv.Value})
 			req.Reply(true, nil)
 		case "signal":
 			var payload struct{ Signal string }
 			gossh.Unmarshal(req.Payload, &payload)
-			sess.Lock()
-			if sess.sigCh != nil {
-				sess.sigCh <- Signal(payload.Signal)
-			} else {
-				if len(sess.sigBuf) < maxSigBufSize {
-					sess.sigBuf = append(sess.sigBuf, Signal(payload.Signal))
-				}
-			}
-			sess.Unlock()
+			sess.signals.push(Signal(payload.Signal))
+			sess.publish(SignalEvent{Signal(payload.Signal)})
 		case "pty-req":
 			if sess.handled || sess.pty != nil {
 				req.Reply(false, nil)
 				continue
 			}
-			ptyReq, ok := parsePtyRequest(req.Payload)
+			ptyReq, modes, ok := parsePtyRequest(req.Payload)
 			if !ok {
 				req.Reply(false, nil)
 				continue
@@ -334,12 +510,18 @@ func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
 				}
 			}
 			sess.pty = &ptyReq
-			sess.winch = make(chan Window, 1)
-			sess.winch <- ptyReq.Window
-			defer func() {
-				// when reqs is closed
-				close(sess.winch)
-			}()
+			sess.modes = modes
+			sess.ctx.SetValue(ContextKeyPty, ptyReq)
+			// the window channel is closed when reqs is closed
+			winchDone := make(chan struct{})
+			defer close(winchDone)
+			winch := make(chan Window)
+			sess.winchQueue = newDeliveryQueue[Window](2, winchDone)
+			sess.winchQueue.coalesce = func(old, win Window) bool { return true }
+			sess.winchQueue.closeOnDone = true
+			sess.winchQueue.register(winch)
+			sess.winchQueue.push(ptyReq.Window)
+			sess.winch = winch
 			req.Reply(ok, nil)
 		case "window-change":
 			if sess.pty == nil {
@@ -349,7 +531,21 @@ func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
 			win, ok := parseWinchRequest(req.Payload)
 			if ok {
 				sess.pty.Window = win
-				sess.winch <- win
+				sess.winchQueue.push(win)
+				sess.publish(WindowChangeEvent{win})
+			}
+			req.Reply(ok, nil)
+		case x11RequestType:
+			if sess.handled || sess.x11 != nil || sess.x11Cb == nil {
+				req.Reply(false, nil)
+				continue
+			}
+			x11Req, ok := parseX11Request(req.Payload)
+			if ok {
+				ok = sess.x11Cb(sess.ctx, x11Req)
+			}
+			if ok {
+				sess.x11 = &x11Req
 			}
 			req.Reply(ok, nil)
 		case agentRequestType:
@@ -357,17 +553,27 @@ func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
 			SetAgentRequested(sess.ctx)
 			req.Reply(true, nil)
 		case "break":
-			ok := false
-			sess.Lock()
-			if sess.breakCh != nil {
-				sess.breakCh <- true
-				ok = true
+			// clients that omit the length get a zero length break
+			brk, _ := parseBreakRequest(req.Payload)
+			req.Reply(sess.handleBreak(brk), nil)
+		case eowRequestType:
+			select {
+			case <-sess.eow:
+			default:
+				close(sess.eow)
 			}
-			req.Reply(ok, nil)
-			sess.Unlock()
+			req.Reply(true, nil)
 		default:
-			// TODO: debug log
-			req.Reply(false, nil)
+			sess.publish(newRequestEvent(req))
+			handler := sess.requestHandlers[req.Type]
+			if handler == nil {
+				handler = sess.requestHandlers["default"]
+			}
+			if handler == nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(handler(sess, req), nil)
 		}
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"testing"
+	"time"
 
 	gossh "golang.org/x/crypto/ssh"
 )
@@ -228,6 +229,30 @@ func TestPty(t *testing.T) {
 	<-done
 }
 
+func TestPtyTerminalModes(t *testing.T) {
+	t.Parallel()
+	got := make(chan string, 1)
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			modes := s.TerminalModes()
+			// callers get their own copy
+			modes[gossh.ECHO] = 1
+			got <- fmt.Sprint(s.TerminalModes())
+		},
+	}, nil)
+	defer cleanup()
+	if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{gossh.ECHO: 0, gossh.TTY_OP_ISPEED: 9600}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprint(gossh.TerminalModes{gossh.ECHO: 0, gossh.TTY_OP_ISPEED: 9600})
+	if modes := <-got; modes != want {
+		t.Fatalf("modes = %s; want %s", modes, want)
+	}
+}
+
 func TestPtyResize(t *testing.T) {
 	t.Parallel()
 	winch0 := Window{40, 80}
@@ -436,3 +461,134 @@ func TestBreakWithoutChanRegistered(t *testing.T) {
 		t.Fatalf("expected nil but got %v", err)
 	}
 }
+
+func TestBreakRequestLength(t *testing.T) {
+	t.Parallel()
+	breaks := make(chan BreakRequest)
+	ready := make(chan struct{})
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			s.BreakRequests(breaks)
+			close(ready)
+			io.WriteString(s, (<-breaks).Duration().String())
+		},
+	}, nil)
+	defer cleanup()
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	done := make(chan error, 1)
+	go func() { done <- session.Run("") }()
+	<-ready
+	ok, err := session.SendRequest("break", true, gossh.Marshal(BreakRequest{Length: 500}))
+	if err != nil || !ok {
+		t.Fatalf("expected break to be accepted: %v %v", ok, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "500ms" {
+		t.Fatalf("stdout = %q; want %q", stdout.String(), "500ms")
+	}
+}
+
+func TestBreakSlowReceiver(t *testing.T) {
+	t.Parallel()
+	// neither channel is received from, and each break counts once
+	breaks := make(chan BreakRequest)
+	breakNotices := make(chan bool)
+	ready := make(chan struct{})
+	release := make(chan struct{})
+	dropped := make(chan uint64, 1)
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			s.BreakRequests(breaks)
+			s.Break(breakNotices)
+			close(ready)
+			<-release
+			dropped <- s.DroppedBreaks()
+		},
+	}, nil)
+	defer cleanup()
+	done := make(chan error, 1)
+	go func() { done <- session.Run("") }()
+	<-ready
+	// breaks stay buffered until received, so the ones past the limit drop
+	n := maxBreakBufSize + 5
+	for i := 0; i < n; i++ {
+		if _, err := session.SendRequest("break", true, gossh.Marshal(BreakRequest{Length: 100})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the request loop must still be responsive
+	if _, err := session.SendRequest("env", true, gossh.Marshal(struct{ Key, Value string }{"A", "B"})); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := <-dropped; n != 5 {
+		t.Fatalf("dropped = %d; want 5", n)
+	}
+}
+
+func TestSessionRequestHandlers(t *testing.T) {
+	t.Parallel()
+	got := make(chan string, 1)
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			io.WriteString(s, <-got)
+		},
+		SessionRequestHandlers: map[string]SessionRequestHandler{
+			"vendor@example.com": func(sess Session, req *gossh.Request) bool {
+				got <- sess.User() + ":" + string(req.Payload)
+				return true
+			},
+		},
+	}, nil)
+	defer cleanup()
+	ok, err := session.SendRequest("vendor@example.com", true, []byte("hello"))
+	if err != nil || !ok {
+		t.Fatalf("expected vendor request to succeed: %v %v", ok, err)
+	}
+	ok, err = session.SendRequest("unknown@example.com", true, nil)
+	if err != nil || ok {
+		t.Fatalf("expected unknown request to fail: %v %v", ok, err)
+	}
+	out, err := session.Output("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "testuser:hello" {
+		t.Fatalf("stdout = %q; want %q", out, "testuser:hello")
+	}
+}
+
+func TestEndOfWrite(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			select {
+			case <-EndOfWrite(s):
+				io.WriteString(s, "eow")
+			case <-time.After(time.Second):
+				io.WriteString(s, "timeout")
+			}
+		},
+	}, nil)
+	defer cleanup()
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	if err := session.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.SendRequest(eowRequestType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "eow" {
+		t.Fatalf("stdout = %q; want eow", stdout.String())
+	}
+}
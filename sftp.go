@@ -0,0 +1,1036 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// SFTP packet types as specified in draft-ietf-secsh-filexfer-02
+const (
+	sftpPacketInit          = 1
+	sftpPacketVersion       = 2
+	sftpPacketOpen          = 3
+	sftpPacketClose         = 4
+	sftpPacketRead          = 5
+	sftpPacketWrite         = 6
+	sftpPacketLstat         = 7
+	sftpPacketFstat         = 8
+	sftpPacketSetstat       = 9
+	sftpPacketFsetstat      = 10
+	sftpPacketOpendir       = 11
+	sftpPacketReaddir       = 12
+	sftpPacketRemove        = 13
+	sftpPacketMkdir         = 14
+	sftpPacketRmdir         = 15
+	sftpPacketRealpath      = 16
+	sftpPacketStat          = 17
+	sftpPacketRename        = 18
+	sftpPacketReadlink      = 19
+	sftpPacketSymlink       = 20
+	sftpPacketStatus        = 101
+	sftpPacketHandle        = 102
+	sftpPacketData          = 103
+	sftpPacketName          = 104
+	sftpPacketAttrs         = 105
+	sftpPacketExtended      = 200
+	sftpPacketExtendedReply = 201
+)
+
+// SFTP status codes
+const (
+	sftpStatusOK               = 0
+	sftpStatusEOF              = 1
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+	sftpStatusFailure          = 4
+	sftpStatusBadMessage       = 5
+	sftpStatusOpUnsupported    = 8
+)
+
+var sftpStatusMessages = map[uint32]string{
+	sftpStatusOK:               "Success",
+	sftpStatusEOF:              "End of file",
+	sftpStatusNoSuchFile:       "No such file",
+	sftpStatusPermissionDenied: "Permission denied",
+	sftpStatusFailure:          "Failure",
+	sftpStatusBadMessage:       "Bad message",
+	sftpStatusOpUnsupported:    "Operation unsupported",
+}
+
+// SFTP attribute flags
+const (
+	sftpAttrSize        = 0x00000001
+	sftpAttrUIDGID      = 0x00000002
+	sftpAttrPermissions = 0x00000004
+	sftpAttrACModTime   = 0x00000008
+	sftpAttrExtended    = 0x80000000
+)
+
+// SFTP open flags
+const (
+	sftpOpenRead   = 0x00000001
+	sftpOpenWrite  = 0x00000002
+	sftpOpenAppend = 0x00000004
+	sftpOpenCreate = 0x00000008
+	sftpOpenTrunc  = 0x00000010
+	sftpOpenExcl   = 0x00000020
+)
+
+const (
+	sftpProtocolVersion = 3
+
+	// sftpMaxPacket is the largest packet accepted from the client, the
+	// same limit as OpenSSH.
+	sftpMaxPacket = 256 * 1024
+
+	// sftpMaxRead is the most data returned by a single read, so the
+	// response fits into the client's packet limit.
+	sftpMaxRead = sftpMaxPacket - 1024
+
+	// sftpMaxHandles is how many files and directories a session may have
+	// open at once.
+	sftpMaxHandles = 512
+
+	// sftpReaddirBatch is how many entries are returned per readdir.
+	sftpReaddirBatch = 100
+)
+
+// SFTP extensions, announced in the version packet
+var sftpExtensions = []struct{ name, version string }{
+	{"posix-rename@openssh.com", "1"},
+	{"statvfs@openssh.com", "2"},
+	{"fstatvfs@openssh.com", "2"},
+	{"hardlink@openssh.com", "1"},
+	{"fsync@openssh.com", "1"},
+}
+
+// SFTPServer is an SFTP version 3 server, the version implemented by
+// OpenSSH, for use as the "sftp" subsystem. Each session is served from the
+// file system returned by Root, so users can be kept to their own files.
+// Changes to files are only supported if the file system implements
+// WritableFS, and changes to attributes and links only if it implements the
+// respective interfaces, like ChmodFS or SymlinkFS. Besides the base protocol,
+// the posix-rename, statvfs, fstatvfs, hardlink and fsync extensions of OpenSSH
+// are supported.
+type SFTPServer struct {
+	// Root returns the file system to serve for a session. Paths sent by
+	// the client are resolved relative to the root of the file system, which
+	// is also the client's working directory.
+	Root func(s Session) (fs.FS, error)
+
+	// Authorize, if non-nil, is called before each file operation. Opening
+	// a file for reading and writing is authorized as both FileRead and
+	// FileWrite.
+	Authorize FileAuthorizer
+}
+
+// SFTP returns a functional option that serves the "sftp" subsystem with
+// the given SFTPServer.
+func SFTP(sftp *SFTPServer) Option {
+	return func(srv *Server) error {
+		if srv.SubsystemHandlers == nil {
+			srv.SubsystemHandlers = map[string]SubsystemHandler{}
+			for k, v := range DefaultSubsystemHandlers {
+				srv.SubsystemHandlers[k] = v
+			}
+		}
+		srv.SubsystemHandlers["sftp"] = sftp.HandleSession
+		return nil
+	}
+}
+
+// HandleSession serves SFTP on the session until the client disconnects. It
+// can be used as a SubsystemHandler.
+func (srv *SFTPServer) HandleSession(s Session) {
+	exitWithError(s, srv.serve(s))
+}
+
+func (srv *SFTPServer) serve(s Session) error {
+	if srv.Root == nil {
+		return errors.New("sftp: no root file system")
+	}
+	fsys, err := srv.Root(s)
+	if err != nil {
+		return err
+	}
+	c := &sftpConn{
+		srv:     srv,
+		sess:    s,
+		fsys:    fsys,
+		handles: make(map[string]*sftpHandle),
+	}
+	defer c.closeHandles()
+
+	pkt, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(pkt) < 5 || pkt[0] != sftpPacketInit {
+		return errors.New("sftp: expected init packet")
+	}
+	b := appendUint32(newSFTPPacket(sftpPacketVersion), sftpProtocolVersion)
+	for _, ext := range sftpExtensions {
+		b = appendString(appendString(b, ext.name), ext.version)
+	}
+	if err := c.writePacket(b); err != nil {
+		return err
+	}
+	for {
+		pkt, err := c.readPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.writePacket(c.handle(pkt)); err != nil {
+			return err
+		}
+	}
+}
+
+// errBadMessage is returned for malformed requests.
+var errBadMessage = errors.New("sftp: bad message")
+
+type sftpConn struct {
+	srv        *SFTPServer
+	sess       Session
+	fsys       fs.FS
+	handles    map[string]*sftpHandle
+	nextHandle uint64
+}
+
+type sftpHandle struct {
+	path    string
+	file    fs.File // nil for directories
+	flags   uint32
+	entries []fs.DirEntry
+}
+
+func (c *sftpConn) readPacket() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.sess, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > sftpMaxPacket {
+		return nil, fmt.Errorf("sftp: bad packet length %d", n)
+	}
+	pkt := make([]byte, n)
+	if _, err := io.ReadFull(c.sess, pkt); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func (c *sftpConn) writePacket(b []byte) error {
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	_, err := c.sess.Write(b)
+	return err
+}
+
+func (c *sftpConn) closeHandles() {
+	for id, h := range c.handles {
+		if h.file != nil {
+			h.file.Close()
+		}
+		delete(c.handles, id)
+	}
+}
+
+// handle handles a request packet and returns the response.
+func (c *sftpConn) handle(pkt []byte) []byte {
+	r := &sftpReader{b: pkt[1:]}
+	id := r.uint32()
+	if r.short {
+		return c.status(0, sftpStatusBadMessage, nil)
+	}
+	resp, err := c.dispatch(pkt[0], id, r)
+	if err != nil {
+		return c.errorStatus(id, err)
+	}
+	return resp
+}
+
+func (c *sftpConn) dispatch(typ byte, id uint32, r *sftpReader) ([]byte, error) {
+	switch typ {
+	case sftpPacketOpen:
+		name, pflags, attrs := r.path(), r.uint32(), r.attrs()
+		if r.short {
+			return nil, errBadMessage
+		}
+		return c.open(id, name, pflags, attrs)
+	case sftpPacketClose:
+		handle := r.string()
+		if r.short {
+			return nil, errBadMessage
+		}
+		return c.close(id, handle)
+	case sftpPacketRead:
+		handle, off, n := r.string(), r.uint64(), r.uint32()
+		if r.short {
+			return nil, errBadMessage
+		}
+		return c.read(id, handle, off, n)
+	case sftpPacketWrite:
+		handle, off, data := r.string(), r.uint64(), r.string()
+		if r.short {
+			return nil, errBadMessage
+		}
+		return c.write(id, handle, off, []byte(data))
+	case sftpPacketLstat, sftpPacketStat:
+		name := r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if err := c.authorize(FileStat, name, ""); err != nil {
+			return nil, err
+		}
+		var fi fs.FileInfo
+		var err error
+		if lfs, ok := c.fsys.(SymlinkFS); ok && typ == sftpPacketLstat {
+			fi, err = lfs.Lstat(name)
+		} else {
+			fi, err = fs.Stat(c.fsys, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c.attrsPacket(id, fi), nil
+	case sftpPacketFstat:
+		handle := r.string()
+		if r.short {
+			return nil, errBadMessage
+		}
+		h, err := c.lookup(handle)
+		if err != nil {
+			return nil, err
+		}
+		var fi fs.FileInfo
+		if h.file != nil {
+			fi, err = h.file.Stat()
+		} else {
+			fi, err = fs.Stat(c.fsys, h.path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c.attrsPacket(id, fi), nil
+	case sftpPacketSetstat:
+		name, attrs := r.path(), r.attrs()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if err := c.authorize(FileSetstat, name, ""); err != nil {
+			return nil, err
+		}
+		return c.ok(id, c.setstat(name, nil, attrs))
+	case sftpPacketFsetstat:
+		handle, attrs := r.string(), r.attrs()
+		if r.short {
+			return nil, errBadMessage
+		}
+		h, err := c.lookup(handle)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.authorize(FileSetstat, h.path, ""); err != nil {
+			return nil, err
+		}
+		return c.ok(id, c.setstat(h.path, h.file, attrs))
+	case sftpPacketOpendir:
+		name := r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		return c.opendir(id, name)
+	case sftpPacketReaddir:
+		handle := r.string()
+		if r.short {
+			return nil, errBadMessage
+		}
+		return c.readdir(id, handle)
+	case sftpPacketRemove:
+		name := r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if err := c.authorize(FileRemove, name, ""); err != nil {
+			return nil, err
+		}
+		return c.ok(id, c.remove(name, false))
+	case sftpPacketRmdir:
+		name := r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if err := c.authorize(FileRemove, name, ""); err != nil {
+			return nil, err
+		}
+		return c.ok(id, c.remove(name, true))
+	case sftpPacketMkdir:
+		name, attrs := r.path(), r.attrs()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if err := c.authorize(FileMkdir, name, ""); err != nil {
+			return nil, err
+		}
+		wfs, err := writableFS(c.fsys)
+		if err != nil {
+			return nil, err
+		}
+		perm := fs.FileMode(0755)
+		if attrs.flags&sftpAttrPermissions != 0 {
+			perm = fs.FileMode(attrs.perm) & fs.ModePerm
+		}
+		return c.ok(id, wfs.Mkdir(name, perm))
+	case sftpPacketRealpath:
+		name := "/" + r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if name == "/." {
+			name = "/"
+		}
+		return c.namePacket(id, name, nil), nil
+	case sftpPacketRename:
+		oldname, newname := r.path(), r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		return c.ok(id, c.rename(oldname, newname, false))
+	case sftpPacketReadlink:
+		name := r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if err := c.authorize(FileStat, name, ""); err != nil {
+			return nil, err
+		}
+		lfs, ok := c.fsys.(SymlinkFS)
+		if !ok {
+			return nil, errUnsupported
+		}
+		target, err := lfs.ReadLink(name)
+		if err != nil {
+			return nil, err
+		}
+		return c.namePacket(id, target, nil), nil
+	case sftpPacketSymlink:
+		// OpenSSH sends the target first, contrary to the draft
+		target, link := r.string(), r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if err := c.authorize(FileLink, fsPath(path.Join(path.Dir("/"+link), target)), link); err != nil {
+			return nil, err
+		}
+		lfs, ok := c.fsys.(SymlinkFS)
+		if !ok {
+			return nil, errUnsupported
+		}
+		return c.ok(id, lfs.Symlink(target, link))
+	case sftpPacketExtended:
+		name := r.string()
+		if r.short {
+			return nil, errBadMessage
+		}
+		return c.extended(id, name, r)
+	}
+	return nil, errUnsupported
+}
+
+func (c *sftpConn) extended(id uint32, name string, r *sftpReader) ([]byte, error) {
+	switch name {
+	case "posix-rename@openssh.com":
+		oldname, newname := r.path(), r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		return c.ok(id, c.rename(oldname, newname, true))
+	case "statvfs@openssh.com":
+		name := r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if err := c.authorize(FileStat, name, ""); err != nil {
+			return nil, err
+		}
+		return c.statvfs(id, name)
+	case "fstatvfs@openssh.com":
+		handle := r.string()
+		if r.short {
+			return nil, errBadMessage
+		}
+		h, err := c.lookup(handle)
+		if err != nil {
+			return nil, err
+		}
+		return c.statvfs(id, h.path)
+	case "hardlink@openssh.com":
+		oldname, newname := r.path(), r.path()
+		if r.short {
+			return nil, errBadMessage
+		}
+		if err := c.authorize(FileLink, oldname, newname); err != nil {
+			return nil, err
+		}
+		lfs, ok := c.fsys.(LinkFS)
+		if !ok {
+			return nil, errUnsupported
+		}
+		return c.ok(id, lfs.Link(oldname, newname))
+	case "fsync@openssh.com":
+		handle := r.string()
+		if r.short {
+			return nil, errBadMessage
+		}
+		h, err := c.lookup(handle)
+		if err != nil {
+			return nil, err
+		}
+		syncer, ok := h.file.(interface{ Sync() error })
+		if !ok {
+			return nil, errUnsupported
+		}
+		return c.ok(id, syncer.Sync())
+	}
+	return nil, errUnsupported
+}
+
+func (c *sftpConn) open(id uint32, name string, pflags uint32, attrs sftpAttrs) ([]byte, error) {
+	write := pflags&(sftpOpenWrite|sftpOpenAppend|sftpOpenCreate|sftpOpenTrunc) != 0
+	read := pflags&sftpOpenRead != 0 || !write
+	if read {
+		if err := c.authorize(FileRead, name, ""); err != nil {
+			return nil, err
+		}
+	}
+	if write {
+		if err := c.authorize(FileWrite, name, ""); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.handles) >= sftpMaxHandles {
+		return nil, errors.New("too many open handles")
+	}
+	var f fs.File
+	var err error
+	if !write {
+		f, err = c.fsys.Open(name)
+	} else {
+		var wfs WritableFS
+		if wfs, err = writableFS(c.fsys); err != nil {
+			return nil, err
+		}
+		flag := os.O_WRONLY
+		if read {
+			flag = os.O_RDWR
+		}
+		if pflags&sftpOpenAppend != 0 {
+			flag |= os.O_APPEND
+		}
+		if pflags&sftpOpenCreate != 0 {
+			flag |= os.O_CREATE
+		}
+		if pflags&sftpOpenTrunc != 0 {
+			flag |= os.O_TRUNC
+		}
+		if pflags&sftpOpenExcl != 0 {
+			flag |= os.O_EXCL
+		}
+		perm := fs.FileMode(0644)
+		if attrs.flags&sftpAttrPermissions != 0 {
+			perm = fs.FileMode(attrs.perm) & fs.ModePerm
+		}
+		f, err = wfs.OpenFile(name, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.handlePacket(id, &sftpHandle{path: name, file: f, flags: pflags}), nil
+}
+
+func (c *sftpConn) close(id uint32, handle string) ([]byte, error) {
+	h, err := c.lookup(handle)
+	if err != nil {
+		return nil, err
+	}
+	delete(c.handles, handle)
+	if h.file != nil {
+		err = h.file.Close()
+	}
+	return c.ok(id, err)
+}
+
+func (c *sftpConn) read(id uint32, handle string, off uint64, n uint32) ([]byte, error) {
+	h, err := c.lookup(handle)
+	if err != nil {
+		return nil, err
+	}
+	if h.file == nil {
+		return nil, errIsDir
+	}
+	if n > sftpMaxRead {
+		n = sftpMaxRead
+	}
+	if off > 1<<63-1 {
+		return nil, io.EOF
+	}
+	buf := make([]byte, n)
+	var read int
+	switch f := h.file.(type) {
+	case io.ReaderAt:
+		read, err = f.ReadAt(buf, int64(off))
+	case io.ReadSeeker:
+		if _, err = f.Seek(int64(off), io.SeekStart); err == nil {
+			read, err = io.ReadFull(f, buf)
+		}
+	default:
+		return nil, errUnsupported
+	}
+	if read == 0 {
+		if err == nil || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	b := appendUint32(newSFTPPacket(sftpPacketData), id)
+	return appendString(b, string(buf[:read])), nil
+}
+
+func (c *sftpConn) write(id uint32, handle string, off uint64, data []byte) ([]byte, error) {
+	h, err := c.lookup(handle)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := h.file.(File)
+	if !ok || h.flags&(sftpOpenWrite|sftpOpenAppend) == 0 {
+		return nil, fs.ErrPermission
+	}
+	if h.flags&sftpOpenAppend != 0 {
+		_, err = f.Write(data)
+	} else {
+		_, err = f.WriteAt(data, int64(off))
+	}
+	return c.ok(id, err)
+}
+
+func (c *sftpConn) opendir(id uint32, name string) ([]byte, error) {
+	if err := c.authorize(FileList, name, ""); err != nil {
+		return nil, err
+	}
+	if len(c.handles) >= sftpMaxHandles {
+		return nil, errors.New("too many open handles")
+	}
+	entries, err := fs.ReadDir(c.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.handlePacket(id, &sftpHandle{path: name, entries: entries}), nil
+}
+
+func (c *sftpConn) readdir(id uint32, handle string) ([]byte, error) {
+	h, err := c.lookup(handle)
+	if err != nil {
+		return nil, err
+	}
+	if h.file != nil {
+		return nil, errNotDir
+	}
+	if len(h.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := len(h.entries)
+	if n > sftpReaddirBatch {
+		n = sftpReaddirBatch
+	}
+	b := appendUint32(appendUint32(newSFTPPacket(sftpPacketName), id), uint32(n))
+	for _, entry := range h.entries[:n] {
+		fi, err := entry.Info()
+		if err != nil {
+			fi = &memFileInfo{name: entry.Name(), mode: entry.Type()}
+		}
+		b = appendString(b, entry.Name())
+		b = appendString(b, sftpLongName(fi))
+		b = appendSFTPAttrs(b, fi)
+	}
+	h.entries = h.entries[n:]
+	return b, nil
+}
+
+func (c *sftpConn) remove(name string, dir bool) error {
+	wfs, err := writableFS(c.fsys)
+	if err != nil {
+		return err
+	}
+	fi, err := lstatFS(c.fsys, name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() != dir {
+		if dir {
+			return errNotDir
+		}
+		return errIsDir
+	}
+	return wfs.Remove(name)
+}
+
+func (c *sftpConn) rename(oldname, newname string, replace bool) error {
+	if err := c.authorize(FileRename, oldname, newname); err != nil {
+		return err
+	}
+	wfs, err := writableFS(c.fsys)
+	if err != nil {
+		return err
+	}
+	if !replace {
+		// the base protocol doesn't replace existing files
+		if _, err := lstatFS(c.fsys, newname); err == nil {
+			return fs.ErrExist
+		}
+	}
+	return wfs.Rename(oldname, newname)
+}
+
+func (c *sftpConn) setstat(name string, f fs.File, attrs sftpAttrs) error {
+	if attrs.flags&sftpAttrSize != 0 {
+		// changing the size is a write
+		if err := c.authorize(FileWrite, name, ""); err != nil {
+			return err
+		}
+		if err := c.truncate(name, f, int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrUIDGID != 0 {
+		cfs, ok := c.fsys.(ChownFS)
+		if !ok {
+			return errUnsupported
+		}
+		if err := cfs.Chown(name, int(attrs.uid), int(attrs.gid)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		cfs, ok := c.fsys.(ChmodFS)
+		if !ok {
+			return errUnsupported
+		}
+		if err := cfs.Chmod(name, fs.FileMode(attrs.perm)&fs.ModePerm); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		cfs, ok := c.fsys.(ChtimesFS)
+		if !ok {
+			return errUnsupported
+		}
+		atime := time.Unix(int64(attrs.atime), 0)
+		mtime := time.Unix(int64(attrs.mtime), 0)
+		if err := cfs.Chtimes(name, atime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *sftpConn) truncate(name string, f fs.File, size int64) error {
+	if wf, ok := f.(File); ok {
+		return wf.Truncate(size)
+	}
+	wfs, err := writableFS(c.fsys)
+	if err != nil {
+		return err
+	}
+	wf, err := wfs.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer wf.Close()
+	return wf.Truncate(size)
+}
+
+func (c *sftpConn) statvfs(id uint32, name string) ([]byte, error) {
+	sfs, ok := c.fsys.(StatVFSFS)
+	if !ok {
+		return nil, errUnsupported
+	}
+	st, err := sfs.StatVFS(name)
+	if err != nil {
+		return nil, err
+	}
+	b := appendUint32(newSFTPPacket(sftpPacketExtendedReply), id)
+	for _, v := range []uint64{
+		st.BlockSize, st.FragmentSize, st.Blocks, st.BlocksFree,
+		st.BlocksAvailable, st.Files, st.FilesFree, st.FilesAvailable,
+		st.ID, st.Flags, st.MaxNameLength,
+	} {
+		b = appendUint64(b, v)
+	}
+	return b, nil
+}
+
+func (c *sftpConn) lookup(handle string) (*sftpHandle, error) {
+	h, ok := c.handles[handle]
+	if !ok {
+		return nil, errors.New("invalid handle")
+	}
+	return h, nil
+}
+
+func (c *sftpConn) authorize(op FileOp, name, target string) error {
+	return authorizeFile(c.srv.Authorize, c.sess, FileRequest{Op: op, Path: name, Target: target})
+}
+
+func (c *sftpConn) handlePacket(id uint32, h *sftpHandle) []byte {
+	c.nextHandle++
+	handle := strconv.FormatUint(c.nextHandle, 10)
+	c.handles[handle] = h
+	b := appendUint32(newSFTPPacket(sftpPacketHandle), id)
+	return appendString(b, handle)
+}
+
+func (c *sftpConn) attrsPacket(id uint32, fi fs.FileInfo) []byte {
+	return appendSFTPAttrs(appendUint32(newSFTPPacket(sftpPacketAttrs), id), fi)
+}
+
+func (c *sftpConn) namePacket(id uint32, name string, fi fs.FileInfo) []byte {
+	b := appendUint32(appendUint32(newSFTPPacket(sftpPacketName), id), 1)
+	b = appendString(appendString(b, name), name)
+	return appendSFTPAttrs(b, fi)
+}
+
+// ok returns an OK status packet, or an error status if err is set.
+func (c *sftpConn) ok(id uint32, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	return c.status(id, sftpStatusOK, nil), nil
+}
+
+func (c *sftpConn) errorStatus(id uint32, err error) []byte {
+	var code uint32
+	switch {
+	case errors.Is(err, io.EOF):
+		code = sftpStatusEOF
+	case errors.Is(err, fs.ErrNotExist):
+		code = sftpStatusNoSuchFile
+	case errors.Is(err, fs.ErrPermission):
+		code = sftpStatusPermissionDenied
+	case errors.Is(err, errUnsupported):
+		code = sftpStatusOpUnsupported
+	case errors.Is(err, errBadMessage):
+		code = sftpStatusBadMessage
+	default:
+		code = sftpStatusFailure
+	}
+	return c.status(id, code, err)
+}
+
+// status returns a status packet. Only messages from a FileAuthorizer are
+// passed on, since other errors may reveal paths outside of the file system.
+func (c *sftpConn) status(id, code uint32, err error) []byte {
+	msg := sftpStatusMessages[code]
+	var authErr *fileAuthError
+	if errors.As(err, &authErr) {
+		msg = authErr.Error()
+	}
+	b := appendUint32(appendUint32(newSFTPPacket(sftpPacketStatus), id), code)
+	return appendString(appendString(b, msg), "")
+}
+
+type sftpAttrs struct {
+	flags        uint32
+	size         uint64
+	uid, gid     uint32
+	perm         uint32
+	atime, mtime uint32
+}
+
+// Unix file type and mode bits used in SFTP permissions
+const (
+	sftpModeFIFO   = 0010000
+	sftpModeChar   = 0020000
+	sftpModeDir    = 0040000
+	sftpModeBlock  = 0060000
+	sftpModeFile   = 0100000
+	sftpModeLink   = 0120000
+	sftpModeSocket = 0140000
+	sftpModeSetuid = 0004000
+	sftpModeSetgid = 0002000
+	sftpModeSticky = 0001000
+)
+
+func sftpMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		m |= sftpModeDir
+	case mode&fs.ModeSymlink != 0:
+		m |= sftpModeLink
+	case mode&fs.ModeNamedPipe != 0:
+		m |= sftpModeFIFO
+	case mode&fs.ModeSocket != 0:
+		m |= sftpModeSocket
+	case mode&fs.ModeCharDevice != 0:
+		m |= sftpModeChar
+	case mode&fs.ModeDevice != 0:
+		m |= sftpModeBlock
+	default:
+		m |= sftpModeFile
+	}
+	if mode&fs.ModeSetuid != 0 {
+		m |= sftpModeSetuid
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= sftpModeSetgid
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= sftpModeSticky
+	}
+	return m
+}
+
+func appendSFTPAttrs(b []byte, fi fs.FileInfo) []byte {
+	if fi == nil {
+		return appendUint32(b, 0)
+	}
+	b = appendUint32(b, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime)
+	b = appendUint64(b, uint64(fi.Size()))
+	b = appendUint32(b, sftpMode(fi.Mode()))
+	mtime := uint32(fi.ModTime().Unix())
+	return appendUint32(appendUint32(b, mtime), mtime)
+}
+
+// sftpLongName formats a directory entry like "ls -l", which clients show
+// as is.
+func sftpLongName(fi fs.FileInfo) string {
+	m := sftpMode(fi.Mode())
+	var typ byte
+	switch m &^ 07777 {
+	case sftpModeDir:
+		typ = 'd'
+	case sftpModeLink:
+		typ = 'l'
+	case sftpModeFIFO:
+		typ = 'p'
+	case sftpModeSocket:
+		typ = 's'
+	case sftpModeChar:
+		typ = 'c'
+	case sftpModeBlock:
+		typ = 'b'
+	default:
+		typ = '-'
+	}
+	perm := []byte{typ}
+	for i, c := range "rwxrwxrwx" {
+		if m&(1<<uint(8-i)) != 0 {
+			perm = append(perm, byte(c))
+		} else {
+			perm = append(perm, '-')
+		}
+	}
+	layout := "Jan _2 15:04"
+	if mod := fi.ModTime(); time.Since(mod) > 180*24*time.Hour || mod.After(time.Now()) {
+		layout = "Jan _2  2006"
+	}
+	return fmt.Sprintf("%s    1 %-8d %-8d %8d %s %s",
+		perm, 0, 0, fi.Size(), fi.ModTime().Format(layout), fi.Name())
+}
+
+func newSFTPPacket(typ byte) []byte {
+	return []byte{0, 0, 0, 0, typ}
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUint32(b, uint32(len(s))), s...)
+}
+
+// sftpReader decodes the fields of a packet. Once a field can't be read,
+// short is set and all further fields are zero.
+type sftpReader struct {
+	b     []byte
+	short bool
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.short = true
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.short = true
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	n := r.uint32()
+	if uint32(len(r.b)) < n {
+		r.short = true
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// path reads a path and converts it to a path in the file system.
+func (r *sftpReader) path() string {
+	return fsPath(r.string())
+}
+
+func (r *sftpReader) attrs() sftpAttrs {
+	var a sftpAttrs
+	a.flags = r.uint32()
+	if a.flags&sftpAttrSize != 0 {
+		a.size = r.uint64()
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		a.uid, a.gid = r.uint32(), r.uint32()
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		a.perm = r.uint32()
+	}
+	if a.flags&sftpAttrACModTime != 0 {
+		a.atime, a.mtime = r.uint32(), r.uint32()
+	}
+	if a.flags&sftpAttrExtended != 0 {
+		for n := r.uint32(); n > 0 && !r.short; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return a
+}
@@ -0,0 +1,421 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sftpTestClient is a minimal SFTP client for testing the server.
+type sftpTestClient struct {
+	t          *testing.T
+	ch         gossh.Channel
+	id         uint32
+	extensions map[string]string
+}
+
+func newSFTPTestClient(t *testing.T, sftp *SFTPServer) (*sftpTestClient, func()) {
+	_, client, cleanup := newTestSession(t, &Server{
+		Handler:           func(s Session) {},
+		SubsystemHandlers: map[string]SubsystemHandler{"sftp": sftp.HandleSession},
+	}, nil)
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gossh.DiscardRequests(reqs)
+	ok, err := ch.SendRequest("subsystem", true, gossh.Marshal(struct{ Name string }{"sftp"}))
+	if err != nil || !ok {
+		t.Fatalf("subsystem request failed: %v %v", ok, err)
+	}
+	c := &sftpTestClient{t: t, ch: ch, extensions: make(map[string]string)}
+	c.send(appendUint32(newSFTPPacket(sftpPacketInit), sftpProtocolVersion))
+	typ, r := c.recv()
+	if typ != sftpPacketVersion || r.uint32() != sftpProtocolVersion {
+		t.Fatalf("unexpected version reply %d", typ)
+	}
+	for len(r.b) > 0 {
+		name := r.string()
+		c.extensions[name] = r.string()
+	}
+	return c, func() {
+		ch.Close()
+		cleanup()
+	}
+}
+
+func (c *sftpTestClient) send(b []byte) {
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	if _, err := c.ch.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *sftpTestClient) recv() (byte, *sftpReader) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.ch, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	pkt := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(c.ch, pkt); err != nil {
+		c.t.Fatal(err)
+	}
+	return pkt[0], &sftpReader{b: pkt[1:]}
+}
+
+// request sends a request with the given fields, which may be strings,
+// uint32s, uint64s or raw bytes, and returns the response.
+func (c *sftpTestClient) request(typ byte, fields ...interface{}) (byte, *sftpReader) {
+	c.id++
+	b := appendUint32(newSFTPPacket(typ), c.id)
+	for _, f := range fields {
+		switch f := f.(type) {
+		case string:
+			b = appendString(b, f)
+		case uint32:
+			b = appendUint32(b, f)
+		case uint64:
+			b = appendUint64(b, f)
+		case []byte:
+			b = append(b, f...)
+		default:
+			c.t.Fatalf("unsupported field %T", f)
+		}
+	}
+	c.send(b)
+	respType, r := c.recv()
+	if id := r.uint32(); id != c.id {
+		c.t.Fatalf("response id = %d; want %d", id, c.id)
+	}
+	return respType, r
+}
+
+// status sends a request and returns the status code of the response.
+func (c *sftpTestClient) status(typ byte, fields ...interface{}) (uint32, string) {
+	respType, r := c.request(typ, fields...)
+	if respType != sftpPacketStatus {
+		c.t.Fatalf("response type = %d; want status", respType)
+	}
+	return r.uint32(), r.string()
+}
+
+func (c *sftpTestClient) expectStatus(want uint32, typ byte, fields ...interface{}) {
+	c.t.Helper()
+	if code, msg := c.status(typ, fields...); code != want {
+		c.t.Fatalf("status = %d (%s); want %d", code, msg, want)
+	}
+}
+
+func (c *sftpTestClient) open(name string, pflags uint32) string {
+	c.t.Helper()
+	typ, r := c.request(sftpPacketOpen, name, pflags, uint32(0))
+	if typ != sftpPacketHandle {
+		c.t.Fatalf("open %s: response type = %d (status %d)", name, typ, r.uint32())
+	}
+	return r.string()
+}
+
+func (c *sftpTestClient) readFile(name string) string {
+	c.t.Helper()
+	h := c.open(name, sftpOpenRead)
+	defer c.expectStatus(sftpStatusOK, sftpPacketClose, h)
+	var data []byte
+	for {
+		typ, r := c.request(sftpPacketRead, h, uint64(len(data)), uint32(4))
+		if typ == sftpPacketStatus {
+			if code := r.uint32(); code != sftpStatusEOF {
+				c.t.Fatalf("read status = %d", code)
+			}
+			return string(data)
+		}
+		data = append(data, r.string()...)
+	}
+}
+
+func (c *sftpTestClient) writeFile(name, data string) {
+	c.t.Helper()
+	h := c.open(name, sftpOpenWrite|sftpOpenCreate|sftpOpenTrunc)
+	c.expectStatus(sftpStatusOK, sftpPacketWrite, h, uint64(0), data)
+	c.expectStatus(sftpStatusOK, sftpPacketClose, h)
+}
+
+func (c *sftpTestClient) list(name string) []string {
+	c.t.Helper()
+	typ, r := c.request(sftpPacketOpendir, name)
+	if typ != sftpPacketHandle {
+		c.t.Fatalf("opendir %s: response type = %d", name, typ)
+	}
+	h := r.string()
+	defer c.expectStatus(sftpStatusOK, sftpPacketClose, h)
+	var names []string
+	for {
+		typ, r := c.request(sftpPacketReaddir, h)
+		if typ == sftpPacketStatus {
+			return names
+		}
+		for n := r.uint32(); n > 0; n-- {
+			names = append(names, r.string())
+			r.string()
+			r.attrs()
+		}
+	}
+}
+
+func TestSFTPMemFS(t *testing.T) {
+	t.Parallel()
+	fsys := NewMemFS()
+	c, cleanup := newSFTPTestClient(t, &SFTPServer{
+		Root: func(s Session) (fs.FS, error) { return fsys, nil },
+	})
+	defer cleanup()
+
+	for _, ext := range []string{"posix-rename@openssh.com", "statvfs@openssh.com", "hardlink@openssh.com", "fsync@openssh.com"} {
+		if _, ok := c.extensions[ext]; !ok {
+			t.Fatalf("extension %s not announced", ext)
+		}
+	}
+
+	c.expectStatus(sftpStatusOK, sftpPacketMkdir, "/dir", uint32(0))
+	c.writeFile("dir/hello.txt", "hello world")
+	if got := c.readFile("/dir/hello.txt"); got != "hello world" {
+		t.Fatalf("read %q; want %q", got, "hello world")
+	}
+
+	// write at an offset, and sync
+	h := c.open("dir/hello.txt", sftpOpenWrite)
+	c.expectStatus(sftpStatusOK, sftpPacketWrite, h, uint64(6), "gophers")
+	c.expectStatus(sftpStatusOK, sftpPacketExtended, "fsync@openssh.com", h)
+	c.expectStatus(sftpStatusOK, sftpPacketClose, h)
+	if got := c.readFile("dir/hello.txt"); got != "hello gophers" {
+		t.Fatalf("read %q; want %q", got, "hello gophers")
+	}
+
+	typ, r := c.request(sftpPacketStat, "dir/hello.txt")
+	if typ != sftpPacketAttrs {
+		t.Fatalf("stat response type = %d", typ)
+	}
+	if attrs := r.attrs(); attrs.size != 13 || attrs.perm&sftpModeFile == 0 {
+		t.Fatalf("unexpected attrs %+v", attrs)
+	}
+
+	// renames don't replace files, unless using posix-rename
+	c.writeFile("dir/other.txt", "other")
+	c.expectStatus(sftpStatusFailure, sftpPacketRename, "dir/other.txt", "dir/hello.txt")
+	c.expectStatus(sftpStatusOK, sftpPacketExtended, "posix-rename@openssh.com", "dir/other.txt", "dir/hello.txt")
+	c.expectStatus(sftpStatusOK, sftpPacketExtended, "hardlink@openssh.com", "dir/hello.txt", "dir/link.txt")
+	if got := strings.Join(c.list("dir"), ","); got != "hello.txt,link.txt" {
+		t.Fatalf("list = %s", got)
+	}
+
+	c.expectStatus(sftpStatusFailure, sftpPacketRmdir, "dir")
+	c.expectStatus(sftpStatusFailure, sftpPacketRemove, "dir")
+	c.expectStatus(sftpStatusOK, sftpPacketRemove, "dir/hello.txt")
+	c.expectStatus(sftpStatusOK, sftpPacketRemove, "dir/link.txt")
+	c.expectStatus(sftpStatusOK, sftpPacketRmdir, "dir")
+	c.expectStatus(sftpStatusNoSuchFile, sftpPacketStat, "dir")
+
+	// setstat changes the size and mode
+	c.writeFile("file", "0123456789")
+	attrs := appendUint32(appendUint64(appendUint32(nil, sftpAttrSize|sftpAttrPermissions), 4), 0600)
+	c.expectStatus(sftpStatusOK, sftpPacketSetstat, "file", attrs)
+	fi, err := fsys.Stat("file")
+	if err != nil || fi.Size() != 4 || fi.Mode() != 0600 {
+		t.Fatalf("unexpected file info %v %v", fi, err)
+	}
+
+	c.expectStatus(sftpStatusOpUnsupported, sftpPacketExtended, "statvfs@openssh.com", "/")
+	c.expectStatus(sftpStatusOpUnsupported, sftpPacketReadlink, "file")
+	c.expectStatus(sftpStatusFailure, sftpPacketClose, "bogus")
+}
+
+func TestSFTPRealpath(t *testing.T) {
+	t.Parallel()
+	c, cleanup := newSFTPTestClient(t, &SFTPServer{
+		Root: func(s Session) (fs.FS, error) { return NewMemFS(), nil },
+	})
+	defer cleanup()
+	for in, want := range map[string]string{
+		".":           "/",
+		"":            "/",
+		"a/../b":      "/b",
+		"../../../..": "/",
+		"/x/./y/":     "/x/y",
+	} {
+		typ, r := c.request(sftpPacketRealpath, in)
+		if typ != sftpPacketName || r.uint32() != 1 {
+			t.Fatalf("realpath %q: unexpected response %d", in, typ)
+		}
+		if got := r.string(); got != want {
+			t.Fatalf("realpath %q = %q; want %q", in, got, want)
+		}
+	}
+}
+
+func TestSFTPReadOnly(t *testing.T) {
+	t.Parallel()
+	c, cleanup := newSFTPTestClient(t, &SFTPServer{
+		Root: func(s Session) (fs.FS, error) {
+			return fstest.MapFS{"docs/readme": {Data: []byte("read me")}}, nil
+		},
+	})
+	defer cleanup()
+	if got := c.readFile("docs/readme"); got != "read me" {
+		t.Fatalf("read %q; want %q", got, "read me")
+	}
+	if got := strings.Join(c.list("/docs"), ","); got != "readme" {
+		t.Fatalf("list = %s", got)
+	}
+	c.expectStatus(sftpStatusPermissionDenied, sftpPacketOpen, "docs/new", uint32(sftpOpenWrite|sftpOpenCreate), uint32(0))
+	c.expectStatus(sftpStatusPermissionDenied, sftpPacketRemove, "docs/readme")
+	c.expectStatus(sftpStatusNoSuchFile, sftpPacketOpen, "missing", uint32(sftpOpenRead), uint32(0))
+}
+
+func TestSFTPAuthorize(t *testing.T) {
+	t.Parallel()
+	var ops []string
+	c, cleanup := newSFTPTestClient(t, &SFTPServer{
+		Root: func(s Session) (fs.FS, error) { return NewMemFS(), nil },
+		Authorize: func(s Session, req FileRequest) error {
+			ops = append(ops, req.Op.String()+" "+req.Path)
+			if req.Op == FileWrite && strings.HasPrefix(req.Path, "secret") {
+				return errors.New("secrets are read-only")
+			}
+			return nil
+		},
+	})
+	defer cleanup()
+	c.writeFile("public", "ok")
+	code, msg := c.status(sftpPacketOpen, "/secret", uint32(sftpOpenWrite|sftpOpenCreate), uint32(0))
+	if code != sftpStatusPermissionDenied || msg != "secrets are read-only" {
+		t.Fatalf("status = %d %q", code, msg)
+	}
+	if got := strings.Join(ops, ","); got != "write public,write secret" {
+		t.Fatalf("authorized ops = %s", got)
+	}
+}
+
+func TestSFTPAuthorizeSetstatSize(t *testing.T) {
+	t.Parallel()
+	fsys := NewMemFS()
+	f, err := fsys.OpenFile("file", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "0123456789")
+	f.Close()
+	c, cleanup := newSFTPTestClient(t, &SFTPServer{
+		Root: func(s Session) (fs.FS, error) { return fsys, nil },
+		Authorize: func(s Session, req FileRequest) error {
+			if req.Op == FileWrite {
+				return errors.New("read-only")
+			}
+			return nil
+		},
+	})
+	defer cleanup()
+	// changing the size is a write, even if changing attributes is allowed
+	attrs := appendUint64(appendUint32(nil, sftpAttrSize), 4)
+	c.expectStatus(sftpStatusPermissionDenied, sftpPacketSetstat, "file", attrs)
+	h := c.open("file", sftpOpenRead)
+	c.expectStatus(sftpStatusPermissionDenied, sftpPacketFsetstat, h, attrs)
+	c.expectStatus(sftpStatusOK, sftpPacketClose, h)
+	if fi, err := fsys.Stat("file"); err != nil || fi.Size() != 10 {
+		t.Fatalf("unexpected file info %v %v", fi, err)
+	}
+}
+
+func TestSFTPBadMessage(t *testing.T) {
+	t.Parallel()
+	c, cleanup := newSFTPTestClient(t, &SFTPServer{
+		Root: func(s Session) (fs.FS, error) { return NewMemFS(), nil },
+	})
+	defer cleanup()
+	// an open request missing its flags and attributes
+	c.expectStatus(sftpStatusBadMessage, sftpPacketOpen, "file")
+	c.expectStatus(sftpStatusOpUnsupported, 99)
+	c.expectStatus(sftpStatusOpUnsupported, sftpPacketExtended, "unknown@example.com")
+}
+
+func TestSFTPOSFS(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, cleanup := newSFTPTestClient(t, &SFTPServer{
+		Root: func(s Session) (fs.FS, error) { return OSFS(dir), nil },
+	})
+	defer cleanup()
+	if got := c.readFile("../../file"); got != "data" {
+		t.Fatalf("read %q; want %q", got, "data")
+	}
+	c.writeFile("new", "new data")
+	data, err := os.ReadFile(filepath.Join(dir, "new"))
+	if err != nil || string(data) != "new data" {
+		t.Fatalf("unexpected file contents %q %v", data, err)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// symlinks may not leave the root
+	c.expectStatus(sftpStatusPermissionDenied, sftpPacketSymlink, "../../etc/passwd", "escape")
+	// even if they stay inside where they are created, as renaming them
+	// would move their targets
+	c.expectStatus(sftpStatusOK, sftpPacketMkdir, "a", uint32(0))
+	c.expectStatus(sftpStatusPermissionDenied, sftpPacketSymlink, "..", "a/l")
+	c.expectStatus(sftpStatusPermissionDenied, sftpPacketSymlink, "a/../..", "a/l")
+	c.expectStatus(sftpStatusNoSuchFile, sftpPacketRename, "a/l", "l")
+	if _, err := os.Lstat(filepath.Join(dir, "l")); !os.IsNotExist(err) {
+		t.Fatalf("escaping link was created: %v", err)
+	}
+	c.expectStatus(sftpStatusOK, sftpPacketSymlink, "file", "link")
+	typ, r := c.request(sftpPacketReadlink, "link")
+	if typ != sftpPacketName || r.uint32() != 1 || r.string() != "file" {
+		t.Fatalf("unexpected readlink response %d", typ)
+	}
+	typ, r = c.request(sftpPacketLstat, "link")
+	if typ != sftpPacketAttrs || r.attrs().perm&^07777 != sftpModeLink {
+		t.Fatalf("lstat did not report a link")
+	}
+	if runtime.GOOS == "linux" {
+		typ, r := c.request(sftpPacketExtended, "statvfs@openssh.com", "/")
+		if typ != sftpPacketExtendedReply || r.uint64() == 0 {
+			t.Fatalf("unexpected statvfs response %d", typ)
+		}
+	}
+}
+
+func TestSFTPNoRoot(t *testing.T) {
+	t.Parallel()
+	_, client, cleanup := newTestSession(t, &Server{
+		Handler:           func(s Session) {},
+		SubsystemHandlers: map[string]SubsystemHandler{"sftp": (&SFTPServer{}).HandleSession},
+	}, nil)
+	defer cleanup()
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	go gossh.DiscardRequests(reqs)
+	ok, err := ch.SendRequest("subsystem", true, gossh.Marshal(struct{ Name string }{"sftp"}))
+	if err != nil || !ok {
+		t.Fatalf("subsystem request failed: %v %v", ok, err)
+	}
+	stderr, err := io.ReadAll(ch.Stderr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(stderr), "no root file system") {
+		t.Fatalf("unexpected stderr %q", stderr)
+	}
+}
@@ -3,6 +3,7 @@ package ssh
 import (
 	"crypto/subtle"
 	"net"
+	"time"
 
 	gossh "golang.org/x/crypto/ssh"
 )
@@ -53,6 +54,22 @@ type PtyCallback func(ctx Context, pty Pty) bool
 // SessionRequestCallback is a callback for allowing or denying SSH sessions.
 type SessionRequestCallback func(sess Session, requestType string) bool
 
+// EnvCallback is a hook for allowing or denying environment variables set by
+// the client for a session.
+type EnvCallback func(sess Session, key, value string) bool
+
+// X11Callback is a hook for allowing X11 forwarding requests.
+type X11Callback func(ctx Context, x11 X11) bool
+
+// SessionTimeoutCallback is a hook for setting the timeouts of a session,
+// such as per user. It is called when the session's handler starts.
+type SessionTimeoutCallback func(sess Session) SessionTimeouts
+
+// ClientAliveCallback is a hook for setting the keepalive interval and the
+// number of unanswered intervals allowed for a connection, such as per user.
+// It is called once authentication succeeded.
+type ClientAliveCallback func(ctx Context) (interval time.Duration, countMax int)
+
 // ConnCallback is a hook for new connections before handling.
 // It allows wrapping for timeouts and limiting by returning
 // the net.Conn that will be used as the underlying connection.
@@ -61,27 +78,49 @@ type ConnCallback func(ctx Context, conn net.Conn) net.Conn
 // LocalPortForwardingCallback is a hook for allowing port forwarding
 type LocalPortForwardingCallback func(ctx Context, destinationHost string, destinationPort uint32) bool
 
+// LocalUnixForwardingCallback is a hook for allowing forwarding to Unix
+// domain sockets on the server.
+type LocalUnixForwardingCallback func(ctx Context, socketPath string) bool
+
 // ReversePortForwardingCallback is a hook for allowing reverse port forwarding
 type ReversePortForwardingCallback func(ctx Context, bindHost string, bindPort uint32) bool
 
+// ReverseUnixForwardingCallback is a hook for allowing reverse forwarding
+// from Unix domain sockets on the server. The policy sets the ownership and
+// permissions of the socket.
+type ReverseUnixForwardingCallback func(ctx Context, socketPath string) (ok bool, policy UnixSocketPolicy)
+
 // ServerConfigCallback is a hook for creating custom default server configs
 type ServerConfigCallback func(ctx Context) *gossh.ServerConfig
 
-// ConnectionFailedCallback is a hook for reporting failed connections
+// ConnectionFailedCallback is a hook for reporting failed connections: the
+// handshake failing, or an established connection being closed because the
+// client stopped replying to keepalives, with ErrClientAliveTimeout.
 // Please note: the net.Conn is likely to be closed at this point
 type ConnectionFailedCallback func(conn net.Conn, err error)
 
+// ConnectionClosedCallback is a hook for reporting closed connections, once
+// all of their channels have been handled or a few seconds have passed since
+// the connection closed. Use ConnectionStats on the Context to get the
+// connection's final statistics.
+type ConnectionClosedCallback func(ctx Context)
+
+// PanicCallback is a hook for reporting panics recovered from handlers.
+// The offending channel or connection has already been terminated when it is
+// called.
+type PanicCallback func(ctx Context, p *HandlerPanic)
+
 // Window represents the size of a PTY window.
 type Window struct {
 	Width  int
 	Height int
 }
 
-// Pty represents a PTY request and configuration.
+// Pty represents a PTY request and configuration. The requested terminal
+// modes are returned by Session.TerminalModes.
 type Pty struct {
 	Term   string
 	Window Window
-	// HELP WANTED: terminal modes!
 }
 
 // Serve accepts incoming SSH connections on the listener l, creating a new
@@ -0,0 +1,160 @@
+package ssh
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// contextKeyStats is an internal context key for the traffic counters of a
+// connection or session.
+var contextKeyStats = &contextKey{"stats"}
+
+// SessionStats holds traffic statistics for a session channel.
+type SessionStats struct {
+	// BytesIn is the number of bytes read from the client's input.
+	BytesIn uint64
+
+	// BytesOut is the number of bytes written to the client's output.
+	BytesOut uint64
+
+	// BytesStderr is the number of bytes written to the client's stderr.
+	BytesStderr uint64
+
+	// Requests is the number of session requests received, by type.
+	Requests map[string]uint64
+
+	// Start is when the session channel was opened.
+	Start time.Time
+
+	// LastActivity is when data was last sent or received.
+	LastActivity time.Time
+
+	// End is when the session channel closed, or zero if it is still open.
+	End time.Time
+}
+
+// Duration returns how long the session lasted, or has lasted so far if it
+// is still open.
+func (s SessionStats) Duration() time.Duration {
+	if s.End.IsZero() {
+		return time.Since(s.Start)
+	}
+	return s.End.Sub(s.Start)
+}
+
+// ConnStats holds traffic statistics for a connection, aggregated over all of
+// its sessions.
+type ConnStats struct {
+	// BytesIn, BytesOut and BytesStderr are the totals of the connection's
+	// sessions.
+	BytesIn     uint64
+	BytesOut    uint64
+	BytesStderr uint64
+
+	// Sessions is the number of session channels opened.
+	Sessions uint64
+
+	// Requests is the number of global and session requests received, by
+	// type.
+	Requests map[string]uint64
+
+	// Start is when the connection was accepted.
+	Start time.Time
+
+	// End is when the connection closed, or zero if it is still open.
+	End time.Time
+}
+
+// Duration returns how long the connection lasted, or has lasted so far if
+// it is still open.
+func (s ConnStats) Duration() time.Duration {
+	if s.End.IsZero() {
+		return time.Since(s.Start)
+	}
+	return s.End.Sub(s.Start)
+}
+
+// ConnectionStats returns the statistics of the connection a Context belongs
+// to, which may be a connection or session Context. It is safe to call while
+// the connection is in use, and in a ConnectionClosedCallback to get the final
+// totals.
+func ConnectionStats(ctx Context) ConnStats {
+	t, ok := ConnContext(ctx).Value(contextKeyStats).(*traffic)
+	if !ok {
+		return ConnStats{}
+	}
+	return ConnStats{
+		BytesIn:     t.in.Load(),
+		BytesOut:    t.out.Load(),
+		BytesStderr: t.stderr.Load(),
+		Sessions:    t.sessions.Load(),
+		Requests:    t.requestCounts(),
+		Start:       t.start,
+		End:         t.endTime(),
+	}
+}
+
+// traffic counts the data and requests of a connection or session.
+type traffic struct {
+	in, out, stderr atomic.Uint64
+	sessions        atomic.Uint64
+	end             atomic.Int64 // unix nanoseconds, zero while open
+	start           time.Time
+
+	mu       sync.Mutex
+	requests map[string]uint64
+}
+
+func newTraffic() *traffic {
+	return &traffic{start: time.Now(), requests: make(map[string]uint64)}
+}
+
+// contextTraffic returns the counters stored on a Context, or nil.
+func contextTraffic(ctx Context) *traffic {
+	t, _ := ctx.Value(contextKeyStats).(*traffic)
+	return t
+}
+
+func (t *traffic) countRequest(typ string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests[typ]++
+}
+
+func (t *traffic) requestCounts() map[string]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]uint64, len(t.requests))
+	for typ, n := range t.requests {
+		counts[typ] = n
+	}
+	return counts
+}
+
+func (t *traffic) close() {
+	t.end.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+func (t *traffic) endTime() time.Time {
+	if end := t.end.Load(); end != 0 {
+		return time.Unix(0, end)
+	}
+	return time.Time{}
+}
+
+func (sess *session) Stats() SessionStats {
+	t := sess.traffic
+	return SessionStats{
+		BytesIn:      t.in.Load(),
+		BytesOut:     t.out.Load(),
+		BytesStderr:  t.stderr.Load(),
+		Requests:     t.requestCounts(),
+		Start:        t.start,
+		LastActivity: sess.activity.lastActivity(),
+		End:          t.endTime(),
+	}
+}
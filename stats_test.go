@@ -0,0 +1,122 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionStats(t *testing.T) {
+	t.Parallel()
+	stats := make(chan SessionStats, 1)
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			io.Copy(s, s)
+			io.WriteString(s.Stderr(), "err")
+			stats <- s.Stats()
+		},
+	}, nil)
+	defer cleanup()
+	session.Stdin = strings.NewReader("hello")
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	if err := session.Setenv("LANG", "C"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run("echo"); err != nil {
+		t.Fatal(err)
+	}
+	s := <-stats
+	if s.BytesIn != 5 || s.BytesOut != 5 || s.BytesStderr != 3 {
+		t.Fatalf("bytes = %d/%d/%d; want 5/5/3", s.BytesIn, s.BytesOut, s.BytesStderr)
+	}
+	if s.Requests["env"] != 1 || s.Requests["exec"] != 1 {
+		t.Fatalf("unexpected request counts %v", s.Requests)
+	}
+	if s.Start.IsZero() || s.LastActivity.Before(s.Start) || !s.End.IsZero() {
+		t.Fatalf("unexpected timestamps %v %v %v", s.Start, s.LastActivity, s.End)
+	}
+}
+
+func TestConnectionClosedCallback(t *testing.T) {
+	t.Parallel()
+	closed := make(chan ConnStats, 1)
+	session, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			io.WriteString(s, "hi")
+		},
+		ConnectionClosedCallback: func(ctx Context) {
+			closed <- ConnectionStats(ctx)
+		},
+	}, nil)
+	defer cleanup()
+	if err := session.Run(""); err != nil {
+		t.Fatal(err)
+	}
+	session2, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session2.Run(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.SendRequest("unknown@example.com", true, nil); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case s := <-closed:
+		if s.Sessions != 2 || s.BytesOut != 4 {
+			t.Fatalf("sessions = %d, bytes out = %d; want 2, 4", s.Sessions, s.BytesOut)
+		}
+		if s.Requests["exec"] != 2 || s.Requests["unknown@example.com"] != 1 {
+			t.Fatalf("unexpected request counts %v", s.Requests)
+		}
+		if s.End.IsZero() || s.Duration() <= 0 {
+			t.Fatalf("unexpected timestamps %v %v", s.Start, s.End)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for connection closed callback")
+	}
+}
+
+// not parallel, as it changes channelDrainTimeout
+func TestConnectionClosedCallbackStuckHandler(t *testing.T) {
+	defer func(d time.Duration) { channelDrainTimeout = d }(channelDrainTimeout)
+	channelDrainTimeout = 100 * time.Millisecond
+	closed := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	session, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			// ignores the closed connection
+			<-release
+		},
+		ConnectionClosedCallback: func(ctx Context) {
+			close(closed)
+		},
+	}, nil)
+	defer cleanup()
+	if err := session.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection closed callback blocked by handler")
+	}
+}
+
+func TestConnectionStatsContext(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := newContext(nil)
+	defer cancel()
+	contextTraffic(ctx).countRequest("x")
+	if s := ConnectionStats(ctx); s.Requests["x"] != 1 || s.Start.IsZero() {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
@@ -0,0 +1,29 @@
+package ssh
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func (dir osFS) StatVFS(name string) (*StatVFS, error) {
+	full, err := dir.join("statvfs", name)
+	if err != nil {
+		return nil, err
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(full, &st); err != nil {
+		return nil, &fs.PathError{Op: "statvfs", Path: name, Err: err}
+	}
+	return &StatVFS{
+		BlockSize:       uint64(st.Bsize),
+		FragmentSize:    uint64(st.Frsize),
+		Blocks:          uint64(st.Blocks),
+		BlocksFree:      uint64(st.Bfree),
+		BlocksAvailable: uint64(st.Bavail),
+		Files:           uint64(st.Files),
+		FilesFree:       uint64(st.Ffree),
+		FilesAvailable:  uint64(st.Ffree),
+		Flags:           uint64(st.Flags),
+		MaxNameLength:   uint64(st.Namelen),
+	}, nil
+}
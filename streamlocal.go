@@ -0,0 +1,265 @@
+package ssh
+
+import (
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	directStreamLocalChannelType    = "direct-streamlocal@openssh.com"
+	forwardedStreamLocalChannelType = "forwarded-streamlocal@openssh.com"
+)
+
+// direct-streamlocal@openssh.com data struct as specified in OpenSSH's
+// PROTOCOL, section 2.4
+type localUnixForwardChannelData struct {
+	SocketPath string
+
+	Reserved0 string
+	Reserved1 uint32
+}
+
+// DirectStreamLocalHandler forwards connections to Unix domain sockets on the
+// server, as requested by "ssh -L local:/path/to/socket". It can be enabled by
+// adding it to the server's ChannelHandlers under
+// direct-streamlocal@openssh.com, and is subject to the server's
+// LocalUnixForwardingCallback.
+func DirectStreamLocalHandler(srv *Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx Context) {
+	d := localUnixForwardChannelData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	if srv.LocalUnixForwardingCallback == nil || !srv.LocalUnixForwardingCallback(ctx, d.SocketPath) {
+		newChan.Reject(gossh.Prohibited, "unix socket forwarding is disabled")
+		return
+	}
+
+	var dialer net.Dialer
+	dconn, err := dialer.DialContext(ctx, "unix", d.SocketPath)
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	proxyChannel(ch, dconn)
+}
+
+// AllowUnixSockets returns a LocalUnixForwardingCallback that allows
+// forwarding to the sockets whose paths match one of the path.Match patterns,
+// like "/run/app/*.sock". Only absolute, clean paths are allowed.
+func AllowUnixSockets(patterns ...string) LocalUnixForwardingCallback {
+	return func(ctx Context, socketPath string) bool {
+		if !path.IsAbs(socketPath) || path.Clean(socketPath) != socketPath {
+			return false
+		}
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, socketPath); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// UnixSocketPolicy controls the socket files created for reverse Unix socket
+// forwarding. As zero UID and GID leave the owner unchanged, they can't give
+// sockets to root, but sockets belong to the server's user to begin with.
+type UnixSocketPolicy struct {
+	Mode   os.FileMode // permissions of the socket file, 0600 if zero
+	UID    int         // owner of the socket file, unchanged if zero
+	GID    int         // group of the socket file, unchanged if zero
+	Unlink bool        // remove a stale socket at the path before listening
+}
+
+// streamlocal-forward@openssh.com and cancel-streamlocal-forward@openssh.com
+// data struct as specified in OpenSSH's PROTOCOL, section 2.4
+type remoteUnixForwardRequest struct {
+	SocketPath string
+}
+
+// forwarded-streamlocal@openssh.com data struct as specified in OpenSSH's
+// PROTOCOL, section 2.4
+type remoteUnixForwardChannelData struct {
+	SocketPath string
+	Reserved   string
+}
+
+// ForwardedUnixHandler listens on Unix domain sockets on the server for
+// "ssh -R /path/to/socket:...". It can be enabled by creating a
+// ForwardedUnixHandler and adding the HandleSSHRequest callback to the
+// server's RequestHandlers under streamlocal-forward@openssh.com and
+// cancel-streamlocal-forward@openssh.com. Forwarding is subject to the
+// server's ReverseUnixForwardingCallback, and the socket files are removed
+// when the forwarding is canceled or the connection closes.
+type ForwardedUnixHandler struct {
+	forwards map[string]*unixForward
+	sync.Mutex
+}
+
+// unixForward is a socket listened on for a connection.
+type unixForward struct {
+	ln   net.Listener
+	conn *gossh.ServerConn
+}
+
+func (h *ForwardedUnixHandler) HandleSSHRequest(ctx Context, srv *Server, req *gossh.Request) (bool, []byte) {
+	conn := ctx.Value(ContextKeyConn).(*gossh.ServerConn)
+	var reqPayload remoteUnixForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+		return false, nil
+	}
+	socketPath := reqPayload.SocketPath
+	switch req.Type {
+	case "streamlocal-forward@openssh.com":
+		if srv.ReverseUnixForwardingCallback == nil {
+			return false, nil
+		}
+		ok, policy := srv.ReverseUnixForwardingCallback(ctx, socketPath)
+		if !ok {
+			return false, nil
+		}
+		h.Lock()
+		defer h.Unlock()
+		// don't unlink the socket of another forwarding
+		if _, exists := h.forwards[socketPath]; exists {
+			return false, nil
+		}
+		ln, err := listenUnixSocket(socketPath, policy)
+		if err != nil {
+			return false, nil
+		}
+		f := &unixForward{ln: ln, conn: conn}
+		if h.forwards == nil {
+			h.forwards = make(map[string]*unixForward)
+		}
+		h.forwards[socketPath] = f
+		go h.serve(ctx, f, socketPath)
+		return true, nil
+
+	case "cancel-streamlocal-forward@openssh.com":
+		h.Lock()
+		f, ok := h.forwards[socketPath]
+		// connections may only cancel their own forwardings
+		ok = ok && f.conn == conn
+		if ok {
+			delete(h.forwards, socketPath)
+		}
+		h.Unlock()
+		if ok {
+			f.ln.Close()
+		}
+		return ok, nil
+	default:
+		return false, nil
+	}
+}
+
+// serve opens a channel for each connection accepted on the socket, until
+// the forwarding is canceled or the client disconnects.
+func (h *ForwardedUnixHandler) serve(ctx Context, f *unixForward, socketPath string) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.ln.Close()
+		case <-done:
+		}
+	}()
+	payload := gossh.Marshal(&remoteUnixForwardChannelData{SocketPath: socketPath})
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			break
+		}
+		go func() {
+			ch, reqs, err := f.conn.OpenChannel(forwardedStreamLocalChannelType, payload)
+			if err != nil {
+				c.Close()
+				return
+			}
+			go gossh.DiscardRequests(reqs)
+			proxyChannel(ch, c)
+		}()
+	}
+	f.ln.Close()
+	h.Lock()
+	if h.forwards[socketPath] == f {
+		delete(h.forwards, socketPath)
+	}
+	h.Unlock()
+}
+
+// listenUnixSocket listens on a socket and applies the policy to its file,
+// which is removed when the listener is closed. The socket is set up in a
+// private directory and only then linked into place, so it is never
+// accessible with other permissions.
+func listenUnixSocket(socketPath string, policy UnixSocketPolicy) (net.Listener, error) {
+	if policy.Unlink {
+		if fi, err := os.Lstat(socketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(socketPath)
+		}
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(socketPath), ".streamlocal-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "socket")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	mode := policy.Mode.Perm()
+	if mode == 0 {
+		mode = 0600
+	}
+	err = os.Chmod(tmpPath, mode)
+	if err == nil && (policy.UID != 0 || policy.GID != 0) {
+		uid, gid := policy.UID, policy.GID
+		if uid == 0 {
+			uid = -1
+		}
+		if gid == 0 {
+			gid = -1
+		}
+		err = os.Lchown(tmpPath, uid, gid)
+	}
+	if err == nil {
+		// unlike a rename, linking fails if the path exists
+		err = os.Link(tmpPath, socketPath)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixSocketListener{UnixListener: ln, path: socketPath}, nil
+}
+
+// unixSocketListener removes the socket file that was linked into place when
+// it is closed.
+type unixSocketListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
@@ -0,0 +1,222 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestSessionWithUnixForwarding(t *testing.T, callback LocalUnixForwardingCallback) (string, func(string) (net.Conn, error), func()) {
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skip("unix sockets not supported:", err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(sampleServerResponse)
+		conn.Close()
+	}()
+
+	// serveOnce only registers the default channel handlers
+	sl := newLocalListener()
+	srv := &Server{
+		Handler:                     func(s Session) {},
+		LocalUnixForwardingCallback: callback,
+		ChannelHandlers: map[string]ChannelHandler{
+			"session":                    DefaultSessionHandler,
+			directStreamLocalChannelType: DirectStreamLocalHandler,
+		},
+	}
+	go srv.Serve(sl)
+	_, client, cleanup := newClientSession(t, sl.Addr().String(), nil)
+	dial := func(path string) (net.Conn, error) { return client.Dial("unix", path) }
+	return socketPath, dial, func() {
+		cleanup()
+		srv.Close()
+		l.Close()
+	}
+}
+
+func TestLocalUnixForwardingWorks(t *testing.T) {
+	t.Parallel()
+	var requested string
+	socketPath, dial, cleanup := newTestSessionWithUnixForwarding(t, func(ctx Context, socketPath string) bool {
+		requested = socketPath
+		return true
+	})
+	defer cleanup()
+
+	conn, err := dial(socketPath)
+	if err != nil {
+		t.Fatalf("Error connecting to %v: %v", socketPath, err)
+	}
+	result, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, sampleServerResponse) {
+		t.Fatalf("result = %#v; want %#v", result, sampleServerResponse)
+	}
+	if requested != socketPath {
+		t.Fatalf("callback got %q; want %q", requested, socketPath)
+	}
+}
+
+func TestLocalUnixForwardingRespectsCallback(t *testing.T) {
+	t.Parallel()
+	socketPath, dial, cleanup := newTestSessionWithUnixForwarding(t, AllowUnixSockets("/run/app/*.sock"))
+	defer cleanup()
+
+	_, err := dial(socketPath)
+	if err == nil {
+		t.Fatalf("Expected error connecting to %v but it succeeded", socketPath)
+	}
+	if !strings.Contains(err.Error(), "unix socket forwarding is disabled") {
+		t.Fatalf("Expected permission error but got %#v", err)
+	}
+}
+
+func TestAllowUnixSockets(t *testing.T) {
+	t.Parallel()
+	allow := AllowUnixSockets("/run/app/*.sock", "/var/run/docker.sock")
+	for path, want := range map[string]bool{
+		"/run/app/web.sock":         true,
+		"/var/run/docker.sock":      true,
+		"/run/app/web.pid":          false,
+		"/run/app/sub/web.sock":     false,
+		"/run/app/../../etc/x.sock": false,
+		"/run/app//web.sock":        false,
+		"run/app/web.sock":          false,
+		"":                          false,
+	} {
+		if got := allow(nil, path); got != want {
+			t.Errorf("%q: allowed = %t; want %t", path, got, want)
+		}
+	}
+}
+
+func newTestSessionWithReverseUnixForwarding(t *testing.T, callback ReverseUnixForwardingCallback) (*gossh.Client, func()) {
+	forwards := &ForwardedUnixHandler{}
+	_, client, cleanup := newTestSession(t, &Server{
+		Handler:                       func(s Session) {},
+		ReverseUnixForwardingCallback: callback,
+		RequestHandlers: map[string]RequestHandler{
+			"streamlocal-forward@openssh.com":        forwards.HandleSSHRequest,
+			"cancel-streamlocal-forward@openssh.com": forwards.HandleSSHRequest,
+		},
+	}, nil)
+	return client, cleanup
+}
+
+func TestReverseUnixForwarding(t *testing.T) {
+	t.Parallel()
+	socketPath := filepath.Join(t.TempDir(), "remote.sock")
+	client, cleanup := newTestSessionWithReverseUnixForwarding(t, func(ctx Context, path string) (bool, UnixSocketPolicy) {
+		return path == socketPath, UnixSocketPolicy{Mode: 0660}
+	})
+	defer cleanup()
+
+	if _, err := client.ListenUnix(filepath.Join(filepath.Dir(socketPath), "other.sock")); err == nil {
+		t.Fatal("expected forwarding of other socket to be denied")
+	}
+	l, err := client.ListenUnix(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(socketPath); err != nil || fi.Mode().Perm() != 0660 {
+		t.Fatalf("unexpected socket file: %v %v", fi, err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(sampleServerResponse)
+		conn.Close()
+	}()
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, sampleServerResponse) {
+		t.Fatalf("result = %#v; want %#v", result, sampleServerResponse)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Fatalf("socket file not removed on cancel: %v", err)
+	}
+}
+
+func TestReverseUnixForwardingDisconnect(t *testing.T) {
+	t.Parallel()
+	socketPath := filepath.Join(t.TempDir(), "remote.sock")
+	client, cleanup := newTestSessionWithReverseUnixForwarding(t, func(ctx Context, path string) (bool, UnixSocketPolicy) {
+		return true, UnixSocketPolicy{}
+	})
+	if _, err := client.ListenUnix(socketPath); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(socketPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket file: %v %v", fi, err)
+	}
+	cleanup()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socketPath); os.IsNotExist(err) {
+			break
+		}
+		if i == 100 {
+			t.Fatal("socket file not removed on disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenUnixSocketExisting(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "app.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Skip("unix sockets not supported:", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	if _, err := listenUnixSocket(socketPath, UnixSocketPolicy{}); err == nil {
+		t.Fatal("expected existing socket not to be replaced")
+	}
+	ln, err := listenUnixSocket(socketPath, UnixSocketPolicy{Unlink: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	if _, err := os.Lstat(socketPath); !os.IsNotExist(err) {
+		t.Fatalf("socket file not removed on close: %v", err)
+	}
+	// regular files are never unlinked
+	os.WriteFile(socketPath, nil, 0644)
+	if _, err := listenUnixSocket(socketPath, UnixSocketPolicy{Unlink: true}); err == nil {
+		t.Fatal("expected regular file not to be replaced")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("temporary files remain: %v", entries)
+	}
+}
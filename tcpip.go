@@ -52,17 +52,28 @@ func DirectTCPIPHandler(srv *Server, conn *gossh.ServerConn, newChan gossh.NewCh
 		return
 	}
 	go gossh.DiscardRequests(reqs)
+	proxyChannel(ch, dconn)
+}
 
+// proxyChannel copies data between a forwarding channel and a connection
+// until either side closes, and then closes both.
+func proxyChannel(ch gossh.Channel, conn net.Conn) {
+	// wait for both copies so the channel is counted as open until it closes
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
+		defer wg.Done()
 		defer ch.Close()
-		defer dconn.Close()
-		io.Copy(ch, dconn)
+		defer conn.Close()
+		io.Copy(ch, conn)
 	}()
 	go func() {
+		defer wg.Done()
 		defer ch.Close()
-		defer dconn.Close()
-		io.Copy(dconn, ch)
+		defer conn.Close()
+		io.Copy(conn, ch)
 	}()
+	wg.Wait()
 }
 
 type remoteForwardRequest struct {
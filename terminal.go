@@ -0,0 +1,568 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrInterrupted is returned by Terminal.ReadLine and Terminal.ReadPassword
+// when the user presses Ctrl-C.
+var ErrInterrupted = errors.New("ssh: interrupted")
+
+// defaultTerminalWidth is used when the session has no PTY.
+const defaultTerminalWidth = 80
+
+// CompletionFunc is called by a Terminal when the user presses tab, with the
+// current line and the cursor position in runes. If ok is true, the line and
+// cursor position are replaced by newLine and newPos.
+type CompletionFunc func(line string, pos int) (newLine string, newPos int, ok bool)
+
+// History stores the lines entered in a Terminal so they can be recalled with
+// the arrow keys.
+type History interface {
+	// Add adds a line to the history.
+	Add(line string)
+
+	// Len returns the number of lines in the history.
+	Len() int
+
+	// At returns a line from the history, where 0 is the most recent one.
+	At(i int) string
+}
+
+// MemoryHistory is a History that keeps a bounded number of lines in memory.
+type MemoryHistory struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+// NewMemoryHistory returns a MemoryHistory that keeps up to max lines.
+func NewMemoryHistory(max int) *MemoryHistory {
+	return &MemoryHistory{max: max}
+}
+
+// Add adds a line to the history, unless it repeats the most recent line.
+func (h *MemoryHistory) Add(line string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := len(h.lines); n > 0 && h.lines[n-1] == line {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if h.max > 0 && len(h.lines) > h.max {
+		h.lines = h.lines[len(h.lines)-h.max:]
+	}
+}
+
+func (h *MemoryHistory) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.lines)
+}
+
+func (h *MemoryHistory) At(i int) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lines[len(h.lines)-1-i]
+}
+
+// FileHistory is a History that persists lines to a file, one per line.
+type FileHistory struct {
+	*MemoryHistory
+	path string
+}
+
+// NewFileHistory returns a FileHistory backed by the file at path, loading
+// up to max of the lines already in it.
+func NewFileHistory(path string, max int) (*FileHistory, error) {
+	h := &FileHistory{MemoryHistory: NewMemoryHistory(max), path: path}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		h.MemoryHistory.Add(scanner.Text())
+	}
+	return h, scanner.Err()
+}
+
+// Add adds a line to the history and appends it to the file. Errors writing
+// the file are ignored, since they shouldn't interrupt the session.
+func (h *FileHistory) Add(line string) {
+	if strings.ContainsAny(line, "\r\n") {
+		return
+	}
+	h.MemoryHistory.Add(line)
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	io.WriteString(f, line+"\n")
+}
+
+// Terminal provides line editing on top of a Session, with cursor movement,
+// history and tab completion. It uses the session's PTY window size for line
+// wrapping and honors the ECHO terminal mode. Output written through the
+// Terminal while a line is being read is printed above the line.
+//
+// ReadLine and ReadPassword must not be called concurrently.
+type Terminal struct {
+	// AutoComplete, if non-nil, is called when the user presses tab.
+	AutoComplete CompletionFunc
+
+	// History, if non-nil, stores entered lines for recall with the up and
+	// down arrow keys. NewTerminal sets it to a MemoryHistory.
+	History History
+
+	sess Session
+
+	mu       sync.Mutex
+	prompt   string
+	width    int
+	echo     bool
+	reading  bool
+	line     []rune
+	pos      int
+	oldPos   int
+	maxRows  int
+	histIdx  int
+	histLine []rune
+	pending  []byte
+	afterCR  bool
+
+	readOnce sync.Once
+	input    chan []byte
+	readErr  error
+}
+
+// NewTerminal returns a Terminal that reads lines from the session, showing
+// prompt before each one. If the session has a PTY, the Terminal consumes
+// its window change channel to track the width of the terminal.
+func NewTerminal(s Session, prompt string) *Terminal {
+	t := &Terminal{
+		History: NewMemoryHistory(1000),
+		sess:    s,
+		prompt:  prompt,
+		width:   defaultTerminalWidth,
+		echo:    true,
+		input:   make(chan []byte, 16),
+	}
+	if pty, winCh, ok := s.Pty(); ok {
+		if pty.Window.Width > 0 {
+			t.width = pty.Window.Width
+		}
+		if echo, ok := s.TerminalModes()[gossh.ECHO]; ok && echo == 0 {
+			t.echo = false
+		}
+		go t.watchWindow(winCh)
+	}
+	return t
+}
+
+// SetPrompt sets the prompt shown by ReadLine.
+func (t *Terminal) SetPrompt(prompt string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prompt = prompt
+}
+
+// Write writes to the session. If a line is being read, it is cleared first
+// and redrawn after the output.
+func (t *Terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.reading || !t.echo {
+		return t.sess.Write(p)
+	}
+	t.clearLine()
+	n, err := t.sess.Write(p)
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		t.writeString("\r\n")
+	}
+	t.refresh()
+	return n, err
+}
+
+// ReadLine reads a line of input with line editing. It returns io.EOF if the
+// user presses Ctrl-D on an empty line or the session's input is closed,
+// ErrInterrupted if the user presses Ctrl-C, and the context's error if the
+// session's context is canceled.
+func (t *Terminal) ReadLine() (string, error) {
+	return t.readLine(t.prompt, t.echo, true)
+}
+
+// ReadPassword reads a line of input without echoing it or adding it to the
+// history.
+func (t *Terminal) ReadPassword(prompt string) (string, error) {
+	return t.readLine(prompt, false, false)
+}
+
+func (t *Terminal) readLine(prompt string, echo, history bool) (string, error) {
+	t.readOnce.Do(func() { go t.readInput() })
+
+	t.mu.Lock()
+	savedPrompt, savedEcho := t.prompt, t.echo
+	t.prompt, t.echo = prompt, echo
+	t.reading = true
+	t.line, t.pos, t.oldPos, t.maxRows = nil, 0, 0, 0
+	t.histIdx, t.histLine = -1, nil
+	if echo {
+		t.refresh()
+	} else {
+		t.writeString(prompt)
+	}
+	defer func() {
+		t.mu.Lock()
+		t.prompt, t.echo = savedPrompt, savedEcho
+		t.reading = false
+		t.mu.Unlock()
+	}()
+
+	for {
+		line, done, err := t.processInput(history)
+		t.mu.Unlock()
+		if done {
+			return line, err
+		}
+		select {
+		case b, ok := <-t.input:
+			if !ok {
+				return "", t.readErr
+			}
+			t.mu.Lock()
+			t.pending = append(t.pending, b...)
+		case <-t.sess.Context().Done():
+			return "", t.sess.Context().Err()
+		}
+	}
+}
+
+// processInput handles the pending input. It returns done when a line was
+// completed or reading must stop. It must be called with t.mu held.
+func (t *Terminal) processInput(history bool) (string, bool, error) {
+	for len(t.pending) > 0 {
+		key, rest := parseKey(t.pending)
+		if key == keyIncomplete {
+			return "", false, nil
+		}
+		t.pending = rest
+		if t.afterCR && key == '\n' {
+			t.afterCR = false
+			continue
+		}
+		t.afterCR = key == '\r'
+
+		switch key {
+		case '\r', '\n':
+			line := string(t.line)
+			t.pos = len(t.line)
+			if t.echo {
+				t.refresh()
+			}
+			t.writeString("\r\n")
+			if history && line != "" && t.History != nil {
+				t.History.Add(line)
+			}
+			return line, true, nil
+		case keyCtrlC:
+			t.writeString("^C\r\n")
+			return "", true, ErrInterrupted
+		case keyCtrlD:
+			if len(t.line) == 0 {
+				t.writeString("\r\n")
+				return "", true, io.EOF
+			}
+			t.deleteRunes(t.pos, t.pos+1)
+		case keyBackspace, keyCtrlH:
+			t.deleteRunes(t.pos-1, t.pos)
+		case keyDelete:
+			t.deleteRunes(t.pos, t.pos+1)
+		case keyCtrlA, keyHome:
+			t.pos = 0
+		case keyCtrlE, keyEnd:
+			t.pos = len(t.line)
+		case keyCtrlB, keyLeft:
+			if t.pos > 0 {
+				t.pos--
+			}
+		case keyCtrlF, keyRight:
+			if t.pos < len(t.line) {
+				t.pos++
+			}
+		case keyCtrlK:
+			t.deleteRunes(t.pos, len(t.line))
+		case keyCtrlU:
+			t.deleteRunes(0, t.pos)
+		case keyCtrlW:
+			start := t.pos
+			for start > 0 && t.line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && t.line[start-1] != ' ' {
+				start--
+			}
+			t.deleteRunes(start, t.pos)
+		case keyCtrlL:
+			t.writeString("\x1b[H\x1b[2J")
+			t.oldPos, t.maxRows = 0, 0
+		case keyUp, keyCtrlP:
+			t.recall(1, history)
+		case keyDown, keyCtrlN:
+			t.recall(-1, history)
+		case '\t':
+			if t.AutoComplete == nil {
+				break
+			}
+			newLine, newPos, ok := t.AutoComplete(string(t.line), t.pos)
+			if ok {
+				t.line = []rune(newLine)
+				t.pos = newPos
+				if t.pos < 0 || t.pos > len(t.line) {
+					t.pos = len(t.line)
+				}
+			}
+		default:
+			if key < ' ' || key >= keyUnknown {
+				break
+			}
+			t.line = append(t.line, 0)
+			copy(t.line[t.pos+1:], t.line[t.pos:])
+			t.line[t.pos] = key
+			t.pos++
+		}
+		if t.echo {
+			t.refresh()
+		}
+	}
+	return "", false, nil
+}
+
+func (t *Terminal) deleteRunes(start, end int) {
+	if start < 0 || end > len(t.line) || start >= end {
+		return
+	}
+	t.line = append(t.line[:start], t.line[end:]...)
+	t.pos = start
+}
+
+// recall moves through the history, where delta 1 is one line further back.
+func (t *Terminal) recall(delta int, history bool) {
+	if !history || t.History == nil {
+		return
+	}
+	idx := t.histIdx + delta
+	if idx < -1 || idx >= t.History.Len() {
+		return
+	}
+	if t.histIdx == -1 {
+		t.histLine = append([]rune(nil), t.line...)
+	}
+	t.histIdx = idx
+	if idx == -1 {
+		t.line = t.histLine
+	} else {
+		t.line = []rune(t.History.At(idx))
+	}
+	t.pos = len(t.line)
+}
+
+// refresh redraws the prompt and line, which may wrap over several rows. It
+// must be called with t.mu held.
+func (t *Terminal) refresh() {
+	var b strings.Builder
+	cols := t.width
+	plen := visibleLen(t.prompt)
+	rows := (plen + len(t.line) + cols - 1) / cols
+	rpos := (plen + t.oldPos + cols) / cols
+	oldRows := t.maxRows
+	if rows > t.maxRows {
+		t.maxRows = rows
+	}
+
+	// clear the rows used before, starting from the last one
+	if oldRows-rpos > 0 {
+		fmt.Fprintf(&b, "\x1b[%dB", oldRows-rpos)
+	}
+	for j := 0; j < oldRows-1; j++ {
+		b.WriteString("\r\x1b[0K\x1b[1A")
+	}
+	b.WriteString("\r\x1b[0K")
+
+	b.WriteString(t.prompt)
+	b.WriteString(string(t.line))
+
+	// when the cursor is at the end of a full row, move it to the next one
+	if t.pos > 0 && t.pos == len(t.line) && (plen+t.pos)%cols == 0 {
+		b.WriteString("\n\r")
+		rows++
+		if rows > t.maxRows {
+			t.maxRows = rows
+		}
+	}
+
+	rpos2 := (plen + t.pos + cols) / cols
+	if rows-rpos2 > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", rows-rpos2)
+	}
+	if col := (plen + t.pos) % cols; col > 0 {
+		fmt.Fprintf(&b, "\r\x1b[%dC", col)
+	} else {
+		b.WriteString("\r")
+	}
+	t.oldPos = t.pos
+	t.writeString(b.String())
+}
+
+// clearLine erases the prompt and line so other output can be written. It
+// must be called with t.mu held.
+func (t *Terminal) clearLine() {
+	cols := t.width
+	rpos := (visibleLen(t.prompt) + t.oldPos + cols) / cols
+	if rpos > 1 {
+		t.writeString(fmt.Sprintf("\x1b[%dA", rpos-1))
+	}
+	t.writeString("\r\x1b[J")
+	t.oldPos, t.maxRows = 0, 0
+}
+
+func (t *Terminal) writeString(s string) {
+	io.WriteString(t.sess, s)
+}
+
+func (t *Terminal) readInput() {
+	buf := make([]byte, 256)
+	for {
+		n, err := t.sess.Read(buf)
+		if n > 0 {
+			select {
+			case t.input <- append([]byte(nil), buf[:n]...):
+			case <-t.sess.Context().Done():
+				return
+			}
+		}
+		if err != nil {
+			t.readErr = err
+			close(t.input)
+			return
+		}
+	}
+}
+
+func (t *Terminal) watchWindow(winCh <-chan Window) {
+	for win := range winCh {
+		if win.Width > 0 {
+			t.mu.Lock()
+			t.width = win.Width
+			t.mu.Unlock()
+		}
+	}
+}
+
+// visibleLen returns the number of runes in s that take up space on the
+// screen, skipping ANSI escape sequences.
+func visibleLen(s string) int {
+	n := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '[' {
+			i += 2
+			for i < len(s) && (s[i] < 0x40 || s[i] > 0x7e) {
+				i++
+			}
+			i++
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		n++
+	}
+	return n
+}
+
+// Keys are runes, with control keys using their ASCII codes and other special
+// keys using values beyond the Unicode range.
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlH     = 8
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyBackspace = 127
+
+	keyUnknown = 0x110000 + iota
+	keyIncomplete
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+)
+
+// parseKey decodes the first key in b and returns it along with the rest of
+// b. If b holds an incomplete key, keyIncomplete is returned.
+func parseKey(b []byte) (rune, []byte) {
+	if b[0] != '\x1b' {
+		if !utf8.FullRune(b) {
+			return keyIncomplete, b
+		}
+		r, size := utf8.DecodeRune(b)
+		return r, b[size:]
+	}
+	if len(b) < 2 {
+		return keyIncomplete, b
+	}
+	if b[1] != '[' && b[1] != 'O' {
+		// a lone escape or an alt modified key
+		return keyUnknown, b[1:]
+	}
+	// find the final byte of the control sequence
+	end := 2
+	for end < len(b) && (b[end] < 0x40 || b[end] > 0x7e) {
+		end++
+	}
+	if end == len(b) {
+		return keyIncomplete, b
+	}
+	seq, rest := string(b[2:end+1]), b[end+1:]
+	switch seq {
+	case "A":
+		return keyUp, rest
+	case "B":
+		return keyDown, rest
+	case "C":
+		return keyRight, rest
+	case "D":
+		return keyLeft, rest
+	case "H", "1~", "7~":
+		return keyHome, rest
+	case "F", "4~", "8~":
+		return keyEnd, rest
+	case "3~":
+		return keyDelete, rest
+	}
+	return keyUnknown, rest
+}
@@ -0,0 +1,229 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type terminalResult struct {
+	lines []string
+	err   error
+}
+
+// newTerminalSession starts a pty session whose handler reads lines with a
+// Terminal until an error, and returns the client's stdin along with a
+// channel receiving what was read.
+func newTerminalSession(t *testing.T, modes gossh.TerminalModes, setup func(*Terminal), read func(*Terminal) (string, error)) (io.WriteCloser, <-chan terminalResult, func()) {
+	results := make(chan terminalResult, 1)
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			term := NewTerminal(s, "> ")
+			if setup != nil {
+				setup(term)
+			}
+			var res terminalResult
+			for {
+				line, err := read(term)
+				if err != nil {
+					res.err = err
+					break
+				}
+				res.lines = append(res.lines, line)
+			}
+			results <- res
+		},
+	}, nil)
+	if modes == nil {
+		modes = gossh.TerminalModes{}
+	}
+	if err := session.RequestPty("xterm", 24, 80, modes); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, stdout)
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	return stdin, results, cleanup
+}
+
+func readLine(term *Terminal) (string, error) {
+	return term.ReadLine()
+}
+
+func waitTerminal(t *testing.T, results <-chan terminalResult) terminalResult {
+	select {
+	case res := <-results:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for terminal")
+	}
+	return terminalResult{}
+}
+
+func TestTerminalEditing(t *testing.T) {
+	t.Parallel()
+	stdin, results, cleanup := newTerminalSession(t, nil, nil, readLine)
+	defer cleanup()
+	// backspace, cursor movement and Ctrl-U
+	io.WriteString(stdin, "helo\x7flo\r")
+	io.WriteString(stdin, "wrld\x1b[D\x1b[D\x1b[Do\r\n")
+	io.WriteString(stdin, "junk\x15ok\r")
+	// recall the first line from the history
+	io.WriteString(stdin, "\x1b[A\x1b[A\x1b[A\r")
+	io.WriteString(stdin, "\x04")
+	res := waitTerminal(t, results)
+	if res.err != io.EOF {
+		t.Fatalf("err = %v; want io.EOF", res.err)
+	}
+	want := []string{"hello", "world", "ok", "hello"}
+	if strings.Join(res.lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("lines = %q; want %q", res.lines, want)
+	}
+}
+
+func TestTerminalCompletion(t *testing.T) {
+	t.Parallel()
+	stdin, results, cleanup := newTerminalSession(t, nil, func(term *Terminal) {
+		term.AutoComplete = func(line string, pos int) (string, int, bool) {
+			if line != "he" {
+				return "", 0, false
+			}
+			return "help", 4, true
+		}
+	}, readLine)
+	defer cleanup()
+	io.WriteString(stdin, "he\t me\r\x04")
+	res := waitTerminal(t, results)
+	if len(res.lines) != 1 || res.lines[0] != "help me" {
+		t.Fatalf("lines = %q; want [\"help me\"]", res.lines)
+	}
+}
+
+func TestTerminalInterrupt(t *testing.T) {
+	t.Parallel()
+	stdin, results, cleanup := newTerminalSession(t, nil, nil, readLine)
+	defer cleanup()
+	io.WriteString(stdin, "partial\x03")
+	res := waitTerminal(t, results)
+	if !errors.Is(res.err, ErrInterrupted) {
+		t.Fatalf("err = %v; want ErrInterrupted", res.err)
+	}
+}
+
+func TestTerminalPassword(t *testing.T) {
+	t.Parallel()
+	var term *Terminal
+	stdin, results, cleanup := newTerminalSession(t, nil, func(tt *Terminal) { term = tt }, func(term *Terminal) (string, error) {
+		return term.ReadPassword("password: ")
+	})
+	defer cleanup()
+	io.WriteString(stdin, "secret\r\x03")
+	res := waitTerminal(t, results)
+	if len(res.lines) != 1 || res.lines[0] != "secret" {
+		t.Fatalf("lines = %q; want [\"secret\"]", res.lines)
+	}
+	if n := term.History.Len(); n != 0 {
+		t.Fatalf("history has %d lines; want 0", n)
+	}
+}
+
+func TestTerminalEchoMode(t *testing.T) {
+	t.Parallel()
+	var echo bool
+	stdin, results, cleanup := newTerminalSession(t, gossh.TerminalModes{gossh.ECHO: 0}, func(term *Terminal) {
+		echo = term.echo
+	}, readLine)
+	defer cleanup()
+	io.WriteString(stdin, "quiet\r\x04")
+	res := waitTerminal(t, results)
+	if echo {
+		t.Fatal("expected echo to be disabled by terminal mode")
+	}
+	if len(res.lines) != 1 || res.lines[0] != "quiet" {
+		t.Fatalf("lines = %q; want [\"quiet\"]", res.lines)
+	}
+}
+
+func TestTerminalCanceled(t *testing.T) {
+	t.Parallel()
+	stdin, results, cleanup := newTerminalSession(t, nil, nil, readLine)
+	io.WriteString(stdin, "never finished")
+	cleanup()
+	res := waitTerminal(t, results)
+	if res.err == nil {
+		t.Fatal("expected an error after the session closed")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		in   string
+		key  rune
+		rest string
+	}{
+		{"a", 'a', ""},
+		{"é!", 'é', "!"},
+		{"\xc3", keyIncomplete, "\xc3"},
+		{"\x1b[A", keyUp, ""},
+		{"\x1bOB", keyDown, ""},
+		{"\x1b[3~x", keyDelete, "x"},
+		{"\x1b[1;5C", keyUnknown, ""},
+		{"\x1b[", keyIncomplete, "\x1b["},
+	} {
+		key, rest := parseKey([]byte(tc.in))
+		if key != tc.key || string(rest) != tc.rest {
+			t.Errorf("parseKey(%q) = %v, %q; want %v, %q", tc.in, key, rest, tc.key, tc.rest)
+		}
+	}
+}
+
+func TestVisibleLen(t *testing.T) {
+	t.Parallel()
+	if n := visibleLen("\x1b[1;32mλ\x1b[0m> "); n != 3 {
+		t.Fatalf("visibleLen = %d; want 3", n)
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	t.Parallel()
+	h := NewMemoryHistory(2)
+	for _, line := range []string{"a", "b", "b", "c"} {
+		h.Add(line)
+	}
+	if h.Len() != 2 || h.At(0) != "c" || h.At(1) != "b" {
+		t.Fatalf("unexpected history: len=%d", h.Len())
+	}
+}
+
+func TestFileHistory(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "history")
+	h, err := NewFileHistory(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Add("first")
+	h.Add("second")
+	h, err = NewFileHistory(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Len() != 2 || h.At(0) != "second" || h.At(1) != "first" {
+		t.Fatalf("unexpected history: len=%d", h.Len())
+	}
+}
@@ -0,0 +1,184 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// exitStatusTimeout is the exit status sent when a session is closed because
+// of a timeout, following the convention of timeout(1).
+const exitStatusTimeout = 124
+
+// SessionTimeouts holds the timeouts applied to a single session channel.
+type SessionTimeouts struct {
+	// Idle is how long the session may go without data being sent or
+	// received on its channel, none if zero. Data from the client counts
+	// when it arrives, whether or not the handler reads it.
+	Idle time.Duration
+
+	// Max is the absolute duration of the session, none if zero.
+	Max time.Duration
+
+	// Warning is how long before a timeout a warning is written to the
+	// session's stderr, none if zero.
+	Warning time.Duration
+}
+
+func (t SessionTimeouts) enabled() bool {
+	return t.Idle > 0 || t.Max > 0
+}
+
+// activityChannel is a gossh.Channel that records the time data was last
+// sent or received on it, and adds the amount of data to the given traffic
+// counters.
+type activityChannel struct {
+	gossh.Channel
+	last    int64 // unix nanoseconds, accessed atomically
+	traffic []*traffic
+}
+
+func newActivityChannel(ch gossh.Channel, traffic ...*traffic) *activityChannel {
+	c := &activityChannel{Channel: ch, last: time.Now().UnixNano()}
+	for _, t := range traffic {
+		if t != nil {
+			c.traffic = append(c.traffic, t)
+		}
+	}
+	return c
+}
+
+func (c *activityChannel) touch() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+}
+
+func (c *activityChannel) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.last))
+}
+
+func (c *activityChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.touch()
+		for _, t := range c.traffic {
+			t.in.Add(uint64(n))
+		}
+	}
+	return n, err
+}
+
+func (c *activityChannel) Write(p []byte) (int, error) {
+	c.touch()
+	n, err := c.Channel.Write(p)
+	for _, t := range c.traffic {
+		t.out.Add(uint64(n))
+	}
+	return n, err
+}
+
+func (c *activityChannel) Stderr() io.ReadWriter {
+	return &activityStderr{ReadWriter: c.Channel.Stderr(), c: c}
+}
+
+type activityStderr struct {
+	io.ReadWriter
+	c *activityChannel
+}
+
+func (w *activityStderr) Read(p []byte) (int, error) {
+	n, err := w.ReadWriter.Read(p)
+	if n > 0 {
+		w.c.touch()
+	}
+	return n, err
+}
+
+func (w *activityStderr) Write(p []byte) (int, error) {
+	w.c.touch()
+	n, err := w.ReadWriter.Write(p)
+	for _, t := range w.c.traffic {
+		t.stderr.Add(uint64(n))
+	}
+	return n, err
+}
+
+// sessionTimeouts returns the timeouts that apply to the session, using the
+// server's SessionTimeoutCallback if it is set.
+func (sess *session) sessionTimeouts() SessionTimeouts {
+	if sess.srv.SessionTimeoutCallback != nil {
+		return sess.srv.SessionTimeoutCallback(sess)
+	}
+	return SessionTimeouts{
+		Idle:    sess.srv.SessionIdleTimeout,
+		Max:     sess.srv.SessionMaxTimeout,
+		Warning: sess.srv.SessionTimeoutWarning,
+	}
+}
+
+// watchTimeouts closes the session once it has been idle or open for too
+// long, writing a warning to stderr beforehand if configured. It returns when
+// the session times out or done is closed.
+func (sess *session) watchTimeouts(t SessionTimeouts, done <-chan struct{}) {
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var warned time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		idle := true
+		var deadline time.Time
+		if t.Idle > 0 {
+			deadline = sess.activity.lastActivity().Add(t.Idle)
+		}
+		if t.Max > 0 {
+			if max := start.Add(t.Max); deadline.IsZero() || max.Before(deadline) {
+				deadline = max
+				idle = false
+			}
+		}
+
+		now := time.Now()
+		if !now.Before(deadline) {
+			if idle {
+				sess.timeoutMessage("ssh: session idle for %v, closing", t.Idle)
+			} else {
+				sess.timeoutMessage("ssh: session time limit of %v reached, closing", t.Max)
+			}
+			sess.Exit(exitStatusTimeout)
+			return
+		}
+
+		next := deadline
+		if t.Warning > 0 && !warned.Equal(deadline) {
+			if warnAt := deadline.Add(-t.Warning); now.Before(warnAt) {
+				next = warnAt
+			} else {
+				warned = deadline
+				left := deadline.Sub(now).Round(time.Second)
+				if idle {
+					sess.timeoutMessage("ssh: session will be closed in %v due to inactivity", left)
+				} else {
+					sess.timeoutMessage("ssh: session will be closed in %v due to the time limit", left)
+				}
+			}
+		}
+		timer.Reset(next.Sub(now))
+	}
+}
+
+// timeoutMessage writes a line to stderr without counting it as activity.
+func (sess *session) timeoutMessage(format string, args ...interface{}) {
+	eol := "\n"
+	if sess.pty != nil {
+		eol = "\r\n"
+	}
+	fmt.Fprintf(sess.activity.Channel.Stderr(), format+eol, args...)
+}
@@ -0,0 +1,122 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestSessionIdleTimeout(t *testing.T) {
+	t.Parallel()
+	session, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			if s.RawCommand() == "busy" {
+				for i := 0; i < 10; i++ {
+					io.WriteString(s, ".")
+					time.Sleep(20 * time.Millisecond)
+				}
+				return
+			}
+			if s.RawCommand() == "typing" {
+				// input counts as activity without being read
+				for ev := range s.Events() {
+					if _, ok := ev.(EOFEvent); ok {
+						return
+					}
+				}
+			}
+			<-s.Context().Done()
+		},
+		SessionIdleTimeout:    200 * time.Millisecond,
+		SessionTimeoutWarning: 100 * time.Millisecond,
+	}, nil)
+	defer cleanup()
+
+	// a session with regular output outlives the idle timeout
+	out, err := session.Output("busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 10 {
+		t.Fatalf("stdout = %q; want 10 dots", out)
+	}
+
+	typing, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := typing.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := typing.Start("typing"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		io.WriteString(stdin, ".")
+		time.Sleep(20 * time.Millisecond)
+	}
+	stdin.Close()
+	if err := typing.Wait(); err != nil {
+		t.Fatalf("session with regular input: %v", err)
+	}
+
+	idle, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	idle.Stderr = &stderr
+	err = idle.Run("idle")
+	e, ok := err.(*gossh.ExitError)
+	if !ok {
+		t.Fatalf("expected ExitError but got %T", err)
+	}
+	if e.ExitStatus() != exitStatusTimeout {
+		t.Fatalf("exit-status = %d; want %d", e.ExitStatus(), exitStatusTimeout)
+	}
+	if !strings.Contains(stderr.String(), "due to inactivity") {
+		t.Fatalf("stderr = %q; missing warning", stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "session idle for") {
+		t.Fatalf("stderr = %q; missing timeout message", stderr.String())
+	}
+}
+
+func TestSessionTimeoutCallback(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			for {
+				if _, err := io.WriteString(s, "."); err != nil {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		},
+		SessionTimeoutCallback: func(sess Session) SessionTimeouts {
+			if sess.User() != "testuser" {
+				return SessionTimeouts{}
+			}
+			return SessionTimeouts{Max: 100 * time.Millisecond}
+		},
+	}, nil)
+	defer cleanup()
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	err := session.Run("")
+	e, ok := err.(*gossh.ExitError)
+	if !ok {
+		t.Fatalf("expected ExitError but got %T", err)
+	}
+	if e.ExitStatus() != exitStatusTimeout {
+		t.Fatalf("exit-status = %d; want %d", e.ExitStatus(), exitStatusTimeout)
+	}
+	if !strings.Contains(stderr.String(), "time limit") {
+		t.Fatalf("stderr = %q; missing timeout message", stderr.String())
+	}
+}
@@ -0,0 +1,212 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrTunnelNotFound is returned by TunnelRegistry.Dial for endpoints that no
+// client forwards.
+var ErrTunnelNotFound = errors.New("ssh: tunnel not found")
+
+// TunnelRegistry handles reverse port forwarding like ForwardedTCPHandler,
+// but registers the requested bind addresses as virtual endpoints instead of
+// listening on them. Server code connects to an endpoint with Dial, which
+// opens a forwarded-tcpip channel to the client that registered it. As no OS
+// listeners are involved, clients can claim the same nominal port as long as
+// the endpoint names differ.
+//
+// It can be enabled by adding the HandleSSHRequest callback to the server's
+// RequestHandlers under tcpip-forward and cancel-tcpip-forward. Requests are
+// subject to the server's ReversePortForwardingCallback, and endpoints are
+// removed when the forwarding is canceled or the client disconnects.
+type TunnelRegistry struct {
+	// Name returns the endpoint name for a forwarding request, such as a
+	// host name derived from the user. It defaults to the "host:port" of the
+	// bind address.
+	Name func(ctx Context, bindAddr string, bindPort uint32) string
+
+	mu         sync.Mutex
+	tunnels    map[string]*tunnel
+	originPort uint32 // last port of the made-up originator of channels
+}
+
+// tunnel is a virtual endpoint registered by a client.
+type tunnel struct {
+	conn     *gossh.ServerConn
+	bindAddr string
+	bindPort uint32
+	done     chan struct{} // closed when the forwarding is canceled
+}
+
+const (
+	// firstVirtualPort is the first port assigned to requests for port 0.
+	firstVirtualPort = 32768
+
+	// firstOriginPort is the first port of the originator of channels,
+	// which clients require to be valid.
+	firstOriginPort = 49152
+)
+
+func (r *TunnelRegistry) name(ctx Context, bindAddr string, bindPort uint32) string {
+	if r.Name != nil {
+		return r.Name(ctx, bindAddr, bindPort)
+	}
+	return net.JoinHostPort(bindAddr, strconv.FormatUint(uint64(bindPort), 10))
+}
+
+// register adds a tunnel under the given name, unless the name is taken.
+func (r *TunnelRegistry) register(name string, t *tunnel) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, taken := r.tunnels[name]; taken {
+		return false
+	}
+	if r.tunnels == nil {
+		r.tunnels = make(map[string]*tunnel)
+	}
+	r.tunnels[name] = t
+	return true
+}
+
+func (r *TunnelRegistry) HandleSSHRequest(ctx Context, srv *Server, req *gossh.Request) (bool, []byte) {
+	conn := ctx.Value(ContextKeyConn).(*gossh.ServerConn)
+	switch req.Type {
+	case "tcpip-forward":
+		var reqPayload remoteForwardRequest
+		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+			return false, []byte{}
+		}
+		if srv.ReversePortForwardingCallback == nil || !srv.ReversePortForwardingCallback(ctx, reqPayload.BindAddr, reqPayload.BindPort) {
+			return false, []byte("port forwarding is disabled")
+		}
+		t := &tunnel{conn: conn, bindAddr: reqPayload.BindAddr, bindPort: reqPayload.BindPort, done: make(chan struct{})}
+		var name string
+		if t.bindPort != 0 {
+			name = r.name(ctx, t.bindAddr, t.bindPort)
+			if !r.register(name, t) {
+				return false, []byte{}
+			}
+		} else {
+			// assign the first free virtual port, unless the name doesn't
+			// depend on the port, in which case no other port would help
+			prev := ""
+			for port := uint32(firstVirtualPort); ; port++ {
+				if port > 65535 {
+					return false, []byte{}
+				}
+				t.bindPort = port
+				name = r.name(ctx, t.bindAddr, port)
+				if r.register(name, t) {
+					break
+				}
+				if name == prev {
+					return false, []byte{}
+				}
+				prev = name
+			}
+		}
+		go func() {
+			select {
+			case <-ctx.Done():
+				r.mu.Lock()
+				if r.tunnels[name] == t {
+					delete(r.tunnels, name)
+				}
+				r.mu.Unlock()
+			case <-t.done:
+			}
+		}()
+		return true, gossh.Marshal(&remoteForwardSuccess{t.bindPort})
+
+	case "cancel-tcpip-forward":
+		var reqPayload remoteForwardCancelRequest
+		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+			return false, []byte{}
+		}
+		name := r.name(ctx, reqPayload.BindAddr, reqPayload.BindPort)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// connections may only cancel their own forwardings
+		t := r.tunnels[name]
+		if t == nil || t.conn != conn {
+			return false, nil
+		}
+		delete(r.tunnels, name)
+		close(t.done)
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// Dial connects to the endpoint with the given name. The client that
+// registered it connects the returned net.Conn to its forwarding target, and
+// sees a made-up local address as the originator.
+func (r *TunnelRegistry) Dial(ctx context.Context, name string) (net.Conn, error) {
+	r.mu.Lock()
+	t := r.tunnels[name]
+	if r.originPort < firstOriginPort || r.originPort >= 65535 {
+		r.originPort = firstOriginPort
+	} else {
+		r.originPort++
+	}
+	originPort := r.originPort
+	r.mu.Unlock()
+	if t == nil {
+		return nil, ErrTunnelNotFound
+	}
+	payload := gossh.Marshal(&remoteForwardChannelData{
+		DestAddr:   t.bindAddr,
+		DestPort:   t.bindPort,
+		OriginAddr: "127.0.0.1",
+		OriginPort: originPort,
+	})
+
+	type result struct {
+		ch   gossh.Channel
+		reqs <-chan *gossh.Request
+		err  error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		ch, reqs, err := t.conn.OpenChannel(forwardedTCPChannelType, payload)
+		opened <- result{ch, reqs, err}
+	}()
+	var res result
+	select {
+	case res = <-opened:
+	case <-ctx.Done():
+		go func() {
+			if res := <-opened; res.err == nil {
+				go gossh.DiscardRequests(res.reqs)
+				res.ch.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	go gossh.DiscardRequests(res.reqs)
+
+	local, remote := net.Pipe()
+	go proxyChannel(res.ch, remote)
+	return &tunnelConn{Conn: local, remoteAddr: t.conn.RemoteAddr()}, nil
+}
+
+// tunnelConn is a connection over a tunnel, whose remote address is the one
+// of the client.
+type tunnelConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
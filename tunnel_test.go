@@ -0,0 +1,189 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTunnelTestServer(t *testing.T, registry *TunnelRegistry) string {
+	l := newLocalListener()
+	srv := &Server{
+		Handler: func(s Session) {},
+		ReversePortForwardingCallback: func(ctx Context, bindHost string, bindPort uint32) bool {
+			return bindHost == "127.0.0.1"
+		},
+		RequestHandlers: map[string]RequestHandler{
+			"tcpip-forward":        registry.HandleSSHRequest,
+			"cancel-tcpip-forward": registry.HandleSSHRequest,
+		},
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// serveTunnel accepts connections on a client's forwarded listener and
+// greets them with the given message.
+func serveTunnel(l net.Listener, greeting string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, greeting)
+		conn.Close()
+	}
+}
+
+func readTunnel(t *testing.T, registry *TunnelRegistry, name string) string {
+	t.Helper()
+	conn, err := registry.Dial(context.Background(), name)
+	if err != nil {
+		t.Fatalf("dial %s: %v", name, err)
+	}
+	defer conn.Close()
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestTunnelRegistry(t *testing.T) {
+	t.Parallel()
+	registry := &TunnelRegistry{
+		Name: func(ctx Context, bindAddr string, bindPort uint32) string {
+			return ctx.User() + ".example.com:" + strconv.Itoa(int(bindPort))
+		},
+	}
+	addr := newTunnelTestServer(t, registry)
+
+	// clients claim the same port under different names
+	for _, user := range []string{"alice", "bob"} {
+		_, client, cleanup := newClientSession(t, addr, &gossh.ClientConfig{User: user})
+		defer cleanup()
+		l, err := client.Listen("tcp", "127.0.0.1:80")
+		if err != nil {
+			t.Fatalf("%s: %v", user, err)
+		}
+		go serveTunnel(l, "hello from "+user)
+	}
+	_, client, cleanup := newClientSession(t, addr, &gossh.ClientConfig{User: "alice"})
+	defer cleanup()
+	if _, err := client.Listen("tcp", "127.0.0.1:80"); err == nil {
+		t.Fatal("expected conflicting forwarding to be rejected")
+	}
+	if _, err := client.Listen("tcp", "0.0.0.0:81"); err == nil {
+		t.Fatal("expected forwarding denied by the callback to be rejected")
+	}
+
+	for _, user := range []string{"alice", "bob"} {
+		if got := readTunnel(t, registry, user+".example.com:80"); got != "hello from "+user {
+			t.Fatalf("%s: got %q", user, got)
+		}
+	}
+	if _, err := registry.Dial(context.Background(), "carol.example.com:80"); err != ErrTunnelNotFound {
+		t.Fatalf("expected ErrTunnelNotFound, got %v", err)
+	}
+
+	// the endpoint is free once canceled
+	l, err := client.Listen("tcp", "127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Dial(context.Background(), "alice.example.com:8080"); err != ErrTunnelNotFound {
+		t.Fatalf("expected ErrTunnelNotFound after cancel, got %v", err)
+	}
+}
+
+func TestTunnelRegistryDisconnect(t *testing.T) {
+	t.Parallel()
+	registry := &TunnelRegistry{}
+	addr := newTunnelTestServer(t, registry)
+
+	_, client, cleanup := newClientSession(t, addr, nil)
+	l, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTunnel(l, "hello")
+	name := l.Addr().String()
+	if name != fmt.Sprintf("127.0.0.1:%d", firstVirtualPort) {
+		t.Fatalf("assigned endpoint = %s", name)
+	}
+	if got := readTunnel(t, registry, name); got != "hello" {
+		t.Fatalf("got %q", got)
+	}
+
+	cleanup()
+	for i := 0; ; i++ {
+		if _, err := registry.Dial(context.Background(), name); err == ErrTunnelNotFound {
+			break
+		}
+		if i == 100 {
+			t.Fatal("endpoint not removed on disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnelRegistryPortIndependentName(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	registry := &TunnelRegistry{
+		Name: func(ctx Context, bindAddr string, bindPort uint32) string {
+			calls.Add(1)
+			return ctx.User() + ".example.com"
+		},
+	}
+	addr := newTunnelTestServer(t, registry)
+
+	_, client, cleanup := newClientSession(t, addr, &gossh.ClientConfig{User: "alice"})
+	defer cleanup()
+	if _, err := client.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	calls.Store(0)
+	if _, err := client.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Fatal("expected second forwarding of the same name to be rejected")
+	}
+	if n := calls.Load(); n > 3 {
+		t.Fatalf("Name called %d times", n)
+	}
+}
+
+func TestTunnelRegistryNameReentrant(t *testing.T) {
+	t.Parallel()
+	registry := &TunnelRegistry{}
+	// Name may use the registry, as it isn't called with the lock held
+	registry.Name = func(ctx Context, bindAddr string, bindPort uint32) string {
+		name := fmt.Sprintf("%s-%d", ctx.User(), bindPort)
+		if _, err := registry.Dial(context.Background(), name); err == nil {
+			t.Errorf("unexpected tunnel %s", name)
+		}
+		return name
+	}
+	addr := newTunnelTestServer(t, registry)
+
+	_, client, cleanup := newClientSession(t, addr, nil)
+	defer cleanup()
+	l, err := client.Listen("tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTunnel(l, "hello")
+	if got := readTunnel(t, registry, "testuser-80"); got != "hello" {
+		t.Fatalf("got %q", got)
+	}
+}
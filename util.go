@@ -8,6 +8,9 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// ttyOpEnd terminates the encoded terminal modes of a pty-req.
+const ttyOpEnd = 0
+
 func generateSigner() (ssh.Signer, error) {
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -16,7 +19,7 @@ func generateSigner() (ssh.Signer, error) {
 	return ssh.NewSignerFromKey(key)
 }
 
-func parsePtyRequest(s []byte) (pty Pty, ok bool) {
+func parsePtyRequest(s []byte) (pty Pty, modes ssh.TerminalModes, ok bool) {
 	term, s, ok := parseString(s)
 	if !ok {
 		return
@@ -25,7 +28,7 @@ func parsePtyRequest(s []byte) (pty Pty, ok bool) {
 	if !ok {
 		return
 	}
-	height32, _, ok := parseUint32(s)
+	height32, s, ok := parseUint32(s)
 	if !ok {
 		return
 	}
@@ -36,9 +39,38 @@ func parsePtyRequest(s []byte) (pty Pty, ok bool) {
 			Height: int(height32),
 		},
 	}
+	// the pixel dimensions and terminal modes are optional for our purposes,
+	// so a request that omits them is still accepted.
+	if _, s, ok := parseUint32(s); ok {
+		if _, s, ok := parseUint32(s); ok {
+			if encoded, _, ok := parseString(s); ok {
+				modes = parseTerminalModes([]byte(encoded))
+			}
+		}
+	}
 	return
 }
 
+// parseTerminalModes parses encoded terminal modes as specified in RFC 4254
+// Section 8. Parsing stops at TTY_OP_END or at the first opcode without a
+// defined argument.
+func parseTerminalModes(s []byte) ssh.TerminalModes {
+	modes := ssh.TerminalModes{}
+	for len(s) > 0 {
+		opcode := s[0]
+		if opcode == ttyOpEnd || opcode >= 160 {
+			break
+		}
+		value, rest, ok := parseUint32(s[1:])
+		if !ok {
+			break
+		}
+		modes[opcode] = value
+		s = rest
+	}
+	return modes
+}
+
 func parseWinchRequest(s []byte) (win Window, ok bool) {
 	width32, s, ok := parseUint32(s)
 	if width32 < 1 {
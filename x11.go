@@ -0,0 +1,169 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	x11RequestType = "x11-req"
+	x11ChannelType = "x11"
+
+	x11BasePort = 6000
+	x11UnixDir  = "/tmp/.X11-unix"
+
+	// x11MaxDisplays is how many display numbers NewX11Listener tries
+	// before giving up.
+	x11MaxDisplays = 1000
+)
+
+// X11DisplayOffset is the first display number used by NewX11Listener, to
+// avoid clashing with real X servers. It matches the default of OpenSSH.
+var X11DisplayOffset = 10
+
+// X11 represents an X11 forwarding request as specified in RFC 4254 Section
+// 6.3.1.
+type X11 struct {
+	// SingleConnection is true if only one X11 connection should be
+	// forwarded.
+	SingleConnection bool
+
+	// AuthProtocol is the X11 authentication protocol, typically
+	// "MIT-MAGIC-COOKIE-1".
+	AuthProtocol string
+
+	// AuthCookie is the hex encoded X11 authentication cookie.
+	AuthCookie string
+
+	// ScreenNumber is the X11 screen number.
+	ScreenNumber uint32
+}
+
+// x11 channel data as specified in RFC 4254 Section 6.3.2
+type x11ChannelData struct {
+	OriginAddr string
+	OriginPort uint32
+}
+
+func parseX11Request(payload []byte) (X11, bool) {
+	var req X11
+	if err := gossh.Unmarshal(payload, &req); err != nil {
+		return X11{}, false
+	}
+	return req, true
+}
+
+// X11Listener listens for connections from X11 clients on a local display,
+// either on a TCP port on the loopback interface or on a Unix socket.
+type X11Listener struct {
+	net.Listener
+
+	// Display is the display number the listener is bound to.
+	Display int
+
+	network string
+}
+
+// NewX11Listener listens on the first free X11 display at or after
+// X11DisplayOffset. With network "tcp", it listens on 127.0.0.1 port 6000
+// plus the display number. With network "unix", it listens on the socket
+// /tmp/.X11-unix/X<display>, which only local clients can connect to.
+func NewX11Listener(network string) (*X11Listener, error) {
+	switch network {
+	case "tcp":
+	case "unix":
+		if err := os.MkdirAll(x11UnixDir, 01777); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("ssh: unsupported X11 network " + network)
+	}
+	for display := X11DisplayOffset; display < X11DisplayOffset+x11MaxDisplays; display++ {
+		var addr string
+		if network == "tcp" {
+			addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(x11BasePort+display))
+		} else {
+			addr = filepath.Join(x11UnixDir, "X"+strconv.Itoa(display))
+		}
+		l, err := net.Listen(network, addr)
+		if err == nil {
+			return &X11Listener{Listener: l, Display: display, network: network}, nil
+		}
+	}
+	return nil, errors.New("ssh: no free X11 display")
+}
+
+// DisplayName returns the value of the DISPLAY environment variable that X11
+// clients should use to connect to the listener.
+func (l *X11Listener) DisplayName(screen uint32) string {
+	if l.network == "unix" {
+		return fmt.Sprintf(":%d.%d", l.Display, screen)
+	}
+	return fmt.Sprintf("localhost:%d.%d", l.Display, screen)
+}
+
+// Environ returns the session's environment with DISPLAY set for the
+// listener and the screen the client requested, for use with commands run on
+// behalf of the session.
+func (l *X11Listener) Environ(s Session) []string {
+	x11, _ := s.X11()
+	return append(s.Environ(), "DISPLAY="+l.DisplayName(x11.ScreenNumber))
+}
+
+// ForwardX11Connections takes connections from a listener to proxy into the
+// session on "x11" channels opened back to the client. It blocks and services
+// connections until the listener stops accepting. If the client requested a
+// single connection, the listener is closed after the first one.
+func ForwardX11Connections(l net.Listener, s Session) {
+	x11, ok := s.X11()
+	if !ok {
+		return
+	}
+	sshConn := s.Context().Value(ContextKeyConn).(gossh.Conn)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if x11.SingleConnection {
+			l.Close()
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			data := x11ChannelData{OriginAddr: "127.0.0.1"}
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				data.OriginAddr = addr.IP.String()
+				data.OriginPort = uint32(addr.Port)
+			}
+			channel, reqs, err := sshConn.OpenChannel(x11ChannelType, gossh.Marshal(&data))
+			if err != nil {
+				return
+			}
+			defer channel.Close()
+			go gossh.DiscardRequests(reqs)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				io.Copy(conn, channel)
+				if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				wg.Done()
+			}()
+			go func() {
+				io.Copy(channel, conn)
+				channel.CloseWrite()
+				wg.Done()
+			}()
+			wg.Wait()
+		}(conn)
+	}
+}
@@ -0,0 +1,115 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestX11Forwarding(t *testing.T) {
+	t.Parallel()
+	cookie := "0123456789abcdef0123456789abcdef"
+	session, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			x11, ok := s.X11()
+			if !ok {
+				t.Error("expected X11 forwarding to be accepted")
+				return
+			}
+			if x11.AuthCookie != cookie || x11.ScreenNumber != 1 || !x11.SingleConnection {
+				t.Errorf("unexpected X11 request %#v", x11)
+			}
+			l, err := NewX11Listener("tcp")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer l.Close()
+			go ForwardX11Connections(l, s)
+			for _, kv := range l.Environ(s) {
+				if strings.HasPrefix(kv, "DISPLAY=") {
+					io.WriteString(s, kv+"\n")
+				}
+			}
+			io.Copy(io.Discard, s)
+		},
+		X11Callback: func(ctx Context, x11 X11) bool {
+			return x11.AuthProtocol == "MIT-MAGIC-COOKIE-1"
+		},
+	}, nil)
+	defer cleanup()
+
+	x11Chans := client.HandleChannelOpen(x11ChannelType)
+	go func() {
+		for newChan := range x11Chans {
+			ch, reqs, err := newChan.Accept()
+			if err != nil {
+				continue
+			}
+			go gossh.DiscardRequests(reqs)
+			go func() {
+				defer ch.Close()
+				io.Copy(ch, ch) // echo, standing in for the X server
+			}()
+		}
+	}()
+
+	ok, err := session.SendRequest(x11RequestType, true, gossh.Marshal(&X11{
+		SingleConnection: true,
+		AuthProtocol:     "MIT-MAGIC-COOKIE-1",
+		AuthCookie:       cookie,
+		ScreenNumber:     1,
+	}))
+	if err != nil || !ok {
+		t.Fatalf("x11-req failed: %v %v", ok, err)
+	}
+	stdin, _ := session.StdinPipe()
+	defer stdin.Close()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var display int
+	if _, err := fmt.Sscanf(strings.TrimSpace(line), "DISPLAY=localhost:%d.1", &display); err != nil {
+		t.Fatalf("unexpected display %q: %v", line, err)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(x11BasePort+display)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q; want ping", buf)
+	}
+}
+
+func TestX11ForwardingDeniedByDefault(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {},
+	}, nil)
+	defer cleanup()
+	ok, err := session.SendRequest(x11RequestType, true, gossh.Marshal(&X11{AuthProtocol: "MIT-MAGIC-COOKIE-1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected x11-req to be rejected without X11Callback")
+	}
+}